@@ -8,9 +8,12 @@ import (
 )
 
 // ast中每一个节点都要实现TokenLiteral()方法
+// Pos()和End()给出节点在源码中的范围[Pos, End)
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Pos() token.Position
+	End() token.Position
 }
 
 type Statement interface {
@@ -23,6 +26,12 @@ type Expression interface {
 	expressionNode()
 }
 
+// 解构时绑定变量的模式
+type Pattern interface {
+	Node
+	patternNode()
+}
+
 type Program struct {
 	Statements []Statement
 }
@@ -36,6 +45,19 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Pos() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return token.Position{}
+}
+func (p *Program) End() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[len(p.Statements)-1].End()
+	}
+	return token.Position{}
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 
@@ -53,6 +75,8 @@ type Identifier struct {
 func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
 func (i *Identifier) String() string       { return i.Value }
+func (i *Identifier) Pos() token.Position  { return i.Token.Pos }
+func (i *Identifier) End() token.Position  { return i.Token.End }
 
 type IntegerLiteral struct {
 	Token token.Token
@@ -62,6 +86,19 @@ type IntegerLiteral struct {
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
+func (il *IntegerLiteral) Pos() token.Position  { return il.Token.Pos }
+func (il *IntegerLiteral) End() token.Position  { return il.Token.End }
+
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode()      {}
+func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
+func (fl *FloatLiteral) Pos() token.Position  { return fl.Token.Pos }
+func (fl *FloatLiteral) End() token.Position  { return fl.Token.End }
 
 type StringLiteral struct {
 	Token token.Token // '"'词法单元
@@ -71,15 +108,57 @@ type StringLiteral struct {
 func (sl *StringLiteral) expressionNode()      {}
 func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
 func (sl *StringLiteral) String() string       { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() token.Position  { return sl.Token.Pos }
+func (sl *StringLiteral) End() token.Position  { return sl.Token.End }
+
+// "a ${x} b"，Parts中字面量部分是StringLiteral（词法单元为INTERP_*），其余为插值表达式
+type InterpolatedString struct {
+	Token    token.Token // INTERP_START词法单元
+	Parts    []Expression
+	EndToken token.Token // INTERP_END词法单元
+}
+
+func (is *InterpolatedString) expressionNode()      {}
+func (is *InterpolatedString) TokenLiteral() string { return is.Token.Literal }
+func (is *InterpolatedString) Pos() token.Position  { return is.Token.Pos }
+func (is *InterpolatedString) End() token.Position  { return is.EndToken.End }
+func (is *InterpolatedString) String() string {
+	var out bytes.Buffer
+
+	for _, part := range is.Parts {
+		if isInterpolationText(part) {
+			out.WriteString(part.String())
+		} else {
+			out.WriteString("${" + part.String() + "}")
+		}
+	}
+
+	return out.String()
+}
+
+func isInterpolationText(part Expression) bool {
+	sl, ok := part.(*StringLiteral)
+	if !ok {
+		return false
+	}
+	switch sl.Token.Type {
+	case token.INTERP_START, token.INTERP_MID, token.INTERP_END:
+		return true
+	}
+	return false
+}
 
 // 数组
 type ArrayLiteral struct {
 	Token    token.Token // '['词法单元，作为前缀表达式时
 	Elements []Expression
+	EndToken token.Token // ']'词法单元
 }
 
 func (al *ArrayLiteral) expressionNode()      {}
 func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
+func (al *ArrayLiteral) Pos() token.Position  { return al.Token.Pos }
+func (al *ArrayLiteral) End() token.Position  { return al.EndToken.End }
 func (al *ArrayLiteral) String() string {
 	var out bytes.Buffer
 	var elements []string
@@ -95,12 +174,15 @@ func (al *ArrayLiteral) String() string {
 }
 
 type HashLiteral struct {
-	Token token.Token // '{'词法单元
-	Pairs map[Expression]Expression
+	Token    token.Token // '{'词法单元
+	Pairs    map[Expression]Expression
+	EndToken token.Token // '}'词法单元
 }
 
 func (hl *HashLiteral) expressionNode()      {}
 func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
+func (hl *HashLiteral) Pos() token.Position  { return hl.Token.Pos }
+func (hl *HashLiteral) End() token.Position  { return hl.EndToken.End }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 	var pairs []string
@@ -118,18 +200,25 @@ func (hl *HashLiteral) String() string {
 
 // 使用数组
 type IndexExpression struct {
-	Token token.Token // '['词法单元，作为中缀表达式时
-	Left  Expression
-	Index Expression
+	Token    token.Token // '['或'?['词法单元，作为中缀表达式时
+	Left     Expression
+	Index    Expression
+	EndToken token.Token // ']'词法单元
+	Optional bool        // a?[i]，a为null时整条链的结果为null
 }
 
 func (ie *IndexExpression) expressionNode()      {}
 func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IndexExpression) Pos() token.Position  { return startOf(ie.Left, ie.Token) }
+func (ie *IndexExpression) End() token.Position  { return ie.EndToken.End }
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
 
 	out.WriteString("(")
 	out.WriteString(ie.Left.String())
+	if ie.Optional {
+		out.WriteString("?")
+	}
 	out.WriteString("[")
 	out.WriteString(ie.Index.String())
 	out.WriteString("])")
@@ -137,6 +226,22 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// a.b，a是hash时相当于a["b"]，否则取a的类型上名为b的方法
+type MemberExpression struct {
+	Token    token.Token // '.'或'?.'词法单元
+	Object   Expression
+	Property *Identifier
+	Optional bool // a?.b，a为null时整条链的结果为null
+}
+
+func (me *MemberExpression) expressionNode()      {}
+func (me *MemberExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *MemberExpression) Pos() token.Position  { return startOf(me.Object, me.Token) }
+func (me *MemberExpression) End() token.Position  { return endOf(me.Property, me.Token) }
+func (me *MemberExpression) String() string {
+	return "(" + me.Object.String() + me.Token.Literal + me.Property.String() + ")"
+}
+
 type Boolean struct {
 	Token token.Token
 	Value bool
@@ -145,6 +250,18 @@ type Boolean struct {
 func (b *Boolean) expressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
 func (b *Boolean) String() string       { return b.Token.Literal }
+func (b *Boolean) Pos() token.Position  { return b.Token.Pos }
+func (b *Boolean) End() token.Position  { return b.Token.End }
+
+type NullLiteral struct {
+	Token token.Token
+}
+
+func (nl *NullLiteral) expressionNode()      {}
+func (nl *NullLiteral) TokenLiteral() string { return nl.Token.Literal }
+func (nl *NullLiteral) String() string       { return nl.Token.Literal }
+func (nl *NullLiteral) Pos() token.Position  { return nl.Token.Pos }
+func (nl *NullLiteral) End() token.Position  { return nl.Token.End }
 
 type PrefixExpression struct {
 	Token    token.Token // 前缀运算符词法单元
@@ -154,6 +271,8 @@ type PrefixExpression struct {
 
 func (pe *PrefixExpression) expressionNode()      {}
 func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() token.Position  { return pe.Token.Pos }
+func (pe *PrefixExpression) End() token.Position  { return endOf(pe.Right, pe.Token) }
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
 
@@ -174,6 +293,8 @@ type InfixExpression struct {
 
 func (ie *InfixExpression) expressionNode()      {}
 func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *InfixExpression) Pos() token.Position  { return startOf(ie.Left, ie.Token) }
+func (ie *InfixExpression) End() token.Position  { return endOf(ie.Right, ie.Token) }
 func (ie *InfixExpression) String() string {
 	var out bytes.Buffer
 
@@ -186,6 +307,30 @@ func (ie *InfixExpression) String() string {
 	return out.String()
 }
 
+// x = 5、x += 1，赋值也是表达式，值为赋值后的新值
+type AssignExpression struct {
+	Token    token.Token // 赋值运算符词法单元
+	Target   Expression  // 标识符、索引表达式或成员表达式
+	Operator string      // "="、"+="、"-="、"*="或"/="
+	Value    Expression
+}
+
+func (ae *AssignExpression) expressionNode()      {}
+func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignExpression) Pos() token.Position  { return startOf(ae.Target, ae.Token) }
+func (ae *AssignExpression) End() token.Position  { return endOf(ae.Value, ae.Token) }
+func (ae *AssignExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ae.Target.String())
+	out.WriteString(" " + ae.Operator + " ")
+	if ae.Value != nil {
+		out.WriteString(ae.Value.String())
+	}
+
+	return out.String()
+}
+
 type IfExpression struct {
 	Token       token.Token // 'if'词法单元
 	Condition   Expression
@@ -195,6 +340,16 @@ type IfExpression struct {
 
 func (ie *IfExpression) expressionNode()      {}
 func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IfExpression) Pos() token.Position  { return ie.Token.Pos }
+func (ie *IfExpression) End() token.Position {
+	if ie.Alternative != nil {
+		return ie.Alternative.End()
+	}
+	if ie.Consequence != nil {
+		return ie.Consequence.End()
+	}
+	return ie.Token.End
+}
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("if")
@@ -211,19 +366,25 @@ func (ie *IfExpression) String() string {
 type FunctionLiteral struct {
 	Token      token.Token // fn 词法单元
 	Parameters []*Identifier
+	Defaults   []Expression // 与Parameters一一对应，没有默认值的为nil
+	Rest       *Identifier  // 最后的...rest参数，没有时为nil
 	Body       *BlockStatement
 	Name       string
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
 func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FunctionLiteral) Pos() token.Position  { return fl.Token.Pos }
+func (fl *FunctionLiteral) End() token.Position {
+	if fl.Body != nil {
+		return fl.Body.End()
+	}
+	return fl.Token.End
+}
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
-	param := []string{}
-	for _, p := range fl.Parameters {
-		param = append(param, p.String())
-	}
+	param := ParameterStrings(fl.Parameters, fl.Defaults, fl.Rest)
 
 	out.WriteString(fl.TokenLiteral())
 	if fl.Name != "" {
@@ -237,15 +398,70 @@ func (fl *FunctionLiteral) String() string {
 	return out.String()
 }
 
+// macro(a, b) { ... }，调用时实参不求值，以quote的形式传入
+type MacroLiteral struct {
+	Token      token.Token // 'macro'词法单元
+	Parameters []*Identifier
+	Body       *BlockStatement
+}
+
+func (ml *MacroLiteral) expressionNode()      {}
+func (ml *MacroLiteral) TokenLiteral() string { return ml.Token.Literal }
+func (ml *MacroLiteral) Pos() token.Position  { return ml.Token.Pos }
+func (ml *MacroLiteral) End() token.Position {
+	if ml.Body != nil {
+		return ml.Body.End()
+	}
+	return ml.Token.End
+}
+func (ml *MacroLiteral) String() string {
+	params := []string{}
+	for _, p := range ml.Parameters {
+		params = append(params, p.String())
+	}
+	return ml.TokenLiteral() + "(" + strings.Join(params, ", ") + ") " + ml.Body.String()
+}
+
+// 形参列表中每个参数的写法，如"a"、"b = 1"和"...rest"
+func ParameterStrings(params []*Identifier, defaults []Expression, rest *Identifier) []string {
+	out := []string{}
+	for i, p := range params {
+		if i < len(defaults) && defaults[i] != nil {
+			out = append(out, p.String()+" = "+defaults[i].String())
+		} else {
+			out = append(out, p.String())
+		}
+	}
+	if rest != nil {
+		out = append(out, "..."+rest.String())
+	}
+	return out
+}
+
+// 调用时把数组展开成多个实参，f(...xs)
+type SpreadExpression struct {
+	Token token.Token // '...'词法单元
+	Value Expression
+}
+
+func (se *SpreadExpression) expressionNode()      {}
+func (se *SpreadExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SpreadExpression) Pos() token.Position  { return se.Token.Pos }
+func (se *SpreadExpression) End() token.Position  { return endOf(se.Value, se.Token) }
+func (se *SpreadExpression) String() string       { return "..." + se.Value.String() }
+
 // 调用表达式
 type CallExpression struct {
 	Token     token.Token // '('词法单元
 	Function  Expression  // 标识符或函数字面量
 	Arguments []Expression
+	EndToken  token.Token // ')'词法单元
 }
 
 func (ce *CallExpression) expressionNode()      {}
 func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() token.Position  { return startOf(ce.Function, ce.Token) }
+func (ce *CallExpression) End() token.Position  { return ce.EndToken.End }
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer
 
@@ -263,18 +479,25 @@ func (ce *CallExpression) String() string {
 }
 
 type LetStatement struct {
-	Token token.Token
-	Name  *Identifier // 保存标识符
-	Value Expression  // 保存产生值的表达式
+	Token   token.Token
+	Name    *Identifier // 保存标识符
+	Pattern Pattern     // 解构时的模式，此时Name为nil
+	Value   Expression  // 保存产生值的表达式
 }
 
 func (ls *LetStatement) statementNode()       {}
 func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
+func (ls *LetStatement) Pos() token.Position  { return ls.Token.Pos }
+func (ls *LetStatement) End() token.Position  { return endOf(ls.Value, ls.Token) }
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
 	out.WriteString(ls.TokenLiteral() + " ")
-	out.WriteString(ls.Name.String())
+	if ls.Pattern != nil {
+		out.WriteString(ls.Pattern.String())
+	} else {
+		out.WriteString(ls.Name.String())
+	}
 	out.WriteString(" = ")
 
 	if ls.Value != nil {
@@ -285,6 +508,191 @@ func (ls *LetStatement) String() string {
 	return out.String()
 }
 
+// 模式中的标识符绑定对应的值，如[a, b]中的a
+func (i *Identifier) patternNode() {}
+
+// 通配符_，匹配任何值但不绑定
+type WildcardPattern struct {
+	Token token.Token // '_'词法单元
+}
+
+func (wp *WildcardPattern) patternNode()         {}
+func (wp *WildcardPattern) TokenLiteral() string { return wp.Token.Literal }
+func (wp *WildcardPattern) Pos() token.Position  { return wp.Token.Pos }
+func (wp *WildcardPattern) End() token.Position  { return wp.Token.End }
+func (wp *WildcardPattern) String() string       { return "_" }
+
+// 字面量模式，值相等时匹配，只能用在match中
+type LiteralPattern struct {
+	Value Expression // 整数、浮点数、字符串、布尔值、null，或者负数
+}
+
+func (lp *LiteralPattern) patternNode()         {}
+func (lp *LiteralPattern) TokenLiteral() string { return lp.Value.TokenLiteral() }
+func (lp *LiteralPattern) Pos() token.Position  { return lp.Value.Pos() }
+func (lp *LiteralPattern) End() token.Position  { return lp.Value.End() }
+func (lp *LiteralPattern) String() string       { return lp.Value.String() }
+
+// [a, b, ...rest]
+type ArrayPattern struct {
+	Token    token.Token // '['词法单元
+	Elements []Pattern
+	Rest     *Identifier // ...rest，没有时为nil
+	EndToken token.Token // ']'词法单元
+}
+
+func (ap *ArrayPattern) patternNode()         {}
+func (ap *ArrayPattern) TokenLiteral() string { return ap.Token.Literal }
+func (ap *ArrayPattern) Pos() token.Position  { return ap.Token.Pos }
+func (ap *ArrayPattern) End() token.Position  { return ap.EndToken.End }
+func (ap *ArrayPattern) String() string {
+	var elements []string
+	for _, e := range ap.Elements {
+		elements = append(elements, e.String())
+	}
+	if ap.Rest != nil {
+		elements = append(elements, "..."+ap.Rest.String())
+	}
+	return "[" + strings.Join(elements, ", ") + "]"
+}
+
+// {name, port: p}，键按名字取哈希中的字符串键
+type HashPattern struct {
+	Token    token.Token   // '{'词法单元
+	Keys     []*Identifier // 哈希中的键
+	Values   []Pattern     // 与Keys一一对应，{name}中是和键同名的标识符
+	EndToken token.Token   // '}'词法单元
+}
+
+func (hp *HashPattern) patternNode()         {}
+func (hp *HashPattern) TokenLiteral() string { return hp.Token.Literal }
+func (hp *HashPattern) Pos() token.Position  { return hp.Token.Pos }
+func (hp *HashPattern) End() token.Position  { return hp.EndToken.End }
+func (hp *HashPattern) String() string {
+	var pairs []string
+	for i, k := range hp.Keys {
+		if ident, ok := hp.Values[i].(*Identifier); ok && ident.Value == k.Value {
+			pairs = append(pairs, k.String())
+		} else {
+			pairs = append(pairs, k.String()+": "+hp.Values[i].String())
+		}
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// 模式中绑定的所有变量名，按出现的顺序
+func PatternNames(pattern Pattern) []*Identifier {
+	switch pattern := pattern.(type) {
+	case *Identifier:
+		return []*Identifier{pattern}
+	case *ArrayPattern:
+		names := []*Identifier{}
+		for _, e := range pattern.Elements {
+			names = append(names, PatternNames(e)...)
+		}
+		if pattern.Rest != nil {
+			names = append(names, pattern.Rest)
+		}
+		return names
+	case *HashPattern:
+		names := []*Identifier{}
+		for _, v := range pattern.Values {
+			names = append(names, PatternNames(v)...)
+		}
+		return names
+	}
+	return nil
+}
+
+// match (x) { 1 => a, [a, b] if a > b => b, _ => c }
+type MatchExpression struct {
+	Token    token.Token // 'match'词法单元
+	Subject  Expression
+	Arms     []*MatchArm
+	EndToken token.Token // '}'词法单元
+}
+
+// 模式匹配且守卫条件为真时，求值Body作为match的结果
+type MatchArm struct {
+	Pattern Pattern
+	Guard   Expression // 可选的if条件，没有时为nil
+	Body    Expression
+}
+
+func (ma *MatchArm) String() string {
+	var out bytes.Buffer
+	out.WriteString(ma.Pattern.String())
+	if ma.Guard != nil {
+		out.WriteString(" if " + ma.Guard.String())
+	}
+	out.WriteString(" => " + ma.Body.String())
+	return out.String()
+}
+
+func (me *MatchExpression) expressionNode()      {}
+func (me *MatchExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *MatchExpression) Pos() token.Position  { return me.Token.Pos }
+func (me *MatchExpression) End() token.Position  { return me.EndToken.End }
+func (me *MatchExpression) String() string {
+	var arms []string
+	for _, arm := range me.Arms {
+		arms = append(arms, arm.String())
+	}
+	return "match (" + me.Subject.String() + ") { " + strings.Join(arms, ", ") + " }"
+}
+
+// try { Block } catch (Param) { Catch } finally { Finally }
+// Catch和Finally至少有一个；Param可以省略
+type TryExpression struct {
+	Token   token.Token // 'try'词法单元
+	Block   *BlockStatement
+	Param   *Identifier
+	Catch   *BlockStatement
+	Finally *BlockStatement
+}
+
+func (te *TryExpression) expressionNode()      {}
+func (te *TryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TryExpression) Pos() token.Position  { return te.Token.Pos }
+func (te *TryExpression) End() token.Position {
+	if te.Finally != nil {
+		return te.Finally.End()
+	}
+	if te.Catch != nil {
+		return te.Catch.End()
+	}
+	return te.Block.End()
+}
+func (te *TryExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("try { " + te.Block.String() + " }")
+	if te.Catch != nil {
+		out.WriteString(" catch ")
+		if te.Param != nil {
+			out.WriteString("(" + te.Param.String() + ") ")
+		}
+		out.WriteString("{ " + te.Catch.String() + " }")
+	}
+	if te.Finally != nil {
+		out.WriteString(" finally { " + te.Finally.String() + " }")
+	}
+	return out.String()
+}
+
+// throw Value;
+type ThrowStatement struct {
+	Token token.Token // 'throw'词法单元
+	Value Expression
+}
+
+func (ts *ThrowStatement) statementNode()       {}
+func (ts *ThrowStatement) TokenLiteral() string { return ts.Token.Literal }
+func (ts *ThrowStatement) Pos() token.Position  { return ts.Token.Pos }
+func (ts *ThrowStatement) End() token.Position  { return endOf(ts.Value, ts.Token) }
+func (ts *ThrowStatement) String() string {
+	return ts.TokenLiteral() + " " + ts.Value.String() + ";"
+}
+
 type ReturnStatement struct {
 	Token       token.Token
 	ReturnValue Expression
@@ -292,6 +700,8 @@ type ReturnStatement struct {
 
 func (rs *ReturnStatement) statementNode()       {}
 func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *ReturnStatement) Pos() token.Position  { return rs.Token.Pos }
+func (rs *ReturnStatement) End() token.Position  { return endOf(rs.ReturnValue, rs.Token) }
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
 
@@ -312,6 +722,8 @@ type ExpressionStatement struct {
 
 func (es *ExpressionStatement) statementNode()       {}
 func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *ExpressionStatement) Pos() token.Position  { return startOf(es.Expression, es.Token) }
+func (es *ExpressionStatement) End() token.Position  { return endOf(es.Expression, es.Token) }
 func (es *ExpressionStatement) String() string {
 
 	if es.Expression != nil {
@@ -324,10 +736,13 @@ func (es *ExpressionStatement) String() string {
 type BlockStatement struct {
 	Token      token.Token // '{'词法单元
 	Statements []Statement
+	EndToken   token.Token // '}'词法单元
 }
 
 func (bs *BlockStatement) statementNode()       {}
 func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BlockStatement) Pos() token.Position  { return bs.Token.Pos }
+func (bs *BlockStatement) End() token.Position  { return bs.EndToken.End }
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 	for _, s := range bs.Statements {
@@ -335,3 +750,113 @@ func (bs *BlockStatement) String() string {
 	}
 	return out.String()
 }
+
+// while (Condition) { Body }
+type WhileStatement struct {
+	Token     token.Token // 'while'词法单元
+	Condition Expression
+	Body      *BlockStatement
+}
+
+func (ws *WhileStatement) statementNode()       {}
+func (ws *WhileStatement) TokenLiteral() string { return ws.Token.Literal }
+func (ws *WhileStatement) Pos() token.Position  { return ws.Token.Pos }
+func (ws *WhileStatement) End() token.Position  { return ws.Body.End() }
+func (ws *WhileStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("while ")
+	out.WriteString(ws.Condition.String())
+	out.WriteString(" ")
+	out.WriteString(ws.Body.String())
+	return out.String()
+}
+
+// for (Init; Condition; Post) { Body }，三个部分都可以省略
+type ForStatement struct {
+	Token     token.Token // 'for'词法单元
+	Init      Statement
+	Condition Expression
+	Post      Expression
+	Body      *BlockStatement
+}
+
+func (fs *ForStatement) statementNode()       {}
+func (fs *ForStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *ForStatement) Pos() token.Position  { return fs.Token.Pos }
+func (fs *ForStatement) End() token.Position  { return fs.Body.End() }
+func (fs *ForStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("for (")
+	if fs.Init != nil {
+		out.WriteString(strings.TrimSuffix(fs.Init.String(), ";"))
+	}
+	out.WriteString("; ")
+	if fs.Condition != nil {
+		out.WriteString(fs.Condition.String())
+	}
+	out.WriteString("; ")
+	if fs.Post != nil {
+		out.WriteString(fs.Post.String())
+	}
+	out.WriteString(") ")
+	out.WriteString(fs.Body.String())
+	return out.String()
+}
+
+// for (Variable in Iterable) { Body }
+type ForInStatement struct {
+	Token    token.Token // 'for'词法单元
+	Variable *Identifier
+	Iterable Expression
+	Body     *BlockStatement
+}
+
+func (fs *ForInStatement) statementNode()       {}
+func (fs *ForInStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *ForInStatement) Pos() token.Position  { return fs.Token.Pos }
+func (fs *ForInStatement) End() token.Position  { return fs.Body.End() }
+func (fs *ForInStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("for (")
+	out.WriteString(fs.Variable.String())
+	out.WriteString(" in ")
+	out.WriteString(fs.Iterable.String())
+	out.WriteString(") ")
+	out.WriteString(fs.Body.String())
+	return out.String()
+}
+
+type BreakStatement struct {
+	Token token.Token // 'break'词法单元
+}
+
+func (bs *BreakStatement) statementNode()       {}
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) Pos() token.Position  { return bs.Token.Pos }
+func (bs *BreakStatement) End() token.Position  { return bs.Token.End }
+func (bs *BreakStatement) String() string       { return bs.Token.Literal + ";" }
+
+type ContinueStatement struct {
+	Token token.Token // 'continue'词法单元
+}
+
+func (cs *ContinueStatement) statementNode()       {}
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) Pos() token.Position  { return cs.Token.Pos }
+func (cs *ContinueStatement) End() token.Position  { return cs.Token.End }
+func (cs *ContinueStatement) String() string       { return cs.Token.Literal + ";" }
+
+// 子节点缺失（如语法错误）时，退回到节点自身的词法单元
+func startOf(n Node, fallback token.Token) token.Position {
+	if n == nil {
+		return fallback.Pos
+	}
+	return n.Pos()
+}
+
+func endOf(n Node, fallback token.Token) token.Position {
+	if n == nil {
+		return fallback.End
+	}
+	return n.End()
+}
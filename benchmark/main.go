@@ -47,7 +47,7 @@ func main() {
 			return
 		}
 
-		machine := vm.New(comp.Bytecode())
+		machine := vm.New(comp.Bytecode(), vm.Config{})
 
 		start := time.Now()
 
@@ -20,7 +20,7 @@ const (
 	OpFalse                  // 将false压入栈
 	OpEqual
 	OpNotEqual
-	OpGreaterThan // 有且只有'>',而'<'通过编译器代码重排序实现
+	OpGreaterThan // '>'
 	OpMinus
 	OpBang
 	OpJumpNotTruthy // 有条件跳转
@@ -40,6 +40,41 @@ const (
 	OpClosure
 	OpGetFree        // 用于在closure里存储自由变量，存储在其Free变量中
 	OpCurrentClosure // 引用自身closure
+
+	OpMod                // %
+	OpGreaterThanOrEqual // '>='
+	OpLessThan           // '<'
+	OpLessThanOrEqual    // '<='
+	OpBitAnd             // &
+	OpBitOr              // |
+	OpBitXor             // ^
+	OpBitNot             // ~，一元运算
+	OpShiftLeft          // <<
+	OpShiftRight         // >>，算术右移
+	OpIter               // 把栈顶的可遍历对象换成迭代器
+	OpIterNext           // 栈顶迭代器的下一个元素压栈，遍历完时弹出迭代器并跳转
+	OpLoopMark           // 进入循环时记下当前的栈高度
+	OpLoopUnwind         // break和continue之前把栈恢复到进入循环时的高度，丢弃表达式中间结果
+	OpSetFree            // 给自由变量赋值，写入闭包共享的Cell
+	OpGetLocalCell       // 创建闭包时捕获局部变量：把局部变量装进Cell，压入Cell本身
+	OpGetFreeCell        // 创建闭包时捕获外层的自由变量：压入Cell本身
+	OpSetIndex           // 栈顶依次为值、索引、被索引对象，赋值后把值压栈
+	OpDup                // 复制栈顶的n个元素
+	OpGetMember          // a.b，操作数为常量池中成员名字符串的索引
+	OpJumpNull           // 栈顶是null时跳转，不弹出栈顶
+	OpJumpNotNull        // 栈顶不是null时跳转，不弹出栈顶
+	OpConcat             // 把栈顶n个值转成字符串后拼接，用于字符串插值
+	OpDestructArray      // 把数组拆成n个元素(和剩余元素组成的数组)，第一个元素在栈顶
+	OpDestructHash       // 按栈顶n个键从hash中取值，第一个键的值在栈顶
+	OpCallSpread         // 把栈顶n个数组展开成实参后调用，实参个数运行时才知道
+	OpMatchArray         // 栈顶是元素个数符合的数组时压入true，否则压入false
+	OpMatchHash          // 栈顶n个键下面是含有这些键的hash时压入true，否则压入false
+	OpBindLocal          // 给局部变量新的绑定：替换槽中的值，不写入之前被闭包捕获的Cell
+	OpBindGlobal         // 给全局变量新的绑定，同OpBindLocal
+	OpGetGlobalCell      // 创建闭包时捕获match或catch绑定的全局变量：压入Cell本身
+	OpTry                // 记下当前栈的高度，抛出异常时由对应的处理器恢复
+	OpThrow              // 弹出栈顶的值作为异常抛出
+	OpTailCall           // 调用后直接返回，被调用的是闭包时复用当前帧
 )
 
 type Definition struct {
@@ -78,6 +113,41 @@ var definitions = map[Opcode]*Definition{
 	OpClosure:        {"OpClosure", []int{2, 1}}, // 第一个是常量索引用于常量池指定哪个函数转化成闭包，第二个是有多少个自由变量
 	OpGetFree:        {"OpGetFree", []int{1}},
 	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+
+	OpMod:                {"OpMod", []int{}},
+	OpGreaterThanOrEqual: {"OpGreaterThanOrEqual", []int{}},
+	OpLessThan:           {"OpLessThan", []int{}},
+	OpLessThanOrEqual:    {"OpLessThanOrEqual", []int{}},
+	OpBitAnd:             {"OpBitAnd", []int{}},
+	OpBitOr:              {"OpBitOr", []int{}},
+	OpBitXor:             {"OpBitXor", []int{}},
+	OpBitNot:             {"OpBitNot", []int{}},
+	OpShiftLeft:          {"OpShiftLeft", []int{}},
+	OpShiftRight:         {"OpShiftRight", []int{}},
+	OpIter:               {"OpIter", []int{}},
+	OpIterNext:           {"OpIterNext", []int{2}}, // 操作数为遍历结束后的跳转位置
+	OpLoopMark:           {"OpLoopMark", []int{1}}, // 操作数为循环在当前函数中的嵌套层数
+	OpLoopUnwind:         {"OpLoopUnwind", []int{1}},
+	OpSetFree:            {"OpSetFree", []int{1}},
+	OpGetLocalCell:       {"OpGetLocalCell", []int{1}},
+	OpGetFreeCell:        {"OpGetFreeCell", []int{1}},
+	OpSetIndex:           {"OpSetIndex", []int{}},
+	OpDup:                {"OpDup", []int{1}}, // 操作数为复制的元素个数
+	OpGetMember:          {"OpGetMember", []int{2}},
+	OpJumpNull:           {"OpJumpNull", []int{2}},
+	OpJumpNotNull:        {"OpJumpNotNull", []int{2}},
+	OpConcat:             {"OpConcat", []int{2}},           // 操作数为拼接的值的个数
+	OpDestructArray:      {"OpDestructArray", []int{2, 1}}, // 元素个数，是否有...rest
+	OpDestructHash:       {"OpDestructHash", []int{2}},     // 键的个数
+	OpCallSpread:         {"OpCallSpread", []int{1}},       // 数组的个数
+	OpMatchArray:         {"OpMatchArray", []int{2, 1}},    // 同OpDestructArray
+	OpMatchHash:          {"OpMatchHash", []int{2}},        // 键的个数
+	OpBindLocal:          {"OpBindLocal", []int{1}},
+	OpBindGlobal:         {"OpBindGlobal", []int{2}},
+	OpGetGlobalCell:      {"OpGetGlobalCell", []int{2}},
+	OpTry:                {"OpTry", []int{2}}, // 处理器的槽号
+	OpThrow:              {"OpThrow", []int{}},
+	OpTailCall:           {"OpTailCall", []int{1}}, // 同OpCall
 }
 
 func (ins Instructions) String() string {
@@ -19,6 +19,7 @@ func TestMake(t *testing.T) {
 		{OpFalse, []int{}, []byte{byte(OpFalse)}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpDestructArray, []int{2, 1}, []byte{byte(OpDestructArray), 0, 2, 1}},
 	}
 
 	for _, tt := range tests {
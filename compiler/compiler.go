@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/code"
+	"monkey/diagnostic"
 	"monkey/object"
+	"monkey/token"
 	"sort"
 )
 
@@ -19,6 +21,32 @@ type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction // 追踪最后一条命令
 	previousInstruction EmittedInstruction // 追踪倒数第二条命令
+
+	loops []*loopContext // 正在编译的循环，最内层在最后；每个函数有自己的一组
+
+	tries       []*handlerContext         // 正在编译的try中的异常处理器，最内层在最后
+	handlers    []object.ExceptionHandler // 编译完的异常处理器表
+	numTrySlots int
+
+	lines []object.LineInfo // 行号表，只在行号变化时记一项
+}
+
+// 正在编译的try中的一个异常处理器。return、break和continue跳出try时会内联finally，
+// 这些代码抛出的异常不能再被跳出的处理器接住，所以保护范围会被分成几段
+type handlerContext struct {
+	slot    int
+	start   int // 当前这段保护范围的开始，-1表示暂时关闭
+	ranges  [][2]int
+	finally *ast.BlockStatement // finally处理器跳出时要运行的代码，catch处理器为nil
+}
+
+// 循环中的break和continue要跳到的位置在编译完循环体之后才确定，先记下来再回填
+type loopContext struct {
+	breakJumps    []int
+	continueJumps []int
+	hasIterator   bool // for-in循环的迭代器在栈上，break之前要弹出
+	depth         int  // 在当前函数中的嵌套层数，OpLoopMark和OpLoopUnwind用它找到记下的栈高度
+	numTries      int  // 进入循环时已有的处理器个数，跳出循环时只运行循环里面的finally
 }
 
 type Compiler struct {
@@ -28,6 +56,10 @@ type Compiler struct {
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	warnings  []diagnostic.Diagnostic
+	line      int                          // 正在编译的节点所在的行
+	tailCalls map[*ast.CallExpression]bool // 处于尾部位置的调用
 }
 
 func New() *Compiler {
@@ -50,6 +82,7 @@ func New() *Compiler {
 		symbolTable:  symbolTable,
 		scopes:       []CompilationScope{mainScope},
 		scopeIndex:   0,
+		tailCalls:    map[*ast.CallExpression]bool{},
 	}
 }
 
@@ -61,10 +94,20 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	// 生成的指令归到正在编译的节点所在的行，编译完子节点后恢复
+	if node != nil && node.Pos().Line > 0 {
+		line := c.line
+		c.line = node.Pos().Line
+		defer func() { c.line = line }()
+	}
+
 	switch node := node.(type) {
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(integer))
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -74,7 +117,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value) // 在送往虚拟机运行之前报错，编译时错误
 		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+			return fmt.Errorf("%s: undefined variable %s", node.Pos(), node.Value)
 		}
 
 		// 在字节码中将标识符替换
@@ -84,93 +127,26 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpConstant, c.addConstant(str))
 
 	case *ast.FunctionLiteral:
-		// start := len(c.instructions)
-
-		// err := c.Compile(node.Body)
-		// if err != nil {
-		// 	return err
-		// }
-
-		// fnBody := code.Instructions{}
-		// for i := start; i < len(c.instructions); i++ {
-		// 	fnBody = append(fnBody, c.instructions[i])
-		// }
-
-		// fn := &object.CompiledFunction{
-		// 	Instructions: fnBody,
-		// }
-
-		// c.instructions = c.instructions[:start]
-		// c.emit(code.OpConstant, c.addConstant(fn))
-
-		c.enterScope() // 编译函数时，改变指令的存储位置
-
-		if node.Name != "" { // 函数名字注册进去
-			c.symbolTable.DefineFunctionName(node.Name)
-		}
-
-		for _, p := range node.Parameters {
-			c.symbolTable.Define(p.Value) // 把每个参数名字，按顺序存到函数域local绑定里
-		}
-
-		err := c.Compile(node.Body)
-		if err != nil {
-			return err
-		}
-
-		if c.lastInstructionIs(code.OpPop) {
-			c.replaceLastPopWithReturn()
-		}
-
-		// 支持空函数，直接返回OpReturn
-		if !c.lastInstructionIs(code.OpReturnValue) {
-			c.emit(code.OpReturn)
-		}
-
-		// 保存该函数体中有多少local变量
-		numLocals := c.symbolTable.numDefinitions
-		freeSymbols := c.symbolTable.FreeSymbols
-
-		instructions := c.leaveScope()
-
-		for _, s := range freeSymbols { // 在封闭域中产生将自由变量压栈的指令
-			c.loadSymbol(s)
-		}
-
-		compiledFn := &object.CompiledFunction{
-			Instructions:  instructions,
-			NumLocals:     numLocals,
-			NumParameters: len(node.Parameters),
-		}
-
-		fnIndex := c.addConstant(compiledFn)
-		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
-
-	case *ast.CallExpression:
-		err := c.Compile(node.Function)
-		if err != nil {
-			return err
-		}
-
-		for _, arg := range node.Arguments {
-			err = c.Compile(arg)
+		return c.compileFunctionLiteral(node, node.Name != "")
+
+	case *ast.CallExpression, *ast.IndexExpression, *ast.MemberExpression:
+		return c.compileChain(node.(ast.Expression))
+	case *ast.NullLiteral:
+		c.emit(code.OpNull)
+	case *ast.MatchExpression:
+		return c.compileMatchExpression(node)
+	case *ast.TryExpression:
+		return c.compileTryExpression(node)
+	case *ast.MacroLiteral: // 顶层的宏定义在展开宏时已经移除
+		return fmt.Errorf("%s: macro must be bound by a top-level let", node.Pos())
+	case *ast.InterpolatedString:
+		for _, part := range node.Parts {
+			err := c.Compile(part)
 			if err != nil {
 				return err
 			}
 		}
-		c.emit(code.OpCall, len(node.Arguments))
-	case *ast.IndexExpression: // 编译器不用在意索引的内容、操作是否有效，这是虚拟机的工作
-		err := c.Compile(node.Left)
-		if err != nil {
-			return err
-		}
-
-		err = c.Compile(node.Index)
-		if err != nil {
-			return err
-		}
-
-		c.emit(code.OpIndex)
+		c.emit(code.OpConcat, len(node.Parts))
 	case *ast.IfExpression:
 		err := c.Compile(node.Condition)
 		if err != nil {
@@ -186,6 +162,8 @@ func (c *Compiler) Compile(node ast.Node) error {
 		// 把if语句中最后一个pop指令删除，块语句中最后一个值是有用的
 		if c.lastInstructionIs(code.OpPop) {
 			c.removeLastPop()
+		} else {
+			c.emit(code.OpNull) // 块以let、循环等语句结尾时没有值
 		}
 
 		jumpPos := c.emit(code.OpJump, 9999)
@@ -201,10 +179,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 			if err != nil {
 				return err
 			}
-		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
+			if c.lastInstructionIs(code.OpPop) {
+				c.removeLastPop()
+			} else {
+				c.emit(code.OpNull)
+			}
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
@@ -242,23 +222,70 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpHash, len(keys)*2)
 
 	case *ast.LetStatement:
+		if node.Pattern != nil {
+			return c.compileLetPattern(node)
+		}
 		// 在编译函数之前就绑定函数名，从而允许函数体引用函数名
 		symbol := c.symbolTable.Define(node.Name.Value) // 包含Index
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
+		c.storeSymbol(symbol)
+	case *ast.AssignExpression:
+		return c.compileAssignExpression(node)
+	case *ast.WhileStatement:
+		return c.compileWhileStatement(node)
+	case *ast.ForStatement:
+		return c.compileForStatement(node)
+	case *ast.ForInStatement:
+		return c.compileForInStatement(node)
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("%s: break outside loop", node.Pos())
+		}
+		err := c.compileFinallyBlocks(loop.numTries)
+		if err != nil {
+			return err
+		}
+		// break可能出现在表达式中间，如[1, if (x) { break }]，跳出前丢掉栈上的中间结果
+		c.emit(code.OpLoopUnwind, loop.depth)
+		if loop.hasIterator {
+			c.emit(code.OpPop)
 		}
+		loop.breakJumps = append(loop.breakJumps, c.emit(code.OpJump, 9999))
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("%s: continue outside loop", node.Pos())
+		}
+		err := c.compileFinallyBlocks(loop.numTries)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpLoopUnwind, loop.depth)
+		loop.continueJumps = append(loop.continueJumps, c.emit(code.OpJump, 9999))
 	case *ast.ReturnStatement:
+		// 主程序没有可以复用的帧；try中返回前还要运行finally
+		if c.scopeIndex > 0 && len(c.scopes[c.scopeIndex].tries) == 0 {
+			c.markTailCalls(node.ReturnValue)
+		}
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
+		err = c.compileFinallyBlocks(0)
+		if err != nil {
+			return err
+		}
 		c.emit(code.OpReturnValue)
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
 	case *ast.BlockStatement:
 		for _, s := range node.Statements {
 			err := c.Compile(s)
@@ -289,21 +316,17 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMinus)
 		case "!":
 			c.emit(code.OpBang)
+		case "~":
+			c.emit(code.OpBitNot)
 		default:
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
 	case *ast.InfixExpression:
-		if node.Operator == "<" { // 把小于符号当作特殊情况对待，出现时左右操作数重新排序
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
-			}
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
-			c.emit(code.OpGreaterThan)
-			return nil
+		if node.Operator == "??" {
+			return c.compileNullishExpression(node)
+		}
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
 		}
 
 		err := c.Compile(node.Left)
@@ -325,12 +348,30 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
 			c.emit(code.OpNotEqual)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case ">=":
+			c.emit(code.OpGreaterThanOrEqual)
+		case "<": // 左边先求值，和解释器的顺序一致
+			c.emit(code.OpLessThan)
+		case "<=":
+			c.emit(code.OpLessThanOrEqual)
+		case "&":
+			c.emit(code.OpBitAnd)
+		case "|":
+			c.emit(code.OpBitOr)
+		case "^":
+			c.emit(code.OpBitXor)
+		case "<<":
+			c.emit(code.OpShiftLeft)
+		case ">>":
+			c.emit(code.OpShiftRight)
 		default:
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
@@ -339,16 +380,919 @@ func (c *Compiler) Compile(node ast.Node) error {
 	return nil
 }
 
+// &&和||用跳转实现短路求值，结果总是布尔值：
+//
+//	a && b:  a; JumpNotTruthy F; b; Bang; Bang; Jump End; F: False; End:
+//	a || b:  a; JumpNotTruthy R; True; Jump End; R: b; Bang; Bang; End:
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	if node.Operator == "&&" {
+		err = c.compileToBoolean(node.Right)
+		if err != nil {
+			return err
+		}
+		jumpPos := c.emit(code.OpJump, 9999)
+
+		c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+		c.emit(code.OpFalse)
+
+		c.changeOperand(jumpPos, len(c.currentInstructions()))
+		return nil
+	}
+
+	c.emit(code.OpTrue)
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+	err = c.compileToBoolean(node.Right)
+	if err != nil {
+		return err
+	}
+
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+	return nil
+}
+
+// 编译表达式，并用两次取反把结果转成布尔值
+func (c *Compiler) compileToBoolean(node ast.Expression) error {
+	err := c.Compile(node)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpBang)
+	c.emit(code.OpBang)
+	return nil
+}
+
+// 函数体中给函数自己的名字赋值时返回，见compileFunctionLiteral
+type functionNameAssigned struct {
+	table *SymbolTable // 函数名所在的符号表
+	pos   token.Position
+	name  string
+}
+
+func (e *functionNameAssigned) Error() string {
+	return fmt.Sprintf("%s: cannot assign to function name %s inside its own body", e.pos, e.name)
+}
+
+// 函数名本身通过OpCurrentClosure读取，无法赋值。函数体给自己的名字赋值时，
+// 不注册函数名重新编译，这样函数名和赋值都落到let定义的外层变量上，和解释器一致
+func (c *Compiler) compileFunctionLiteral(node *ast.FunctionLiteral, defineName bool) error {
+	// start := len(c.instructions)
+
+	// err := c.Compile(node.Body)
+	// if err != nil {
+	// 	return err
+	// }
+
+	// fnBody := code.Instructions{}
+	// for i := start; i < len(c.instructions); i++ {
+	// 	fnBody = append(fnBody, c.instructions[i])
+	// }
+
+	// fn := &object.CompiledFunction{
+	// 	Instructions: fnBody,
+	// }
+
+	// c.instructions = c.instructions[:start]
+	// c.emit(code.OpConstant, c.addConstant(fn))
+
+	numConstants := len(c.constants)
+	scopeIndex := c.scopeIndex
+	c.enterScope() // 编译函数时，改变指令的存储位置
+	fnTable := c.symbolTable
+
+	if defineName { // 函数名字注册进去
+		c.symbolTable.DefineFunctionName(node.Name)
+	}
+
+	params := []Symbol{}
+	for _, p := range node.Parameters {
+		params = append(params, c.symbolTable.Define(p.Value)) // 把每个参数名字，按顺序存到函数域local绑定里
+	}
+	if node.Rest != nil {
+		c.symbolTable.Define(node.Rest.Value)
+	}
+
+	// 函数体前面依次是各默认参数的求值指令，虚拟机按缺少的参数选择开始的位置
+	defaultOffsets := []int{}
+	var err error
+	for i, d := range node.Defaults {
+		if d == nil {
+			continue
+		}
+		defaultOffsets = append(defaultOffsets, len(c.currentInstructions()))
+		err = c.Compile(d)
+		if err != nil {
+			break
+		}
+		c.storeSymbol(params[i])
+	}
+	bodyOffset := len(c.currentInstructions())
+
+	if err == nil {
+		c.markTailCalls(node.Body)
+		err = c.Compile(node.Body)
+	}
+	if assigned, ok := err.(*functionNameAssigned); ok && assigned.table == fnTable {
+		// 丢掉这次编译的结果，不注册函数名重新编译，让函数名解析到外层的绑定上
+		c.scopes = c.scopes[:scopeIndex+1]
+		c.scopeIndex = scopeIndex
+		c.symbolTable = fnTable.Outer
+		c.constants = c.constants[:numConstants]
+		return c.compileFunctionLiteral(node, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.lastInstructionIs(code.OpPop) {
+		c.replaceLastPopWithReturn()
+	}
+
+	// 支持空函数，直接返回OpReturn
+	if !c.lastInstructionIs(code.OpReturnValue) {
+		c.emit(code.OpReturn)
+	}
+
+	// 保存该函数体中有多少local变量
+	numLocals := c.symbolTable.numDefinitions
+	freeSymbols := c.symbolTable.FreeSymbols
+	handlers := c.scopes[c.scopeIndex].handlers
+	lines := c.scopes[c.scopeIndex].lines
+
+	instructions := c.leaveScope()
+
+	for _, s := range freeSymbols { // 在封闭域中产生将自由变量压栈的指令
+		c.loadCell(s)
+	}
+
+	compiledFn := &object.CompiledFunction{
+		Instructions:  instructions,
+		NumLocals:     numLocals,
+		NumParameters: len(node.Parameters),
+		Variadic:      node.Rest != nil,
+		Handlers:      handlers,
+		Name:          node.Name,
+		Lines:         lines,
+	}
+	if len(defaultOffsets) > 0 {
+		compiledFn.DefaultOffsets = defaultOffsets
+		compiledFn.BodyOffset = bodyOffset
+	}
+
+	fnIndex := c.addConstant(compiledFn)
+	c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+	return nil
+}
+
+var compoundAssignOps = map[string]code.Opcode{
+	"+=": code.OpAdd,
+	"-=": code.OpSub,
+	"*=": code.OpMul,
+	"/=": code.OpDiv,
+}
+
+// 解构let：先求值，再把拆出的值逐个存入模式中的名字
+func (c *Compiler) compileLetPattern(node *ast.LetStatement) error {
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+
+	c.compileDestructure(node.Pattern)
+	return nil
+}
+
+// 按模式拆开栈顶的值；拆出的第一个值在栈顶，按顺序处理各部分即可
+func (c *Compiler) compileDestructure(pattern ast.Pattern) {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		c.storeSymbol(c.symbolTable.Define(pattern.Value))
+	case *ast.WildcardPattern:
+		c.emit(code.OpPop)
+	case *ast.ArrayPattern:
+		c.emit(code.OpDestructArray, len(pattern.Elements), hasRest(pattern))
+		for _, element := range pattern.Elements {
+			c.compileDestructure(element)
+		}
+		if pattern.Rest != nil {
+			c.storeSymbol(c.symbolTable.Define(pattern.Rest.Value))
+		}
+	case *ast.HashPattern:
+		c.emitPatternKeys(pattern)
+		c.emit(code.OpDestructHash, len(pattern.Keys))
+		for _, value := range pattern.Values {
+			c.compileDestructure(value)
+		}
+	}
+}
+
+func hasRest(pattern *ast.ArrayPattern) int {
+	if pattern.Rest != nil {
+		return 1
+	}
+	return 0
+}
+
+func (c *Compiler) emitPatternKeys(pattern *ast.HashPattern) {
+	for _, key := range pattern.Keys {
+		c.emit(code.OpConstant, c.addConstant(&object.String{Value: key.Value}))
+	}
+}
+
+// 被匹配的值存在临时变量里，各分支依次测试，失败时跳到下一个分支：
+// <subject>; Set tmp; <arm1 tests>; <arm1 body>; Jump end; <arm2 tests>; ...; Null; end:
+func (c *Compiler) compileMatchExpression(node *ast.MatchExpression) error {
+	err := c.Compile(node.Subject)
+	if err != nil {
+		return err
+	}
+	subject := c.defineTemp()
+	c.storeSymbol(subject)
+
+	c.checkUnreachableArms(node)
+
+	endJumps := []int{}
+	for _, arm := range node.Arms {
+		// 分支绑定的名字只在分支内可见，编译完分支后恢复原来的符号
+		names := []string{}
+		for _, name := range ast.PatternNames(arm.Pattern) {
+			names = append(names, name.Value)
+		}
+		saved := c.symbolTable.save(names)
+
+		failJumps := []int{}
+		err := c.compileMatchPattern(arm.Pattern, subject, &failJumps)
+		if err != nil {
+			return err
+		}
+		if arm.Guard != nil {
+			err := c.Compile(arm.Guard)
+			if err != nil {
+				return err
+			}
+			failJumps = append(failJumps, c.emit(code.OpJumpNotTruthy, 9999))
+		}
+
+		err = c.Compile(arm.Body)
+		if err != nil {
+			return err
+		}
+		endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+
+		c.symbolTable.restore(names, saved)
+
+		nextArm := len(c.currentInstructions())
+		for _, pos := range failJumps {
+			c.changeOperand(pos, nextArm)
+		}
+	}
+
+	c.emit(code.OpNull) // 没有分支匹配
+	end := len(c.currentInstructions())
+	for _, pos := range endJumps {
+		c.changeOperand(pos, end)
+	}
+	return nil
+}
+
+// 测试subject中的值是否匹配模式，不匹配时跳转的位置记入failJumps；测试前后栈的高度不变
+func (c *Compiler) compileMatchPattern(pattern ast.Pattern, subject Symbol, failJumps *[]int) error {
+	switch pattern := pattern.(type) {
+	case *ast.WildcardPattern:
+	case *ast.Identifier:
+		c.loadSymbol(subject)
+		c.bindSymbol(c.symbolTable.DefineBinding(pattern.Value))
+	case *ast.LiteralPattern:
+		c.loadSymbol(subject)
+		err := c.Compile(pattern.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpEqual)
+		*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthy, 9999))
+	case *ast.ArrayPattern:
+		c.loadSymbol(subject)
+		c.emit(code.OpMatchArray, len(pattern.Elements), hasRest(pattern))
+		*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthy, 9999))
+
+		c.loadSymbol(subject)
+		c.emit(code.OpDestructArray, len(pattern.Elements), hasRest(pattern))
+		parts := c.storeMatchParts(pattern.Elements)
+		if pattern.Rest != nil {
+			c.bindSymbol(c.symbolTable.DefineBinding(pattern.Rest.Value))
+		}
+		return c.compileMatchParts(pattern.Elements, parts, failJumps)
+	case *ast.HashPattern:
+		c.loadSymbol(subject)
+		c.emitPatternKeys(pattern)
+		c.emit(code.OpMatchHash, len(pattern.Keys))
+		*failJumps = append(*failJumps, c.emit(code.OpJumpNotTruthy, 9999))
+
+		c.loadSymbol(subject)
+		c.emitPatternKeys(pattern)
+		c.emit(code.OpDestructHash, len(pattern.Keys))
+		parts := c.storeMatchParts(pattern.Values)
+		return c.compileMatchParts(pattern.Values, parts, failJumps)
+	}
+	return nil
+}
+
+// 把拆出的各部分从栈顶依次存下来，需要继续测试的部分存进临时变量
+func (c *Compiler) storeMatchParts(patterns []ast.Pattern) []Symbol {
+	parts := make([]Symbol, len(patterns))
+	for i, pattern := range patterns {
+		switch pattern := pattern.(type) {
+		case *ast.WildcardPattern:
+			c.emit(code.OpPop)
+		case *ast.Identifier:
+			c.bindSymbol(c.symbolTable.DefineBinding(pattern.Value))
+		default:
+			parts[i] = c.defineTemp()
+			c.storeSymbol(parts[i])
+		}
+	}
+	return parts
+}
+
+func (c *Compiler) compileMatchParts(patterns []ast.Pattern, parts []Symbol, failJumps *[]int) error {
+	for i, pattern := range patterns {
+		switch pattern.(type) {
+		case *ast.WildcardPattern, *ast.Identifier:
+			continue
+		}
+		err := c.compileMatchPattern(pattern, parts[i], failJumps)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 编译器内部使用的变量，名字不是合法的标识符，源码中引用不到
+func (c *Compiler) defineTemp() Symbol {
+	return c.symbolTable.Define("$match")
+}
+
+// 没有守卫的通配符或标识符分支匹配所有值，它后面的分支不会执行；
+// 没有守卫的字面量分支之后，相同字面量的分支也不会执行
+func (c *Compiler) checkUnreachableArms(node *ast.MatchExpression) {
+	catchAll := false
+	literals := map[string]bool{}
+
+	for _, arm := range node.Arms {
+		literal, isLiteral := arm.Pattern.(*ast.LiteralPattern)
+		switch {
+		case catchAll:
+			c.warn(arm.Pattern, diagnostic.UnreachableArm, "an earlier arm matches every value",
+				"unreachable match arm")
+			continue
+		case isLiteral && literals[literal.String()]:
+			c.warn(arm.Pattern, diagnostic.UnreachableArm, "an earlier arm matches the same value",
+				"unreachable match arm")
+			continue
+		case arm.Guard != nil:
+			continue
+		}
+
+		switch arm.Pattern.(type) {
+		case *ast.WildcardPattern, *ast.Identifier:
+			catchAll = true
+		case *ast.LiteralPattern:
+			literals[literal.String()] = true
+		}
+	}
+}
+
+func (c *Compiler) warn(node ast.Node, code diagnostic.Code, hint string, format string, a ...interface{}) {
+	c.warnings = append(c.warnings, diagnostic.Diagnostic{
+		Severity: diagnostic.Warning,
+		Code:     code,
+		Message:  fmt.Sprintf(format, a...),
+		Pos:      node.Pos(),
+		End:      node.End(),
+		Hint:     hint,
+	})
+}
+
+// 编译过程中产生的警告，不影响编译结果
+func (c *Compiler) Warnings() []diagnostic.Diagnostic {
+	return c.warnings
+}
+
+// x op= v 编译为 x = x op v，赋值之后再把x压栈作为整个表达式的值
+func (c *Compiler) compileAssignExpression(node *ast.AssignExpression) error {
+	switch target := node.Target.(type) {
+	case *ast.IndexExpression:
+		return c.compileIndexAssignExpression(node, target.Left, target.Index)
+	case *ast.MemberExpression: // a.b = v 即 a["b"] = v
+		key := &ast.StringLiteral{Token: target.Property.Token, Value: target.Property.Value}
+		return c.compileIndexAssignExpression(node, target.Object, key)
+	}
+
+	ident := node.Target.(*ast.Identifier)
+	symbol, ok := c.symbolTable.Resolve(ident.Value)
+	if !ok {
+		return fmt.Errorf("%s: undefined variable %s", ident.Pos(), ident.Value)
+	}
+	if symbol.Scope == BuiltinScope {
+		return fmt.Errorf("%s: cannot assign to builtin function %s", ident.Pos(), ident.Value)
+	}
+	if table := c.symbolTable.functionNameTable(symbol); table != nil {
+		return &functionNameAssigned{table: table, pos: ident.Pos(), name: ident.Value}
+	}
+
+	if node.Operator != "=" {
+		c.loadSymbol(symbol)
+	}
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+	if op, ok := compoundAssignOps[node.Operator]; ok {
+		c.emit(op)
+	}
+
+	c.storeSymbol(symbol)
+	c.loadSymbol(symbol)
+	return nil
+}
+
+// a[i] = v: <a>; <i>; <v>; SetIndex
+// a[i] op= v: <a>; <i>; Dup 2; Index; <v>; <op>; SetIndex
+func (c *Compiler) compileIndexAssignExpression(node *ast.AssignExpression, left, index ast.Expression) error {
+	err := c.Compile(left)
+	if err != nil {
+		return err
+	}
+	err = c.Compile(index)
+	if err != nil {
+		return err
+	}
+
+	if node.Operator != "=" {
+		c.emit(code.OpDup, 2)
+		c.emit(code.OpIndex)
+	}
+	err = c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+	if op, ok := compoundAssignOps[node.Operator]; ok {
+		c.emit(op)
+	}
+
+	c.emit(code.OpSetIndex)
+	return nil
+}
+
+// a ?? b:  a; JumpNotNull End; Pop; b; End:
+func (c *Compiler) compileNullishExpression(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	jumpPos := c.emit(code.OpJumpNotNull, 9999)
+	c.emit(code.OpPop)
+
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+	return nil
+}
+
+// 编译由索引、成员访问和调用组成的链。链中每个?.和?[都发出一条OpJumpNull，
+// 全部跳到整条链的末尾，跳转时栈顶的null就是整条链的结果
+func (c *Compiler) compileChain(node ast.Expression) error {
+	var nullJumps []int
+	err := c.compileChainLink(node, &nullJumps)
+	if err != nil {
+		return err
+	}
+
+	for _, pos := range nullJumps {
+		c.changeOperand(pos, len(c.currentInstructions()))
+	}
+	return nil
+}
+
+func (c *Compiler) compileChainLink(node ast.Expression, nullJumps *[]int) error {
+	switch node := node.(type) {
+	case *ast.CallExpression:
+		err := c.compileChainLink(node.Function, nullJumps)
+		if err != nil {
+			return err
+		}
+
+		return c.compileArguments(node.Arguments, c.tailCalls[node])
+	case *ast.IndexExpression: // 编译器不用在意索引的内容、操作是否有效，这是虚拟机的工作
+		err := c.compileChainLink(node.Left, nullJumps)
+		if err != nil {
+			return err
+		}
+		if node.Optional {
+			*nullJumps = append(*nullJumps, c.emit(code.OpJumpNull, 9999))
+		}
+
+		err = c.Compile(node.Index)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpIndex)
+	case *ast.MemberExpression:
+		err := c.compileChainLink(node.Object, nullJumps)
+		if err != nil {
+			return err
+		}
+		if node.Optional {
+			*nullJumps = append(*nullJumps, c.emit(code.OpJumpNull, 9999))
+		}
+
+		name := &object.String{Value: node.Property.Value}
+		c.emit(code.OpGetMember, c.addConstant(name))
+	default:
+		return c.Compile(node)
+	}
+	return nil
+}
+
+// 有...xs时，连续的普通实参先装进数组，再由OpCallSpread把所有数组展开后调用；
+// 这样的调用不做尾调用优化
+func (c *Compiler) compileArguments(args []ast.Expression, tail bool) error {
+	hasSpread := false
+	for _, arg := range args {
+		if _, ok := arg.(*ast.SpreadExpression); ok {
+			hasSpread = true
+		}
+	}
+	if !hasSpread {
+		for _, arg := range args {
+			err := c.Compile(arg)
+			if err != nil {
+				return err
+			}
+		}
+		if tail {
+			c.emit(code.OpTailCall, len(args))
+		} else {
+			c.emit(code.OpCall, len(args))
+		}
+		return nil
+	}
+
+	numPieces, numPlain := 0, 0
+	for _, arg := range args {
+		spread, ok := arg.(*ast.SpreadExpression)
+		if !ok {
+			err := c.Compile(arg)
+			if err != nil {
+				return err
+			}
+			numPlain++
+			continue
+		}
+
+		if numPlain > 0 {
+			c.emit(code.OpArray, numPlain)
+			numPieces, numPlain = numPieces+1, 0
+		}
+		err := c.Compile(spread.Value)
+		if err != nil {
+			return err
+		}
+		numPieces++
+	}
+	if numPlain > 0 {
+		c.emit(code.OpArray, numPlain)
+		numPieces++
+	}
+	c.emit(code.OpCallSpread, numPieces)
+	return nil
+}
+
+// LoopMark; cond: <condition>; JumpNotTruthy end; <body>; Jump cond; end: Null; Pop
+func (c *Compiler) compileWhileStatement(node *ast.WhileStatement) error {
+	c.enterLoop(false)
+	conditionPos := len(c.currentInstructions())
+	err := c.Compile(node.Condition)
+	if err != nil {
+		return err
+	}
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	err = c.Compile(node.Body)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpJump, conditionPos)
+
+	afterLoopPos := len(c.currentInstructions())
+	c.changeOperand(jumpNotTruthyPos, afterLoopPos)
+	c.leaveLoop(conditionPos, afterLoopPos)
+	c.emitLoopValue()
+	return nil
+}
+
+// <init>; LoopMark; cond: <condition>; JumpNotTruthy end; <body>; post: <post>; Pop; Jump cond; end: Null; Pop
+func (c *Compiler) compileForStatement(node *ast.ForStatement) error {
+	if node.Init != nil {
+		err := c.Compile(node.Init)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.enterLoop(false)
+	conditionPos := len(c.currentInstructions())
+	jumpNotTruthyPos := -1
+	if node.Condition != nil {
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+		jumpNotTruthyPos = c.emit(code.OpJumpNotTruthy, 9999)
+	}
+
+	err := c.Compile(node.Body)
+	if err != nil {
+		return err
+	}
+
+	postPos := len(c.currentInstructions())
+	if node.Post != nil {
+		err := c.Compile(node.Post)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpPop)
+	}
+	c.emit(code.OpJump, conditionPos)
+
+	afterLoopPos := len(c.currentInstructions())
+	if jumpNotTruthyPos != -1 {
+		c.changeOperand(jumpNotTruthyPos, afterLoopPos)
+	}
+	c.leaveLoop(postPos, afterLoopPos)
+	c.emitLoopValue()
+	return nil
+}
+
+// <iterable>; Iter; LoopMark; next: IterNext end; <set variable>; <body>; Jump next; end: Null; Pop
+// 迭代器在整个循环期间留在栈上，遍历完时由OpIterNext弹出
+func (c *Compiler) compileForInStatement(node *ast.ForInStatement) error {
+	err := c.Compile(node.Iterable)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpIter)
+	c.enterLoop(true)
+
+	nextPos := c.emit(code.OpIterNext, 9999)
+	symbol := c.symbolTable.Define(node.Variable.Value)
+	c.storeSymbol(symbol)
+
+	err = c.Compile(node.Body)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpJump, nextPos)
+
+	afterLoopPos := len(c.currentInstructions())
+	c.changeOperand(nextPos, afterLoopPos)
+	c.leaveLoop(nextPos, afterLoopPos)
+	c.emitLoopValue()
+	return nil
+}
+
+// 记下处于尾部位置的调用：调用的结果直接作为函数的返回值，之后不再用到当前帧。
+// 函数体和if的分支中最后的表达式、return的值都是尾部位置
+func (c *Compiler) markTailCalls(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		if len(node.Statements) > 0 {
+			c.markTailCalls(node.Statements[len(node.Statements)-1])
+		}
+	case *ast.ExpressionStatement:
+		c.markTailCalls(node.Expression)
+	case *ast.IfExpression:
+		c.markTailCalls(node.Consequence)
+		if node.Alternative != nil {
+			c.markTailCalls(node.Alternative)
+		}
+	case *ast.CallExpression:
+		c.tailCalls[node] = true
+	}
+}
+
+// OpTry; <try块>; Jump end; catch: <绑定e>; <catch块>; end:
+// 有finally时外面再包一层，正常结束时运行finally；出现异常时运行finally后重新抛出：
+// OpTry; <上面的代码>; <finally>; Jump after; handler: <finally>; Throw; after:
+func (c *Compiler) compileTryExpression(node *ast.TryExpression) error {
+	if node.Finally != nil {
+		c.enterHandler(node.Finally)
+	}
+	if node.Catch != nil {
+		c.enterHandler(nil)
+	}
+
+	err := c.compileBlockValue(node.Block)
+	if err != nil {
+		return err
+	}
+
+	if node.Catch != nil {
+		handler := c.leaveHandler()
+		jumpPos := c.emit(code.OpJump, 9999)
+		c.addHandler(handler)
+
+		// 处理器把异常值压在栈顶
+		var names []string
+		if node.Param != nil {
+			names = []string{node.Param.Value}
+		}
+		saved := c.symbolTable.save(names)
+		if node.Param != nil {
+			c.bindSymbol(c.symbolTable.DefineBinding(node.Param.Value))
+		} else {
+			c.emit(code.OpPop)
+		}
+		err := c.compileBlockValue(node.Catch)
+		if err != nil {
+			return err
+		}
+		c.symbolTable.restore(names, saved)
+
+		c.changeOperand(jumpPos, len(c.currentInstructions()))
+	}
+
+	if node.Finally != nil {
+		handler := c.leaveHandler()
+		err := c.Compile(node.Finally)
+		if err != nil {
+			return err
+		}
+		jumpPos := c.emit(code.OpJump, 9999)
+
+		c.addHandler(handler)
+		err = c.Compile(node.Finally)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+
+		c.changeOperand(jumpPos, len(c.currentInstructions()))
+	}
+	return nil
+}
+
+// 编译块并把块的值留在栈上，块为空或以语句结尾时留下null
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) error {
+	err := c.Compile(block)
+	if err != nil {
+		return err
+	}
+	if len(block.Statements) > 0 && c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+	return nil
+}
+
+// 进入try，之后的指令受新的处理器保护
+func (c *Compiler) enterHandler(finally *ast.BlockStatement) {
+	scope := &c.scopes[c.scopeIndex]
+	handler := &handlerContext{slot: scope.numTrySlots, finally: finally}
+	scope.numTrySlots++
+	scope.tries = append(scope.tries, handler)
+
+	c.emit(code.OpTry, handler.slot)
+	handler.start = len(c.currentInstructions())
+}
+
+// 结束最内层处理器的保护范围
+func (c *Compiler) leaveHandler() *handlerContext {
+	scope := &c.scopes[c.scopeIndex]
+	handler := scope.tries[len(scope.tries)-1]
+	scope.tries = scope.tries[:len(scope.tries)-1]
+
+	handler.close(len(c.currentInstructions()))
+	return handler
+}
+
+// 处理器处理异常的代码从当前位置开始，把它的每段保护范围加入处理器表
+func (c *Compiler) addHandler(handler *handlerContext) {
+	scope := &c.scopes[c.scopeIndex]
+	target := len(c.currentInstructions())
+	for _, r := range handler.ranges {
+		scope.handlers = append(scope.handlers, object.ExceptionHandler{
+			Start: r[0], End: r[1], Target: target, Slot: handler.slot, Finally: handler.finally != nil,
+		})
+	}
+}
+
+func (h *handlerContext) close(pos int) {
+	if h.start >= 0 && h.start < pos {
+		h.ranges = append(h.ranges, [2]int{h.start, pos})
+	}
+	h.start = -1
+}
+
+// return、break和continue跳出try之前，从内到外运行第from个之后的处理器的finally。
+// 运行一个finally时，它和它里面的处理器都已经跳出，只有外面的处理器还在保护
+func (c *Compiler) compileFinallyBlocks(from int) error {
+	tries := c.scopes[c.scopeIndex].tries
+	hasFinally := false
+	for _, h := range tries[from:] {
+		hasFinally = hasFinally || h.finally != nil
+	}
+	if !hasFinally {
+		return nil
+	}
+
+	for i := len(tries) - 1; i >= from; i-- {
+		tries[i].close(len(c.currentInstructions()))
+		if tries[i].finally == nil {
+			continue
+		}
+		// finally里的return不会再运行这个finally；复制一份，免得finally里的try覆盖后面的处理器
+		c.scopes[c.scopeIndex].tries = append([]*handlerContext{}, tries[:i]...)
+		err := c.Compile(tries[i].finally)
+		if err != nil {
+			return err
+		}
+	}
+	c.scopes[c.scopeIndex].tries = tries
+
+	for _, h := range tries[from:] {
+		h.start = len(c.currentInstructions())
+	}
+	return nil
+}
+
+// 进入循环，记下此时的栈高度
+func (c *Compiler) enterLoop(hasIterator bool) {
+	scope := &c.scopes[c.scopeIndex]
+	depth := len(scope.loops)
+	scope.loops = append(scope.loops, &loopContext{hasIterator: hasIterator, depth: depth, numTries: len(scope.tries)})
+	c.emit(code.OpLoopMark, depth)
+}
+
+// 回填循环中所有break和continue的跳转位置
+func (c *Compiler) leaveLoop(continuePos, breakPos int) {
+	scope := &c.scopes[c.scopeIndex]
+	loop := scope.loops[len(scope.loops)-1]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+
+	for _, pos := range loop.breakJumps {
+		c.changeOperand(pos, breakPos)
+	}
+	for _, pos := range loop.continueJumps {
+		c.changeOperand(pos, continuePos)
+	}
+}
+
+// 循环语句的值是null，和解释器一致
+func (c *Compiler) emitLoopValue() {
+	c.emit(code.OpNull)
+	c.emit(code.OpPop)
+}
+
+// 当前函数中最内层的循环，不在循环中时返回nil
+func (c *Compiler) currentLoop() *loopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode{
 		Instructions: c.currentInstructions(),
 		Constants:    c.constants,
+		Handlers:     c.scopes[c.scopeIndex].handlers,
+		Lines:        c.scopes[c.scopeIndex].lines,
 	}
 }
 
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	Handlers     []object.ExceptionHandler // 主程序的异常处理器表
+	Lines        []object.LineInfo         // 主程序的行号表
 }
 
 // 添加常量到constants末尾，返回其索引
@@ -403,6 +1347,13 @@ func (c *Compiler) removeLastPop() {
 	c.scopes[c.scopeIndex].instructions = new
 	c.scopes[c.scopeIndex].lastInstruction = previous
 
+	// 被删掉的指令可能是某一行的第一条
+	lines := c.scopes[c.scopeIndex].lines
+	for len(lines) > 0 && lines[len(lines)-1].Offset >= last.Position {
+		lines = lines[:len(lines)-1]
+	}
+	c.scopes[c.scopeIndex].lines = lines
+
 }
 
 func (c *Compiler) addInstruction(ins []byte) int {
@@ -411,6 +1362,11 @@ func (c *Compiler) addInstruction(ins []byte) int {
 	updatedInstructions := append(c.currentInstructions(), ins...)
 	c.scopes[c.scopeIndex].instructions = updatedInstructions
 
+	scope := &c.scopes[c.scopeIndex]
+	if n := len(scope.lines); n == 0 || scope.lines[n-1].Line != c.line {
+		scope.lines = append(scope.lines, object.LineInfo{Offset: posNewInstruction, Line: c.line})
+	}
+
 	return posNewInstruction
 }
 
@@ -453,6 +1409,45 @@ func (c *Compiler) leaveScope() code.Instructions {
 	return instructions
 }
 
+// 把栈顶的值存到符号对应的位置
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
+	}
+}
+
+// 把栈顶的值绑定到match分支或catch新定义的名字上。循环中再次执行时，
+// 上一次被闭包捕获的变量不能被覆盖，和解释器中每次新建环境一样
+func (c *Compiler) bindSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpBindGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpBindLocal, s.Index)
+	default:
+		c.storeSymbol(s)
+	}
+}
+
+// 创建闭包时捕获变量本身而不是它的值，闭包内外的赋值才能互相看到
+func (c *Compiler) loadCell(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobalCell, s.Index)
+	case LocalScope:
+		c.emit(code.OpGetLocalCell, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFreeCell, s.Index)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
 func (c *Compiler) loadSymbol(s Symbol) {
 	switch s.Scope {
 	case GlobalScope:
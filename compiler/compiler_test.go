@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/code"
+	"monkey/diagnostic"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -83,6 +86,133 @@ func TestIntegerArithmetic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestComparisonAndLogicalOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 && 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJumpNotTruthy, 14),
+				// 0006
+				code.Make(code.OpConstant, 1),
+				// 0009
+				code.Make(code.OpBang),
+				// 0010
+				code.Make(code.OpBang),
+				// 0011
+				code.Make(code.OpJump, 15),
+				// 0014
+				code.Make(code.OpFalse),
+				// 0015
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             "1 || 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0006
+				code.Make(code.OpTrue),
+				// 0007
+				code.Make(code.OpJump, 15),
+				// 0010
+				code.Make(code.OpConstant, 1),
+				// 0013
+				code.Make(code.OpBang),
+				// 0014
+				code.Make(code.OpBang),
+				// 0015
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             "1 <= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessThanOrEqual),
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             "1 % 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			}},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 & 2 | 3",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpBitAnd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpBitOr),
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             "1 << 2 >> 3 ^ 4",
+			expectedConstants: []interface{}{1, 2, 3, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpShiftLeft),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpShiftRight),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpBitXor),
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             "~1",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpBitNot),
+				code.Make(code.OpPop),
+			}},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1.5 + 2",
+			expectedConstants: []interface{}{1.5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             "-2.5e-1",
+			expectedConstants: []interface{}{0.25},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			}},
+	}
+	runCompilerTests(t, tests)
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -110,11 +240,11 @@ func TestBooleanExpressions(t *testing.T) {
 			}},
 		{
 			input:             "1 < 2",
-			expectedConstants: []interface{}{2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpLessThan),
 				code.Make(code.OpPop),
 			}},
 		{
@@ -138,82 +268,978 @@ func TestBooleanExpressions(t *testing.T) {
 			input:             "true == false",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpFalse),
-				code.Make(code.OpEqual),
+				code.Make(code.OpTrue),
+				code.Make(code.OpFalse),
+				code.Make(code.OpEqual),
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             "true != false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpFalse),
+				code.Make(code.OpNotEqual),
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             "!true",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpBang),
+				code.Make(code.OpPop),
+			}},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `if (true) { 10 } else { 20 }; 3333;
+				`,
+			expectedConstants: []interface{}{10, 20, 3333},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpJump, 13),
+				// 0010
+				code.Make(code.OpConstant, 1),
+				// 0013
+				code.Make(code.OpPop),
+				// 0014
+				code.Make(code.OpConstant, 2),
+				// 0017
+				code.Make(code.OpPop),
+			}},
+		{
+			input: `if (true) { 10 } ; 3333;
+					`,
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpJump, 11),
+				// 0010
+				code.Make(code.OpNull),
+				// 0011
+				code.Make(code.OpPop),
+				// 0012
+				code.Make(code.OpConstant, 1),
+				// 0015
+				code.Make(code.OpPop),
+			}},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `while (true) { 10; break; continue; } 20;`,
+			expectedConstants: []interface{}{10, 20},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpLoopMark, 0),
+				// 0002
+				code.Make(code.OpTrue),
+				// 0003
+				code.Make(code.OpJumpNotTruthy, 23),
+				// 0006
+				code.Make(code.OpConstant, 0),
+				// 0009
+				code.Make(code.OpPop),
+				// 0010
+				code.Make(code.OpLoopUnwind, 0),
+				// 0012
+				code.Make(code.OpJump, 23),
+				// 0015
+				code.Make(code.OpLoopUnwind, 0),
+				// 0017
+				code.Make(code.OpJump, 2),
+				// 0020
+				code.Make(code.OpJump, 2),
+				// 0023
+				code.Make(code.OpNull),
+				// 0024
+				code.Make(code.OpPop),
+				// 0025
+				code.Make(code.OpConstant, 1),
+				// 0028
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             `for (let i = 1; i; 2) { continue; }`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpLoopMark, 0),
+				// 0008
+				code.Make(code.OpGetGlobal, 0),
+				// 0011
+				code.Make(code.OpJumpNotTruthy, 26),
+				// 0014
+				code.Make(code.OpLoopUnwind, 0),
+				// 0016
+				code.Make(code.OpJump, 19),
+				// 0019
+				code.Make(code.OpConstant, 1),
+				// 0022
+				code.Make(code.OpPop),
+				// 0023
+				code.Make(code.OpJump, 8),
+				// 0026
+				code.Make(code.OpNull),
+				// 0027
+				code.Make(code.OpPop),
+			}},
+		{
+			input:             `for (x in [1]) { x; break; }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpArray, 1),
+				// 0006
+				code.Make(code.OpIter),
+				// 0007
+				code.Make(code.OpLoopMark, 0),
+				// 0009
+				code.Make(code.OpIterNext, 28),
+				// 0012
+				code.Make(code.OpSetGlobal, 0),
+				// 0015
+				code.Make(code.OpGetGlobal, 0),
+				// 0018
+				code.Make(code.OpPop),
+				// 0019
+				code.Make(code.OpLoopUnwind, 0),
+				// 0021
+				code.Make(code.OpPop),
+				// 0022
+				code.Make(code.OpJump, 28),
+				// 0025
+				code.Make(code.OpJump, 9),
+				// 0028
+				code.Make(code.OpNull),
+				// 0029
+				code.Make(code.OpPop),
+			}},
+		{
+			// 内层循环的嵌套层数为1
+			input:             `while (true) { while (true) { break; } }`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpLoopMark, 0),
+				// 0002
+				code.Make(code.OpTrue),
+				// 0003
+				code.Make(code.OpJumpNotTruthy, 25),
+				// 0006
+				code.Make(code.OpLoopMark, 1),
+				// 0008
+				code.Make(code.OpTrue),
+				// 0009
+				code.Make(code.OpJumpNotTruthy, 20),
+				// 0012
+				code.Make(code.OpLoopUnwind, 1),
+				// 0014
+				code.Make(code.OpJump, 20),
+				// 0017
+				code.Make(code.OpJump, 8),
+				// 0020
+				code.Make(code.OpNull),
+				// 0021
+				code.Make(code.OpPop),
+				// 0022
+				code.Make(code.OpJump, 2),
+				// 0025
+				code.Make(code.OpNull),
+				// 0026
+				code.Make(code.OpPop),
+			}},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `let x = 1; x = 2;`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 给函数自己的名字赋值时，函数名解析为外层的全局变量，不用OpCurrentClosure
+			input: `let f = fn() { f = 1; f }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetGlobal, 0),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: `fn() { let x = 1; x -= 2 }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSub),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			fn() {
+				let x = 1;
+				fn() { x += 2 }
+			}
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocalCell, 0),
+					code.Make(code.OpClosure, 2, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestIndexAssignExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `let a = [1]; a[0] = 2;`,
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `let a = [1]; a[0] += 2;`,
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDup, 2),
+				code.Make(code.OpIndex),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestMemberExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `"a".upper()`,
+			expectedConstants: []interface{}{"a", "upper"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpGetMember, 1),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `let h = {}; h.x = 1;`,
+			expectedConstants: []interface{}{"x", 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestNullAndOptionalChaining(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `null ?? 1;`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpNull),
+				// 0001
+				code.Make(code.OpJumpNotNull, 8),
+				// 0004
+				code.Make(code.OpPop),
+				// 0005
+				code.Make(code.OpConstant, 0),
+				// 0008
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `let a = null; a?.b?[0].c();`,
+			expectedConstants: []interface{}{"b", 0, "c"},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpNull),
+				// 0001
+				code.Make(code.OpSetGlobal, 0),
+				// 0004
+				code.Make(code.OpGetGlobal, 0),
+				// 0007
+				code.Make(code.OpJumpNull, 25),
+				// 0010
+				code.Make(code.OpGetMember, 0),
+				// 0013
+				code.Make(code.OpJumpNull, 25),
+				// 0016
+				code.Make(code.OpConstant, 1),
+				// 0019
+				code.Make(code.OpIndex),
+				// 0020
+				code.Make(code.OpGetMember, 2),
+				// 0023
+				code.Make(code.OpCall, 0),
+				// 0025
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestInterpolatedStrings(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `"a ${1} b"`,
+			expectedConstants: []interface{}{"a ", 1, " b"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConcat, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"${1}"`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConcat, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let [a, ...b] = [1, 2];",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpDestructArray, 1, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+		{
+			input: `fn(h) { let {x, y: z} = h; z }`,
+			expectedConstants: []interface{}{
+				"x",
+				"y",
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpDestructHash, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(a, b = 1, ...c) { b }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
 				code.Make(code.OpPop),
-			}},
+			},
+		},
 		{
-			input:             "true != false",
-			expectedConstants: []interface{}{},
+			input: "let f = fn(a) { a }; f(1, ...[2], 3)",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+				2,
+				3,
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpFalse),
-				code.Make(code.OpNotEqual),
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpCallSpread, 3),
 				code.Make(code.OpPop),
-			}},
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestFunctionArity(t *testing.T) {
+	tests := []struct {
+		input          string
+		numParameters  int
+		variadic       bool
+		defaultOffsets []int
+		bodyOffset     int
+	}{
+		{"fn(a, b) { a }", 2, false, nil, 0},
+		{"fn(a, ...b) { a }", 1, true, nil, 0},
+		// OpConstant 3字节，OpSetLocal 2字节
+		{"fn(a, b = 1, c = 2) { a }", 3, false, []int{0, 5}, 10},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var fn *object.CompiledFunction
+		for _, c := range compiler.Bytecode().Constants {
+			if f, ok := c.(*object.CompiledFunction); ok {
+				fn = f
+			}
+		}
+		if fn == nil {
+			t.Fatalf("no compiled function in constants")
+		}
+		if fn.NumParameters != tt.numParameters || fn.Variadic != tt.variadic {
+			t.Errorf("wrong arity. want=(%d, %t), got=(%d, %t)",
+				tt.numParameters, tt.variadic, fn.NumParameters, fn.Variadic)
+		}
+		if fmt.Sprint(fn.DefaultOffsets) != fmt.Sprint(tt.defaultOffsets) || fn.BodyOffset != tt.bodyOffset {
+			t.Errorf("wrong offsets. want=(%v, %d), got=(%v, %d)",
+				tt.defaultOffsets, tt.bodyOffset, fn.DefaultOffsets, fn.BodyOffset)
+		}
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []struct {
+		compilerTestCase
+		expectedHandlers []object.ExceptionHandler
+	}{
 		{
-			input:             "!true",
-			expectedConstants: []interface{}{},
+			compilerTestCase{
+				input:             "try { 1 } catch (e) { e }",
+				expectedConstants: []interface{}{1},
+				expectedInstructions: []code.Instructions{
+					// 0000
+					code.Make(code.OpTry, 0),
+					// 0003
+					code.Make(code.OpConstant, 0),
+					// 0006
+					code.Make(code.OpJump, 15),
+					// 0009 catch
+					code.Make(code.OpBindGlobal, 0),
+					// 0012
+					code.Make(code.OpGetGlobal, 0),
+					// 0015
+					code.Make(code.OpPop),
+				},
+			},
+			[]object.ExceptionHandler{{Start: 3, End: 6, Target: 9, Slot: 0}},
+		},
+		{
+			compilerTestCase{
+				input:             "try { 1 } finally { 2 }",
+				expectedConstants: []interface{}{1, 2, 2},
+				expectedInstructions: []code.Instructions{
+					// 0000
+					code.Make(code.OpTry, 0),
+					// 0003
+					code.Make(code.OpConstant, 0),
+					// 0006 正常结束时的finally
+					code.Make(code.OpConstant, 1),
+					// 0009
+					code.Make(code.OpPop),
+					// 0010
+					code.Make(code.OpJump, 18),
+					// 0013 出现异常时的finally
+					code.Make(code.OpConstant, 2),
+					// 0016
+					code.Make(code.OpPop),
+					// 0017
+					code.Make(code.OpThrow),
+					// 0018
+					code.Make(code.OpPop),
+				},
+			},
+			[]object.ExceptionHandler{{Start: 3, End: 6, Target: 13, Slot: 0, Finally: true}},
+		},
+		{
+			compilerTestCase{
+				input:             "try { throw 1 } catch { 2 } finally { 3 }",
+				expectedConstants: []interface{}{1, 2, 3, 3},
+				expectedInstructions: []code.Instructions{
+					// 0000 finally处理器
+					code.Make(code.OpTry, 0),
+					// 0003 catch处理器
+					code.Make(code.OpTry, 1),
+					// 0006
+					code.Make(code.OpConstant, 0),
+					// 0009
+					code.Make(code.OpThrow),
+					// 0010
+					code.Make(code.OpNull),
+					// 0011
+					code.Make(code.OpJump, 18),
+					// 0014 catch
+					code.Make(code.OpPop),
+					// 0015
+					code.Make(code.OpConstant, 1),
+					// 0018
+					code.Make(code.OpConstant, 2),
+					// 0021
+					code.Make(code.OpPop),
+					// 0022
+					code.Make(code.OpJump, 30),
+					// 0025
+					code.Make(code.OpConstant, 3),
+					// 0028
+					code.Make(code.OpPop),
+					// 0029
+					code.Make(code.OpThrow),
+					// 0030
+					code.Make(code.OpPop),
+				},
+			},
+			[]object.ExceptionHandler{
+				{Start: 6, End: 11, Target: 14, Slot: 1},
+				{Start: 3, End: 18, Target: 25, Slot: 0, Finally: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		runCompilerTests(t, []compilerTestCase{tt.compilerTestCase})
+
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		handlers := compiler.Bytecode().Handlers
+		if !reflect.DeepEqual(handlers, tt.expectedHandlers) {
+			t.Errorf("wrong handlers. want=%+v, got=%+v", tt.expectedHandlers, handlers)
+		}
+	}
+}
+
+func TestLineTable(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse("1;\n2 +\n3;\nlet f = fn() {\n  4\n};"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := compiler.Bytecode()
+
+	// 中缀表达式的OpAdd在右边的操作数之后生成，归到表达式开头的那一行
+	expected := []object.LineInfo{
+		{Offset: 0, Line: 1},
+		{Offset: 4, Line: 2},
+		{Offset: 7, Line: 3},
+		{Offset: 10, Line: 2},
+		{Offset: 12, Line: 4},
+	}
+	if !reflect.DeepEqual(bytecode.Lines, expected) {
+		t.Errorf("wrong main lines. want=%+v, got=%+v", expected, bytecode.Lines)
+	}
+
+	fn, ok := bytecode.Constants[len(bytecode.Constants)-1].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant is not CompiledFunction. got=%T", bytecode.Constants[len(bytecode.Constants)-1])
+	}
+	if fn.Name != "f" {
+		t.Errorf("wrong function name. want=%q, got=%q", "f", fn.Name)
+	}
+	if fn.LineAt(0) != 5 {
+		t.Errorf("wrong line for function body. want=5, got=%d", fn.LineAt(0))
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(f) { if (f) { f(1) } else { f(2); f(3) } }`,
+			expectedConstants: []interface{}{
+				1, 2, 3,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpJumpNotTruthy, 15),
+					// 0005
+					code.Make(code.OpGetLocal, 0),
+					// 0007
+					code.Make(code.OpConstant, 0),
+					// 0010
+					code.Make(code.OpTailCall, 1),
+					// 0012
+					code.Make(code.OpJump, 30),
+					// 0015
+					code.Make(code.OpGetLocal, 0),
+					// 0017
+					code.Make(code.OpConstant, 1),
+					// 0020 不是分支中最后的表达式
+					code.Make(code.OpCall, 1),
+					// 0022
+					code.Make(code.OpPop),
+					// 0023
+					code.Make(code.OpGetLocal, 0),
+					// 0025
+					code.Make(code.OpConstant, 2),
+					// 0028
+					code.Make(code.OpTailCall, 1),
+					// 0030
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpBang),
+				code.Make(code.OpClosure, 3, 0),
 				code.Make(code.OpPop),
-			}},
+			},
+		},
 	}
 	runCompilerTests(t, tests)
+
+	// 这些调用之后还要用到当前帧
+	notTail := []string{
+		`fn(f) { f(1) + 1 }`,
+		`fn(f) { return f(1) + 1; }`,
+		`fn(f) { let x = f(1); }`,
+		`fn(f) { try { return f(1); } finally { f(2) } }`,
+		`fn(f) { try { f(1) } catch (e) { 0 } }`,
+		`fn(f) { f(...[1]) }`,
+	}
+	for _, input := range notTail {
+		compiler := New()
+		err := compiler.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		fn := compiler.Bytecode().Constants[len(compiler.Bytecode().Constants)-1].(*object.CompiledFunction)
+		if strings.Contains(fn.Instructions.String(), "OpTailCall") {
+			t.Errorf("unexpected tail call in %q:\n%s", input, fn.Instructions)
+		}
+	}
 }
 
-func TestConditionals(t *testing.T) {
+func TestMatchExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input: `if (true) { 10 } else { 20 }; 3333;
-				`,
-			expectedConstants: []interface{}{10, 20, 3333},
+			input:             "match (1) { 2 => 3, x => x }",
+			expectedConstants: []interface{}{1, 2, 3},
 			expectedInstructions: []code.Instructions{
 				// 0000
-				code.Make(code.OpTrue),
-				// 0001
-				code.Make(code.OpJumpNotTruthy, 10),
-				// 0004
 				code.Make(code.OpConstant, 0),
-				// 0007
-				code.Make(code.OpJump, 13),
-				// 0010
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
 				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpEqual),
 				// 0013
-				code.Make(code.OpPop),
-				// 0014
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0016
 				code.Make(code.OpConstant, 2),
-				// 0017
+				// 0019
+				code.Make(code.OpJump, 35),
+				// 0022
+				code.Make(code.OpGetGlobal, 0),
+				// 0025
+				code.Make(code.OpBindGlobal, 1),
+				// 0028
+				code.Make(code.OpGetGlobal, 1),
+				// 0031
+				code.Make(code.OpJump, 35),
+				// 0034
+				code.Make(code.OpNull),
+				// 0035
 				code.Make(code.OpPop),
-			}},
+			},
+		},
 		{
-			input: `if (true) { 10 } ; 3333;
-					`,
-			expectedConstants: []interface{}{10, 3333},
+			input:             "match (1) { [a] => a }",
+			expectedConstants: []interface{}{1},
 			expectedInstructions: []code.Instructions{
 				// 0000
-				code.Make(code.OpTrue),
-				// 0001
-				code.Make(code.OpJumpNotTruthy, 10),
-				// 0004
 				code.Make(code.OpConstant, 0),
-				// 0007
-				code.Make(code.OpJump, 11),
-				// 0010
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpMatchArray, 1, 0),
+				// 0013
+				code.Make(code.OpJumpNotTruthy, 32),
+				// 0016
+				code.Make(code.OpGetGlobal, 0),
+				// 0019
+				code.Make(code.OpDestructArray, 1, 0),
+				// 0023
+				code.Make(code.OpBindGlobal, 1),
+				// 0026
+				code.Make(code.OpGetGlobal, 1),
+				// 0029
+				code.Make(code.OpJump, 33),
+				// 0032
 				code.Make(code.OpNull),
-				// 0011
+				// 0033
 				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 闭包通过Cell捕获match绑定的全局变量
+			input: "match (1) { v => fn() { v } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpBindGlobal, 1),
 				// 0012
-				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGetGlobalCell, 1),
 				// 0015
+				code.Make(code.OpClosure, 1, 1),
+				// 0019
+				code.Make(code.OpJump, 23),
+				// 0022
+				code.Make(code.OpNull),
+				// 0023
 				code.Make(code.OpPop),
-			}},
+			},
+		},
+		{
+			input: "fn() { match (1) { v => v } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpBindLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpJump, 15),
+					code.Make(code.OpNull),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 	runCompilerTests(t, tests)
 }
 
+func TestMatchBindingsAreScopedToArm(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse("match (1) { a => a }; a"))
+	if err == nil || err.Error() != "1:23: undefined variable a" {
+		t.Fatalf("expected undefined variable error. got=%v", err)
+	}
+}
+
+func TestUnreachableMatchArms(t *testing.T) {
+	tests := []struct {
+		input   string
+		columns []int
+		hints   []string
+	}{
+		{"match (x) { 1 => 1, 2 => 2 }", nil, nil},
+		{"match (x) { n if n > 1 => 1, _ => 2, 3 => 3 }", []int{38}, []string{"an earlier arm matches every value"}},
+		{"match (x) { n => 1, [a] => 2, _ => 3 }", []int{21, 31}, []string{"an earlier arm matches every value", "an earlier arm matches every value"}},
+		{"match (x) { 1 => 1, 1 => 2 }", []int{21}, []string{"an earlier arm matches the same value"}},
+		{"match (x) { 1 if y => 1, 1 => 2, 1 if y => 3 }", []int{34}, []string{"an earlier arm matches the same value"}},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		compiler.symbolTable.Define("x")
+		compiler.symbolTable.Define("y")
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		warnings := compiler.Warnings()
+		if len(warnings) != len(tt.columns) {
+			t.Fatalf("wrong number of warnings for %q. want=%d, got=%v", tt.input, len(tt.columns), warnings)
+		}
+		for i, w := range warnings {
+			if w.Severity != diagnostic.Warning || w.Code != diagnostic.UnreachableArm {
+				t.Errorf("warning is not UnreachableArm. got=%s", w)
+			}
+			if w.Message != "unreachable match arm" || w.Hint != tt.hints[i] {
+				t.Errorf("wrong warning. got=%q (%q)", w.Message, w.Hint)
+			}
+			if w.Pos.Line != 1 || w.Pos.Column != tt.columns[i] {
+				t.Errorf("wrong position. want=1:%d, got=%s", tt.columns[i], w.Pos)
+			}
+		}
+	}
+}
+
+func TestLoopErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"break;", "1:1: break outside loop"},
+		{"while (true) { fn() { continue; } }", "1:23: continue outside loop"},
+		{"x = 1", "1:1: undefined variable x"},
+		{"len = 1", "1:1: cannot assign to builtin function len"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q but resulted in none.", tt.input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -720,7 +1746,7 @@ func TestBuiltins(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpGetBuiltin, 0),
 					code.Make(code.OpArray, 0),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -749,7 +1775,7 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{ // fn(a)
-					code.Make(code.OpGetLocal, 0), // 有自由变量，它才被压栈
+					code.Make(code.OpGetLocalCell, 0), // 有自由变量，它才被压栈
 					code.Make(code.OpClosure, 0, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -777,13 +1803,13 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetFreeCell, 0),
+					code.Make(code.OpGetLocalCell, 0),
 					code.Make(code.OpClosure, 0, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocalCell, 0),
 					code.Make(code.OpClosure, 1, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -827,15 +1853,15 @@ func TestClosures(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpConstant, 2),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetFreeCell, 0),
+					code.Make(code.OpGetLocalCell, 0),
 					code.Make(code.OpClosure, 4, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
 					code.Make(code.OpConstant, 1),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocalCell, 0),
 					code.Make(code.OpClosure, 5, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -865,7 +1891,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 				1,
@@ -894,7 +1920,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 				1,
@@ -903,7 +1929,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpSetLocal, 0),
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 2),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -973,6 +1999,14 @@ func testConstants(t *testing.T, expected []interface{}, actual []object.Object)
 			if err != nil {
 				return fmt.Errorf("constant %d - testIntegerObject failed: %s", i, err)
 			}
+		case float64:
+			result, ok := actual[i].(*object.Float)
+			if !ok {
+				return fmt.Errorf("constant %d - not a float: %T", i, actual[i])
+			}
+			if result.Value != constant {
+				return fmt.Errorf("constant %d - wrong value. got=%g, want=%g", i, result.Value, constant)
+			}
 		case string:
 			err := testStringObject(constant, actual[i])
 			if err != nil {
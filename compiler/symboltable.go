@@ -11,9 +11,10 @@ const (
 )
 
 type Symbol struct {
-	Name  string
-	Scope SymbolScope
-	Index int
+	Name    string
+	Scope   SymbolScope
+	Index   int
+	Rebound bool // match分支或catch绑定的全局变量，每次执行都是新的绑定，闭包要通过Cell捕获它
 }
 
 type SymbolTable struct {
@@ -67,7 +68,7 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 			return obj, ok
 		}
 
-		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+		if obj.Scope == GlobalScope && !obj.Rebound || obj.Scope == BuiltinScope {
 			return obj, ok
 		}
 
@@ -77,6 +78,38 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	return obj, ok
 }
 
+// 记下names在本作用域中当前的符号，配合restore使用
+func (s *SymbolTable) save(names []string) map[string]Symbol {
+	saved := make(map[string]Symbol)
+	for _, name := range names {
+		if symbol, ok := s.store[name]; ok {
+			saved[name] = symbol
+		}
+	}
+	return saved
+}
+
+// 恢复save时的符号，之后定义的同名符号不再可见；它们占用的槽不回收
+func (s *SymbolTable) restore(names []string, saved map[string]Symbol) {
+	for _, name := range names {
+		if symbol, ok := saved[name]; ok {
+			s.store[name] = symbol
+		} else {
+			delete(s.store, name)
+		}
+	}
+}
+
+// 定义match分支或catch绑定的名字
+func (s *SymbolTable) DefineBinding(name string) Symbol {
+	symbol := s.Define(name)
+	if symbol.Scope == GlobalScope {
+		symbol.Rebound = true
+		s.store[name] = symbol
+	}
+	return symbol
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol { // 找函数是靠名字找，index标明了vm运行时的存放地点
 	symbol := Symbol{Name: name, Scope: BuiltinScope, Index: index}
 
@@ -95,6 +128,18 @@ func (s *SymbolTable) defineFree(original Symbol) Symbol {
 	return symbol
 }
 
+// 沿着自由变量找到它最初定义的位置，如果是函数自身的名字，返回定义它的函数的符号表，否则返回nil
+func (s *SymbolTable) functionNameTable(symbol Symbol) *SymbolTable {
+	for symbol.Scope == FreeScope {
+		symbol = s.FreeSymbols[symbol.Index]
+		s = s.Outer
+	}
+	if symbol.Scope != FunctionScope {
+		return nil
+	}
+	return s
+}
+
 func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 	symbol := Symbol{Name: name, Scope: FunctionScope, Index: 0} // index为0，因为它就在栈的基指针里
 
@@ -0,0 +1,116 @@
+package diagnostic
+
+import (
+	"bytes"
+	"fmt"
+	"monkey/token"
+	"strings"
+	"unicode/utf8"
+)
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Error:
+		return "error"
+	case Warning:
+		return "warning"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// 诊断编号，供工具按类别识别，不必解析消息文本
+type Code string
+
+const (
+	// 词法错误
+	UnterminatedComment Code = "E0001" // 块注释没有闭合
+	UnterminatedString  Code = "E0002" // 字符串没有闭合
+	InvalidEscape       Code = "E0003" // 非法的转义序列
+	IllegalCharacter    Code = "E0004" // 不能出现在源码中的字符
+	MalformedNumber     Code = "E0005" // 数字字面量格式错误
+
+	// 语法错误
+	UnexpectedToken    Code = "E0101" // 期待的词法单元与实际不符
+	NoPrefixParseFn    Code = "E0102" // 该词法单元不能作为表达式的开头
+	InvalidInteger     Code = "E0103" // 整数字面量无法解析
+	InvalidFloat       Code = "E0104" // 浮点数字面量无法解析
+	IntegerOverflow    Code = "E0105" // 整数字面量超出int64范围
+	InvalidAssign      Code = "E0106" // 赋值号左边不是可以赋值的目标
+	EmptyInterpolation Code = "E0107" // 字符串插值${}中没有表达式
+	DuplicateName      Code = "E0108" // 同一个模式中重复绑定同一个名字
+	MissingDefault     Code = "E0109" // 有默认值的参数后面跟着没有默认值的参数
+	InvalidPattern     Code = "E0110" // 模式中出现不能使用的写法
+	MissingHandler     Code = "E0111" // try后面既没有catch也没有finally
+
+	// 编译警告
+	UnreachableArm Code = "W0201" // 前面的分支已经匹配了所有可能的值
+)
+
+// 带位置的诊断信息，范围为[Pos, End)
+type Diagnostic struct {
+	Severity Severity
+	Code     Code
+	Message  string
+	Pos      token.Position
+	End      token.Position
+	Hint     string // 可选的修改建议
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s[%s]: %s", d.Pos, d.Severity, d.Code, d.Message)
+}
+
+// 渲染诊断信息，并在出错的源码行下面用'^'标出范围
+func (d Diagnostic) Render(source string) string {
+	var out bytes.Buffer
+
+	out.WriteString(d.String())
+	out.WriteString("\n")
+
+	offset := d.Pos.Offset
+	if d.Pos.IsValid() && offset >= 0 && offset <= len(source) {
+		lineStart := strings.LastIndexByte(source[:offset], '\n') + 1
+		lineEnd := len(source)
+		if i := strings.IndexByte(source[offset:], '\n'); i >= 0 {
+			lineEnd = offset + i
+		}
+		line := strings.TrimRight(source[lineStart:lineEnd], "\r")
+
+		// 保留制表符，保证'^'与源码对齐
+		var indent bytes.Buffer
+		for _, r := range source[lineStart:offset] {
+			if r == '\t' {
+				indent.WriteRune('\t')
+			} else {
+				indent.WriteRune(' ')
+			}
+		}
+
+		width := 1
+		if d.End.Offset > offset && d.End.Offset <= lineEnd {
+			width = utf8.RuneCountInString(source[offset:d.End.Offset])
+		}
+
+		out.WriteString(line)
+		out.WriteString("\n")
+		out.WriteString(indent.String())
+		out.WriteString(strings.Repeat("^", width))
+		out.WriteString("\n")
+	}
+
+	if d.Hint != "" {
+		out.WriteString("hint: ")
+		out.WriteString(d.Hint)
+		out.WriteString("\n")
+	}
+
+	return out.String()
+}
@@ -0,0 +1,53 @@
+package diagnostic
+
+import (
+	"monkey/token"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	source := "let x = 1;\n\tlet y = (x;\nlet z = 3;"
+
+	tests := []struct {
+		diagnostic Diagnostic
+		expected   string
+	}{
+		{
+			Diagnostic{
+				Severity: Error,
+				Code:     UnexpectedToken,
+				Message:  "expected next token to be ), got ; instead",
+				Pos:      token.Position{Offset: 22, Line: 2, Column: 12},
+				End:      token.Position{Offset: 23, Line: 2, Column: 13},
+				Hint:     "did you forget a closing ')'?",
+			},
+			"2:12: error[E0101]: expected next token to be ), got ; instead\n" +
+				"\tlet y = (x;\n" +
+				"\t          ^\n" +
+				"hint: did you forget a closing ')'?\n",
+		},
+		{
+			Diagnostic{
+				Severity: Warning,
+				Code:     NoPrefixParseFn,
+				Message:  "something about let",
+				Pos:      token.Position{Offset: 24, Line: 3, Column: 1},
+				End:      token.Position{Offset: 27, Line: 3, Column: 4},
+			},
+			"3:1: warning[E0102]: something about let\n" +
+				"let z = 3;\n" +
+				"^^^\n",
+		},
+		{
+			Diagnostic{Severity: Error, Code: InvalidInteger, Message: "no position"},
+			"-: error[E0103]: no position\n",
+		},
+	}
+
+	for i, tt := range tests {
+		rendered := tt.diagnostic.Render(source)
+		if rendered != tt.expected {
+			t.Errorf("tests[%d] - wrong rendering.\nwant=%q\ngot =%q", i, tt.expected, rendered)
+		}
+	}
+}
@@ -1,19 +1,57 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"monkey/ast"
 	"monkey/object"
+	"strings"
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL     = &object.Null{}
+	TRUE     = &object.Boolean{Value: true}
+	FALSE    = &object.Boolean{Value: false}
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
+// EvalContext中没有设置MaxDepth时的最大调用深度，和虚拟机的MaxFrames相同
+const MaxDepth = 1024
+
+// 执行预算，0表示不限制。解释器每求值一个节点算一条指令
+type Limits struct {
+	MaxInstructions int
+	MaxAllocations  int
+	MaxDepth        int // 最大调用深度，0表示使用MaxDepth；否则深递归会耗尽Go的栈让进程崩溃
+}
+
+// 和Eval相同，但ctx被取消或超出预算时中止求值，返回*object.AbortError；
+// 脚本自身的错误仍然作为*object.Error结果返回
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment, limits Limits) (object.Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &object.AbortError{Err: err}
+	}
+	if limits.MaxDepth <= 0 {
+		limits.MaxDepth = MaxDepth
+	}
+	env.SetBudget(object.NewBudget(ctx, limits.MaxInstructions, limits.MaxAllocations, limits.MaxDepth))
+	defer env.SetBudget(nil)
+
+	result := Eval(node, env)
+	if err, ok := result.(*object.Error); ok && err.Abort != nil {
+		return nil, err.Abort
+	}
+	return result, nil
+}
+
 // 每用一次Eval，就得及时错误处理，免得Error到处传递
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	if err := env.Budget().Step(); err != nil {
+		return abortError(err)
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
 		return evalProgram(node.Statements, env)
@@ -23,6 +61,8 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalIdentifier(node, env)
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 	case *ast.Boolean:
@@ -32,19 +72,20 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
-		return &object.Array{Elements: elements}
+		return allocate(&object.Array{Elements: elements}, env)
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
-	case *ast.IndexExpression:
-		left := Eval(node.Left, env)
-		if isError(left) {
-			return left
-		}
-		index := Eval(node.Index, env)
-		if isError(index) {
-			return index
-		}
-		return evalIndexExpression(left, index)
+		return allocate(evalHashLiteral(node, env), env)
+	case *ast.NullLiteral:
+		return NULL
+	case *ast.MatchExpression:
+		return evalMatchExpression(node, env)
+	case *ast.MacroLiteral:
+		return newError("macro must be bound by a top-level let")
+	case *ast.InterpolatedString:
+		return allocate(evalInterpolatedString(node, env), env)
+	case *ast.IndexExpression, *ast.MemberExpression, *ast.CallExpression:
+		result, _ := evalChain(node.(ast.Expression), env)
+		return result
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
 		if isError(right) {
@@ -52,6 +93,13 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		}
 		return evalPrefixExpression(node.Operator, right)
 	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, env)
+		}
+		if node.Operator == "??" {
+			return evalNullishExpression(node, env)
+		}
+
 		left := Eval(node.Left, env)
 		if isError(left) {
 			return left
@@ -61,53 +109,202 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(right) {
 			return right
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		result := evalInfixExpression(node.Operator, left, right)
+		if result.Type() == object.STRING_OBJ { // 只有字符串拼接会创建新的值
+			return allocate(result, env)
+		}
+		return result
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
 	case *ast.BlockStatement:
 		return evalBlockStatement(node.Statements, env)
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
+	case *ast.WhileStatement:
+		return evalWhileStatement(node, env)
+	case *ast.ForStatement:
+		return evalForStatement(node, env)
+	case *ast.ForInStatement:
+		return evalForInStatement(node, env)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
 	case *ast.ReturnStatement:
 		val := Eval(node.ReturnValue, env)
 		if isError(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return object.NewException(val)
+	case *ast.TryExpression:
+		return evalTryExpression(node, env)
 	case *ast.LetStatement:
 		val := Eval(node.Value, env)
 		if isError(val) {
 			return val
 		}
+		if node.Pattern != nil {
+			return bindPattern(node.Pattern, val, env)
+		}
 		env.Set(node.Name.Value, val)
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Body: body, Env: env}
+		return allocate(&object.Function{Parameters: params, Defaults: node.Defaults, Rest: node.Rest, Body: body, Env: env}, env)
+	}
+
+	return nil
+}
+
+// 求值由索引、成员访问和调用组成的链，如a?.b.c(x)[0]。
+// a?.b在a为null时让整条链短路，返回的bool表示已经短路，外层不再继续求值
+func evalChain(node ast.Expression, env *object.Environment) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IndexExpression:
+		left, short := evalChain(node.Left, env)
+		if short || isError(left) {
+			return left, short
+		}
+		if node.Optional && left == NULL {
+			return NULL, true
+		}
+		index := Eval(node.Index, env)
+		if isError(index) {
+			return index, false
+		}
+		return evalIndexExpression(left, index), false
+	case *ast.MemberExpression:
+		obj, short := evalChain(node.Object, env)
+		if short || isError(obj) {
+			return obj, short
+		}
+		if node.Optional && obj == NULL {
+			return NULL, true
+		}
+		return evalMemberExpression(obj, node.Property.Value), false
 	case *ast.CallExpression:
-		function := Eval(node.Function, env)
-		if isError(function) {
-			return function
+		if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "quote" {
+			if len(node.Arguments) != 1 {
+				return newError("wrong number of arguments to `quote`. got=%d, want=1", len(node.Arguments)), false
+			}
+			return quote(node.Arguments[0], env), false
+		}
+		function, short := evalChain(node.Function, env)
+		if short || isError(function) {
+			return function, short
 		}
-		args := evalExpressions(node.Arguments, env)
+		args := evalArguments(node.Arguments, env)
 		if len(args) == 1 && isError(args[0]) {
-			return args[0]
+			return args[0], false
+		}
+		if function.Type() == object.FUNCTION_OBJ {
+			return applyFunction(function, args), false
 		}
-		return applyFunction(function, args)
+		return allocate(applyFunction(function, args), env), false // 内置函数的结果都按新创建的值计算
+	default:
+		return Eval(node, env), false
 	}
+}
 
-	return nil
+// 各部分按Inspect()转成字符串后拼接
+func evalInterpolatedString(node *ast.InterpolatedString, env *object.Environment) object.Object {
+	var out strings.Builder
+
+	for _, part := range node.Parts {
+		val := Eval(part, env)
+		if isError(val) {
+			return val
+		}
+		out.WriteString(val.Inspect())
+	}
+
+	return &object.String{Value: out.String()}
+}
+
+// a ?? b，a不是null时不求值b
+func evalNullishExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isError(left) || left != NULL {
+		return left
+	}
+	return Eval(node.Right, env)
 }
 
 func newError(format string, a ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
 
+// 中止运行的错误沿着Error的传递路径一直返回到EvalContext
+func abortError(err error) *object.Error {
+	abort := err.(*object.AbortError)
+	return &object.Error{Message: abort.Error(), Abort: abort}
+}
+
+func isAborted(obj object.Object) bool {
+	err, ok := obj.(*object.Error)
+	return ok && err.Abort != nil
+}
+
+// 记下新创建的值，超出分配预算时返回中止运行的错误
+func allocate(obj object.Object, env *object.Environment) object.Object {
+	if isError(obj) {
+		return obj
+	}
+	if err := env.Budget().Allocate(obj); err != nil {
+		return abortError(err)
+	}
+	return obj
+}
+
+// break、continue和return也算在内：它们和错误一样要中断表达式的求值，
+// 一直传到循环或函数，如[1, if (x) { break }]
 func isError(obj object.Object) bool {
 	if obj != nil {
-		return obj.Type() == object.ERROR_OBJ
+		switch obj.Type() {
+		case object.ERROR_OBJ, object.BREAK_OBJ, object.CONTINUE_OBJ, object.RETURN_VALUE_OBJ:
+			return true
+		}
 	}
 	return false
 }
 
+// 错误一路向外传递，直到被try接住；finally总会运行，它自己的错误、return、break和continue优先
+func evalTryExpression(te *ast.TryExpression, env *object.Environment) object.Object {
+	result := Eval(te.Block, env)
+	if isAborted(result) { // 中止运行时catch和finally都不执行
+		return result
+	}
+
+	if err, ok := result.(*object.Error); ok && te.Catch != nil {
+		catchEnv := object.NewEnclosedEnvironment(env)
+		if te.Param != nil {
+			catchEnv.Set(te.Param.Value, err.Caught())
+		}
+		result = Eval(te.Catch, catchEnv)
+		if isAborted(result) {
+			return result
+		}
+	}
+
+	if te.Finally != nil {
+		finally := Eval(te.Finally, env)
+		if isError(finally) {
+			return finally
+		}
+	}
+
+	if result == nil {
+		return NULL
+	}
+	return result
+}
+
 func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 	var result object.Object
 
@@ -119,6 +316,8 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 			return result.Value
 		case *object.Error: // 有错误就抛出错误, 不解值
 			return result
+		case *object.Break, *object.Continue:
+			return newError("%s outside loop", result.Inspect())
 		}
 	}
 
@@ -134,7 +333,8 @@ func evalBlockStatement(stmts []ast.Statement, env *object.Environment) object.O
 		// 在块内找到return不接包，丢到上级解return，以便于在多重嵌套中返回return
 		if result != nil {
 			rt := result.Type()
-			if rt == object.ERROR_OBJ || rt == object.RETURN_VALUE_OBJ {
+			if rt == object.ERROR_OBJ || rt == object.RETURN_VALUE_OBJ ||
+				rt == object.BREAK_OBJ || rt == object.CONTINUE_OBJ {
 				return result
 			}
 		}
@@ -150,6 +350,117 @@ func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	return FALSE
 }
 
+// &&和||短路求值，右边只在需要时才求值，结果总是布尔值
+func evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	if node.Operator == "&&" && !isTruthy(left) {
+		return FALSE
+	}
+	if node.Operator == "||" && isTruthy(left) {
+		return TRUE
+	}
+
+	right := Eval(node.Right, env)
+	if isError(right) {
+		return right
+	}
+	return nativeBoolToBooleanObject(isTruthy(right))
+}
+
+func evalWhileStatement(ws *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(ws.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return NULL
+		}
+
+		if stop, result := evalLoopBody(ws.Body, env); stop {
+			return result
+		}
+	}
+}
+
+func evalForStatement(fs *ast.ForStatement, env *object.Environment) object.Object {
+	if fs.Init != nil {
+		init := Eval(fs.Init, env)
+		if isError(init) {
+			return init
+		}
+	}
+
+	for {
+		if fs.Condition != nil {
+			condition := Eval(fs.Condition, env)
+			if isError(condition) {
+				return condition
+			}
+			if !isTruthy(condition) {
+				return NULL
+			}
+		}
+
+		if stop, result := evalLoopBody(fs.Body, env); stop {
+			return result
+		}
+
+		if fs.Post != nil {
+			post := Eval(fs.Post, env)
+			if isError(post) {
+				return post
+			}
+		}
+	}
+}
+
+func evalForInStatement(fs *ast.ForInStatement, env *object.Environment) object.Object {
+	iterable := Eval(fs.Iterable, env)
+	if isError(iterable) {
+		return iterable
+	}
+
+	iter, ok := object.NewIterator(iterable)
+	if !ok {
+		return newError("object is not iterable: %s", iterable.Type())
+	}
+
+	for {
+		value, ok := iter.Next()
+		if !ok {
+			return NULL
+		}
+		env.Set(fs.Variable.Value, value)
+
+		if stop, result := evalLoopBody(fs.Body, env); stop {
+			return result
+		}
+	}
+}
+
+// 执行一次循环体，遇到break、return或错误时结束循环，
+// 返回的result是整个循环语句的结果
+func evalLoopBody(body *ast.BlockStatement, env *object.Environment) (bool, object.Object) {
+	result := Eval(body, env)
+	if result == nil {
+		return false, nil
+	}
+
+	switch result.Type() {
+	case object.BREAK_OBJ:
+		return true, NULL
+	case object.RETURN_VALUE_OBJ, object.ERROR_OBJ:
+		return true, result
+	default:
+		return false, nil
+	}
+}
+
 func isTruthy(obj object.Object) bool {
 	switch obj {
 	case NULL:
@@ -194,6 +505,8 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
 	default:
@@ -214,6 +527,19 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	return arrayObject.Elements[idx]
 }
 
+// 按字符索引，结果是只含一个字符的字符串
+func evalStringIndexExpression(str, index object.Object) object.Object {
+	runes := str.(*object.String).Runes()
+	idx := index.(*object.Integer).Value
+	max := int64(len(runes) - 1)
+
+	if idx < 0 || idx > max {
+		return NULL
+	}
+
+	return &object.String{Value: string(runes[idx])}
+}
+
 func evalHashIndexExpression(hash, index object.Object) object.Object {
 	hashObject := hash.(*object.Hash)
 	key, ok := index.(object.Hashable)
@@ -229,12 +555,33 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 	return pair.Value
 }
 
+// hash先按字符串键查找，找不到再查方法；其他类型只查方法
+func evalMemberExpression(obj object.Object, name string) object.Object {
+	hash, isHash := obj.(*object.Hash)
+	if isHash {
+		if pair, ok := hash.Pairs[(&object.String{Value: name}).HashKey()]; ok {
+			return pair.Value
+		}
+	}
+
+	if method, ok := object.GetMethod(obj, name); ok {
+		return method
+	}
+
+	if isHash {
+		return NULL
+	}
+	return newError("unknown method %s for %s", name, obj.Type())
+}
+
 func evalPrefixExpression(operator string, right object.Object) object.Object {
 	switch operator {
 	case "!":
 		return evalBangOperatorExpression(right)
 	case "-":
 		return evalMinusPrefixOperatorExpression(right)
+	case "~":
+		return evalBitNotPrefixOperatorExpression(right)
 	default:
 		return newError("unknown operator: %s%s", operator, right.Type())
 	}
@@ -247,24 +594,37 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 	case FALSE:
 		return TRUE
 	case NULL:
-		return NULL
+		return TRUE
 	default:
 		return FALSE
 	}
 }
 
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: -right.Value}
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
+}
+
+func evalBitNotPrefixOperatorExpression(right object.Object) object.Object {
+	if right.Type() != object.INTEGER_OBJ {
+		return newError("unknown operator: ~%s", right.Type())
+	}
 	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+	return &object.Integer{Value: ^value}
 }
 
 func evalInfixExpression(operator string, left, right object.Object) object.Object {
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(operator, left, right)
+	case isNumber(left) && isNumber(right): // 整数和浮点数混合运算时按浮点数计算
+		return evalFloatInfixExpression(operator, left, right)
 	// case left.Type() == object.BOOLEAN_OBJ || right.Type() == object.BOOLEAN_OBJ:
 	// 	return evalBooleanInfixExpressioin(operator, left, right)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
@@ -292,11 +652,39 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return &object.Integer{Value: leftVal % rightVal}
+	case "&":
+		return &object.Integer{Value: leftVal & rightVal}
+	case "|":
+		return &object.Integer{Value: leftVal | rightVal}
+	case "^":
+		return &object.Integer{Value: leftVal ^ rightVal}
+	case "<<":
+		if rightVal < 0 {
+			return newError("negative shift count: %d", rightVal)
+		}
+		return &object.Integer{Value: leftVal << uint64(rightVal)}
+	case ">>":
+		if rightVal < 0 {
+			return newError("negative shift count: %d", rightVal)
+		}
+		return &object.Integer{Value: leftVal >> uint64(rightVal)}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
@@ -306,14 +694,67 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	}
 }
 
-func evalStringInfixExpression(operator string, left, right object.Object) object.Object {
-	if operator != "+" {
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
+	}
+}
 
+func evalStringInfixExpression(operator string, left, right object.Object) object.Object {
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
-	return &object.String{Value: leftVal + rightVal}
+
+	switch operator {
+	case "+":
+		return &object.String{Value: leftVal + rightVal}
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
 }
 
 func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
@@ -343,6 +784,235 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 	return newError("identifier not found: " + node.Value)
 }
 
+// 赋值只修改已有的绑定，复合赋值x += v按x = x + v计算
+// 按模式拆开val并绑定到env中，成功时返回nil
+func bindPattern(pattern ast.Pattern, val object.Object, env *object.Environment) object.Object {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		env.Set(pattern.Value, val)
+	case *ast.ArrayPattern:
+		array, ok := val.(*object.Array)
+		if !ok {
+			return newError("cannot destructure %s with array pattern", val.Type())
+		}
+		length, numElements := len(array.Elements), len(pattern.Elements)
+		if pattern.Rest != nil && length < numElements {
+			return newError("wrong number of elements to destructure. got=%d, want at least %d", length, numElements)
+		}
+		if pattern.Rest == nil && length != numElements {
+			return newError("wrong number of elements to destructure. got=%d, want=%d", length, numElements)
+		}
+
+		for i, element := range pattern.Elements {
+			if err := bindPattern(element, array.Elements[i], env); err != nil {
+				return err
+			}
+		}
+		if pattern.Rest != nil {
+			rest := make([]object.Object, length-numElements)
+			copy(rest, array.Elements[numElements:])
+			restArray := allocate(&object.Array{Elements: rest}, env)
+			if isError(restArray) {
+				return restArray
+			}
+			env.Set(pattern.Rest.Value, restArray)
+		}
+	case *ast.HashPattern:
+		hash, ok := val.(*object.Hash)
+		if !ok {
+			return newError("cannot destructure %s with hash pattern", val.Type())
+		}
+
+		for i, key := range pattern.Keys {
+			k := &object.String{Value: key.Value}
+			pair, ok := hash.Pairs[k.HashKey()]
+			if !ok {
+				return newError("key not found in hash: %s", k.Inspect())
+			}
+			if err := bindPattern(pattern.Values[i], pair.Value, env); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 依次尝试每个分支，都不匹配时结果为null；分支绑定的名字只在该分支内可见
+func evalMatchExpression(node *ast.MatchExpression, env *object.Environment) object.Object {
+	subject := Eval(node.Subject, env)
+	if isError(subject) {
+		return subject
+	}
+
+	for _, arm := range node.Arms {
+		armEnv := object.NewEnclosedEnvironment(env)
+		if !matchPattern(arm.Pattern, subject, armEnv) {
+			continue
+		}
+		if arm.Guard != nil {
+			guard := Eval(arm.Guard, armEnv)
+			if isError(guard) {
+				return guard
+			}
+			if !isTruthy(guard) {
+				continue
+			}
+		}
+		return Eval(arm.Body, armEnv)
+	}
+
+	return NULL
+}
+
+// 和bindPattern结构相同，但形状不符时返回false而不是报错
+func matchPattern(pattern ast.Pattern, val object.Object, env *object.Environment) bool {
+	switch pattern := pattern.(type) {
+	case *ast.WildcardPattern:
+		return true
+	case *ast.Identifier:
+		env.Set(pattern.Value, val)
+		return true
+	case *ast.LiteralPattern:
+		// 字面量只有负号一种运算，求值不会出错
+		return evalInfixExpression("==", val, Eval(pattern.Value, env)) == TRUE
+	case *ast.ArrayPattern:
+		array, ok := val.(*object.Array)
+		if !ok {
+			return false
+		}
+		length, numElements := len(array.Elements), len(pattern.Elements)
+		if length < numElements || (pattern.Rest == nil && length != numElements) {
+			return false
+		}
+
+		for i, element := range pattern.Elements {
+			if !matchPattern(element, array.Elements[i], env) {
+				return false
+			}
+		}
+		if pattern.Rest != nil {
+			rest := make([]object.Object, length-numElements)
+			copy(rest, array.Elements[numElements:])
+			env.Set(pattern.Rest.Value, &object.Array{Elements: rest})
+		}
+		return true
+	case *ast.HashPattern:
+		hash, ok := val.(*object.Hash)
+		if !ok {
+			return false
+		}
+
+		for i, key := range pattern.Keys {
+			pair, ok := hash.Pairs[(&object.String{Value: key.Value}).HashKey()]
+			if !ok || !matchPattern(pattern.Values[i], pair.Value, env) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object {
+	switch target := node.Target.(type) {
+	case *ast.IndexExpression:
+		return evalIndexAssignExpression(node, target.Left, target.Index, env)
+	case *ast.MemberExpression: // a.b = v 即 a["b"] = v
+		key := &ast.StringLiteral{Token: target.Property.Token, Value: target.Property.Value}
+		return evalIndexAssignExpression(node, target.Object, key, env)
+	}
+
+	name := node.Target.(*ast.Identifier).Value
+
+	current, ok := env.Get(name)
+	if !ok {
+		if _, ok := builtins[name]; ok {
+			return newError("cannot assign to builtin function %s", name)
+		}
+		return newError("identifier not found: " + name)
+	}
+
+	val := Eval(node.Value, env)
+	if isError(val) {
+		return val
+	}
+
+	if node.Operator != "=" {
+		val = evalInfixExpression(strings.TrimSuffix(node.Operator, "="), current, val)
+		if isError(val) {
+			return val
+		}
+	}
+
+	env.Assign(name, val)
+	return val
+}
+
+// a[i] = v，先求a和i，复合赋值时再读出a[i]，最后求v
+func evalIndexAssignExpression(node *ast.AssignExpression, leftNode, indexNode ast.Expression, env *object.Environment) object.Object {
+	left := Eval(leftNode, env)
+	if isError(left) {
+		return left
+	}
+	index := Eval(indexNode, env)
+	if isError(index) {
+		return index
+	}
+
+	var current object.Object
+	if node.Operator != "=" {
+		current = evalIndexExpression(left, index)
+		if isError(current) {
+			return current
+		}
+	}
+
+	val := Eval(node.Value, env)
+	if isError(val) {
+		return val
+	}
+
+	if current != nil {
+		val = evalInfixExpression(strings.TrimSuffix(node.Operator, "="), current, val)
+		if isError(val) {
+			return val
+		}
+	}
+
+	return evalSetIndex(left, index, val, env)
+}
+
+// 数组和hash原地修改，所有引用同一对象的变量都能看到变化；
+// 数组不会因为赋值而变长，追加元素用push
+func evalSetIndex(left, index, val object.Object, env *object.Environment) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			return newError("array index must be INTEGER, got %s", index.Type())
+		}
+		if idx.Value < 0 || idx.Value >= int64(len(left.Elements)) {
+			return newError("index out of range: %d (array length %d)", idx.Value, len(left.Elements))
+		}
+		left.Elements[idx.Value] = val
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+		hashKey := key.HashKey()
+		if _, exists := left.Pairs[hashKey]; !exists {
+			if err := env.Budget().Grow(1); err != nil {
+				return abortError(err)
+			}
+		}
+		left.Pairs[hashKey] = object.HashPair{Key: index, Value: val}
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
+	return val
+}
+
 // 返回多个表达式的值
 func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
 	var result []object.Object
@@ -358,31 +1028,185 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 	return result
 }
 
+// 同evalExpressions，...xs展开成数组中的各个元素
+func evalArguments(exps []ast.Expression, env *object.Environment) []object.Object {
+	var result []object.Object
+
+	for _, e := range exps {
+		spread, ok := e.(*ast.SpreadExpression)
+		if !ok {
+			evaluated := Eval(e, env)
+			if isError(evaluated) {
+				return []object.Object{evaluated}
+			}
+			result = append(result, evaluated)
+			continue
+		}
+
+		evaluated := Eval(spread.Value, env)
+		if isError(evaluated) {
+			return []object.Object{evaluated}
+		}
+		array, ok := evaluated.(*object.Array)
+		if !ok {
+			return []object.Object{newError("spread argument must be ARRAY, got %s", evaluated.Type())}
+		}
+		result = append(result, array.Elements...)
+	}
+
+	return result
+}
+
 func applyFunction(fn object.Object, args []object.Object) object.Object {
 
 	switch fn := fn.(type) {
 	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+		// 尾调用在下面的循环中执行，不加深调用
+		budget := fn.Env.Budget()
+		if !budget.Enter() {
+			return newError("maximum call depth exceeded")
+		}
+		defer budget.Leave()
+
+		for { // 函数体以尾调用结束时，在这里接着调用，不再递归
+			extendedEnv, result := extendFunctionEnv(fn, args)
+			if result != nil {
+				return result
+			}
+			evaluated := evalTail(fn.Body, extendedEnv)
+			if tailCall, ok := evaluated.(*object.TailCall); ok {
+				next, ok := tailCall.Fn.(*object.Function)
+				if !ok {
+					return allocate(applyFunction(tailCall.Fn, tailCall.Args), extendedEnv)
+				}
+				fn, args = next, tailCall.Args
+				continue
+			}
+			return functionResult(evaluated)
+		}
 	case *object.Builtin:
-		if result := fn.Fn(args...); result != nil {
-			return result
+		return nativeResult(fn.Fn(args...))
+	case *object.BoundMethod:
+		return nativeResult(fn.Fn(callFunction, fn.Receiver, args...))
+	default:
+		return newError("not a function: %s", fn.Type())
+	}
+}
+
+// 求值函数体，和Eval相同，但处于尾部位置的调用只求出函数和实参，返回TailCall。
+// 尾部位置和编译器的一样：函数体和if的分支中最后的表达式、return的值
+func evalTail(node ast.Node, env *object.Environment) object.Object {
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		stmts := node.Statements
+		if len(stmts) == 0 {
+			return nil
+		}
+		result := evalBlockStatement(stmts[:len(stmts)-1], env)
+		if result != nil {
+			switch result.Type() {
+			case object.ERROR_OBJ, object.RETURN_VALUE_OBJ, object.BREAK_OBJ, object.CONTINUE_OBJ:
+				return result
+			}
+		}
+		return evalTail(stmts[len(stmts)-1], env)
+	case *ast.ExpressionStatement:
+		return evalTail(node.Expression, env)
+	case *ast.ReturnStatement:
+		val := evalTail(node.ReturnValue, env)
+		if val != nil && (isError(val) || val.Type() == object.TAIL_CALL_OBJ) {
+			return val
+		}
+		return &object.ReturnValue{Value: val}
+	case *ast.IfExpression:
+		condition := Eval(node.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if isTruthy(condition) {
+			return evalTail(node.Consequence, env)
+		} else if node.Alternative != nil {
+			return evalTail(node.Alternative, env)
 		}
 		return NULL
+	case *ast.CallExpression:
+		if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "quote" {
+			return Eval(node, env)
+		}
+		function, short := evalChain(node.Function, env)
+		if short || isError(function) {
+			return function
+		}
+		args := evalArguments(node.Arguments, env)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+		return &object.TailCall{Fn: function, Args: args}
 	default:
-		return newError("not a function: %s", fn.Type())
+		return Eval(node, env)
 	}
 }
 
-func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Environment {
-	env := object.NewEnclosedEnvironment(fn.Env)
+// 提供给内置方法，用来调用用户传入的函数
+func callFunction(fn object.Object, args ...object.Object) object.Object {
+	return applyFunction(fn, args)
+}
+
+// 内置函数和方法返回的nil和布尔值换成解释器的单例，==和isTruthy比较的是指针
+func nativeResult(result object.Object) object.Object {
+	switch result := result.(type) {
+	case nil:
+		return NULL
+	case *object.Boolean:
+		return nativeBoolToBooleanObject(result.Value)
+	default:
+		return result
+	}
+}
+
+// 缺少的参数按顺序在新环境里求默认值，默认值可以引用前面的参数。
+// 参数个数不对或求默认值时出错、遇到return时，返回的result就是这次调用的结果
+func extendFunctionEnv(fn *object.Function, args []object.Object) (env *object.Environment, result object.Object) {
+	minArgs, maxArgs := fn.Arity()
+	if err := object.CheckArity(minArgs, maxArgs, len(args)); err != nil {
+		return nil, newError("%s", err)
+	}
+
+	env = object.NewEnclosedEnvironment(fn.Env)
 
 	for paramIdx, param := range fn.Parameters {
-		env.Set(param.Value, args[paramIdx])
+		if paramIdx < len(args) {
+			env.Set(param.Value, args[paramIdx])
+			continue
+		}
+		val := Eval(fn.Defaults[paramIdx], env)
+		if isError(val) {
+			return nil, functionResult(val)
+		}
+		env.Set(param.Value, val)
 	}
 
-	return env
+	if fn.Rest != nil {
+		rest := []object.Object{}
+		if len(args) > len(fn.Parameters) {
+			rest = append(rest, args[len(fn.Parameters):]...)
+		}
+		restArray := allocate(&object.Array{Elements: rest}, env)
+		if isError(restArray) {
+			return nil, restArray
+		}
+		env.Set(fn.Rest.Value, restArray)
+	}
+
+	return env, nil
+}
+
+// 函数体求值的结果：解开return的值，break和continue不能跳出函数外面的循环
+func functionResult(obj object.Object) object.Object {
+	if obj == BREAK || obj == CONTINUE {
+		return newError("%s outside loop", obj.Inspect())
+	}
+	return unwrapReturnValue(obj)
 }
 
 func unwrapReturnValue(obj object.Object) object.Object {
@@ -1,10 +1,14 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
+	"math"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
 	"testing"
+	"time"
 )
 
 func testEval(input string) object.Object {
@@ -31,6 +35,21 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float. got=%T (%+v)", obj, obj)
+		return false
+	}
+	if result.Value != expected {
+		t.Errorf("object has wrong value. got=%g, want=%g",
+			result.Value, expected)
+		return false
+	}
+
+	return true
+}
+
 func testStringObject(t *testing.T, obj object.Object, expected string) bool {
 	str, ok := obj.(*object.String)
 	if !ok {
@@ -113,6 +132,149 @@ func TestEvalStringExpression(t *testing.T) {
 
 }
 
+func TestInterpolatedStrings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let name = "Monkey"; "hello ${name}"`, "hello Monkey"},
+		{`let age = 41; "you are ${age + 1}"`, "you are 42"},
+		{`"${1.5} ${true} ${null} ${[1, "a"]}"`, "1.5 true null [1, a]"},
+		{`"${"nested ${1 + 1}"}!"`, "nested 2!"},
+		{`let h = {"k": 3}; "${h["k"]}"`, "3"},
+		{`"\${x}"`, "${x}"},
+		{`"${fn(x) { x * 2 }(21)}"`, "42"},
+		{`let s = "a"; for (x in [1, 2]) { s = "${s}${x}"; } s`, "a12"},
+	}
+
+	for _, tt := range tests {
+		testStringObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"2.5", 2.5},
+		{"-2.5", -2.5},
+		{"1.5 + 1.5", 3.0},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2.0},
+		{"7 / 2.0", 3.5},
+		{"1e3 - 1", 999.0},
+		{"1.0 / 0", math.Inf(1)},
+		{"1 + 2", 3},
+		{"0.5 < 1", true},
+		{"2 > 1.5", true},
+		{"1 == 1.0", true},
+		{"1.5 != 1.5", false},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case float64:
+			testFloatObject(t, evaluated, expected)
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		}
+	}
+}
+
+func TestComparisonAndLogicalOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"7.5 % 2", 1.5},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"2 >= 2", true},
+		{"1 >= 2", false},
+		{"1.5 >= 1", true},
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && 2", true},
+		{"1 > 2 || 3 > 2", true},
+		{"false && undefinedVariable", false},
+		{"true || undefinedVariable", true},
+		{"true && undefinedVariable", "identifier not found: undefinedVariable"},
+		{"1 / 0", "division by zero"},
+		{"1 % 0", "division by zero"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			testFloatObject(t, evaluated, expected)
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"12 & 10", 8},
+		{"12 | 10", 14},
+		{"12 ^ 10", 6},
+		{"~0", -1},
+		{"~5", -6},
+		{"1 << 10", 1024},
+		{"1024 >> 3", 128},
+		{"-16 >> 2", -4},
+		{"0xFF & 0b1010 | 1 << 8", 266},
+		{"1 << -1", "negative shift count: -1"},
+		{"8 >> -2", "negative shift count: -2"},
+		{"~1.5", "unknown operator: ~FLOAT"},
+		{"1.5 & 1", "unknown operator: FLOAT & INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -120,6 +282,11 @@ func TestEvalBooleanExpression(t *testing.T) {
 	}{
 		{"true", true},
 		{"false", false},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" == "b"`, false},
+		{`let s = "mon"; s + "key" == "monkey"`, true},
+		{`"1" == 1`, false},
 		{"true == false", false},
 		{"true != false", true},
 		{"false != true", true},
@@ -231,6 +398,118 @@ func TestErrorHandling(t *testing.T) {
 			"-true",
 			"unknown operator: -BOOLEAN",
 		},
+		{
+			"break;",
+			"break outside loop",
+		},
+		{
+			"x = 1",
+			"identifier not found: x",
+		},
+		{
+			"len = 1",
+			"cannot assign to builtin function len",
+		},
+		{
+			"let a = [1]; a[1] = 2",
+			"index out of range: 1 (array length 1)",
+		},
+		{
+			"let a = [1]; a[-1] = 2",
+			"index out of range: -1 (array length 1)",
+		},
+		{
+			"let a = [1]; a[\"x\"] = 2",
+			"array index must be INTEGER, got STRING",
+		},
+		{
+			"let s = \"abc\"; s[0] = \"x\"",
+			"index assignment not supported: STRING",
+		},
+		{
+			"let h = {}; h[[]] = 1",
+			"unusable as hash key: ARRAY",
+		},
+		{
+			`"a ${1 + true} b"`,
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"let [a, b] = [1];",
+			"wrong number of elements to destructure. got=1, want=2",
+		},
+		{
+			"let [a, b, ...c] = [1];",
+			"wrong number of elements to destructure. got=1, want at least 2",
+		},
+		{
+			"let [a] = 1;",
+			"cannot destructure INTEGER with array pattern",
+		},
+		{
+			`let {a} = [1];`,
+			"cannot destructure ARRAY with hash pattern",
+		},
+		{
+			`let {a, b} = {"a": 1};`,
+			"key not found in hash: b",
+		},
+		{
+			"fn(a, b) { a }(1);",
+			"wrong number of arguments: want=2, got=1",
+		},
+		{
+			"fn(a, b = 1) { a }(1, 2, 3);",
+			"wrong number of arguments: want 1 to 2, got=3",
+		},
+		{
+			"fn(a, ...b) { a }();",
+			"wrong number of arguments: want at least 1, got=0",
+		},
+		{
+			"fn(a = x) { a }();",
+			"identifier not found: x",
+		},
+		{
+			"len(...5);",
+			"spread argument must be ARRAY, got INTEGER",
+		},
+		{
+			"match (1) { n if n + true => 1 }",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"5.upper()",
+			"unknown method upper for INTEGER",
+		},
+		{
+			"let h = {\"a\": null}; h?.a.b",
+			"unknown method b for NULL",
+		},
+		{
+			`"abc".split(1)`,
+			"argument to `split` must be STRING, got INTEGER",
+		},
+		{
+			`"abc".upper(1)`,
+			"wrong number of arguments to `upper`. got=1, want=0",
+		},
+		{
+			"[1, 0].map(fn(x) { 1 / x })",
+			"division by zero",
+		},
+		{
+			"let x = 1; x += true",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"while (true) { fn() { continue; }(); }",
+			"continue outside loop",
+		},
+		{
+			"for (x in 5) { x }",
+			"object is not iterable: INTEGER",
+		},
 		{
 			"true + false;",
 			"unknown operator: BOOLEAN + BOOLEAN",
@@ -267,6 +546,22 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "Monkey"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			`throw "boom"`,
+			"uncaught exception: boom",
+		},
+		{
+			`try { throw 1 } catch (e) { throw e + 1 }`,
+			"uncaught exception: 2",
+		},
+		{
+			`try { throw [1] } finally { 2 }`,
+			"uncaught exception: [1]",
+		},
+		{
+			`try { 1 / 0 } finally { 2 }`,
+			"division by zero",
+		},
 	}
 
 	for _, tt := range tests {
@@ -286,6 +581,202 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"while (false) { 1 }", nil},
+		{"while (true) { break; } 5", 5},
+		{"for (;;) { break; } 5", 5},
+		{"for (let i = 0; false;) { 1 } i", 0},
+		{"let f = fn(arr) { for (x in arr) { if (x > 2) { return x; } } -1 }; f([1, 2, 3, 4])", 3},
+		{"let f = fn(arr) { for (x in arr) { if (x > 9) { return x; } } -1 }; f([1, 2, 3, 4])", -1},
+		{"let f = fn(arr) { for (x in arr) { if (x % 2 == 1) { continue; } return x; } }; f([1, 3, 4, 5])", 4},
+		{"for (x in [1, 2, 3]) { if (x == 2) { break; } } x", 2},
+		{"for (c in \"héllo\") { } c", "o"},
+		{"for (k in {\"b\": 2, \"a\": 1}) { break; } k", "a"},
+		{"let f = fn(a) { for (x in a) { for (y in a) { if (x * y == 6) { return x * 10 + y; } } } }; f([1, 2, 3])", 23},
+		{"let f = fn(arr) { let g = fn() { for (x in arr) { if (x > 1) { return x; } } }; g() }; f([1, 2, 3])", 2},
+		{"fn() { for (x in [1]) { return 7; } }()", 7},
+		// 表达式中间的break、continue和return直接结束表达式的求值
+		{"for (x in [1, 2, 3]) { let y = [x, if (x == 2) { break } else { 0 }]; } x", 2},
+		{"for (x in [1, 2, 3]) { let y = [if (x > 1) { continue } else { 0 }]; } y[0]", 0},
+		{"let f = fn() { for (x in [1, 2, 3]) { let y = 1 + if (x == 2) { return x } else { 0 }; } }; f()", 2},
+		{"5; for (x in [1, 2]) { x }", nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			testStringObject(t, evaluated, expected)
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = 1; a = 2; a", 2},
+		{"let a = 1; a = 2", 2},
+		{"let a = 1; let b = 0; a = b = 3; a + b", 6},
+		{"let a = 10; a += 5; a -= 3; a *= 2; a /= 4; a", 6},
+		{"let a = 1.5; a *= 2; a", 3.0},
+		{"let s = \"a\"; s += \"b\"; s", "ab"},
+		{"let i = 0; let sum = 0; while (i < 100) { i += 1; sum += i; } sum", 5050},
+		{"let sum = 0; for (let i = 0; i < 10; i += 1) { if (i % 2 == 0) { continue; } sum += i; } sum", 25},
+		{"let n = 0; for (x in [1, 2, 3]) { n = n * 10 + x; } n", 123},
+		// 闭包修改外层的变量
+		{"let c = 0; let inc = fn() { c += 1 }; inc(); inc(); c", 2},
+		{"let counter = fn() { let n = 0; fn() { n += 1; n } }; let c = counter(); c(); c(); c()", 3},
+		{"let f = fn() { let x = 1; let g = fn() { let h = fn() { x = 5 }; h() }; g(); x }; f()", 5},
+		{"let f = fn() { f = 1; f }; f()", 1},
+		{"let f = fn() { fn() { f = 1 } }; f()(); f", 1},
+		{"let g = fn() { let f = fn() { f = 2; f }; f() + f }; g()", 4},
+		{"let f = fn(n) { if (n == 0) { f = 5; return 0; } f(n - 1) }; f(3); f", 5},
+		{`let s = ""; let a = fn() { s += "a"; 1 }; let b = fn() { s += "b"; 2 }; a() <= b(); b() < a(); s`, "abba"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			testFloatObject(t, evaluated, expected)
+		case string:
+			testStringObject(t, evaluated, expected)
+		}
+	}
+}
+
+func TestIndexAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = [1, 2, 3]; a[0] = 10; a[0] + a[2]", 13},
+		{"let a = [1, 2, 3]; a[1] = 5", 5},
+		{"let a = [1, 2, 3]; a[2] *= 4; a[2]", 12},
+		{"let h = {}; h[\"k\"] = 1; h[\"k\"] += 2; h[\"k\"]", 3},
+		{"let h = {1: 1}; h[1.0] = 2; h[1]", 2},
+		{"let m = [[1, 2], [3, 4]]; m[1][0] = 9; m[1][0]", 9},
+		// 数组和hash按引用共享
+		{"let a = [1]; let b = a; b[0] = 2; a[0]", 2},
+		{"let set = fn(arr) { arr[0] = 7 }; let a = [0]; set(a); a[0]", 7},
+		{"let a = [1]; let b = push(a, 2); b[0] = 5; a[0]", 1},
+		{"let i = 0; let a = [0, 0]; a[i] = i = 1; [a[0], i][0]", 1},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), int64(tt.expected.(int)))
+	}
+}
+
+func TestMemberExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let cfg = {"server": {"port": 8080}}; cfg.server.port`, 8080},
+		{`let h = {"a": 1}; h.b`, nil},
+		{`let h = {"len": 5}; h.len`, 5},
+		{`let h = {"a": 1, "b": 2}; h.len()`, 2},
+		{`let h = {}; h.x = 1; h.x += 2; h["x"]`, 3},
+		{`"abc".upper()`, "ABC"},
+		{`"ÀB".lower()`, "àb"},
+		{`"  hi ".trim()`, "hi"},
+		{`"héllo".len()`, 5},
+		{`"a,b,c".split(",").join("-")`, "a-b-c"},
+		{`"hello".contains("ell")`, true},
+		{`"hello".contains("xyz") == false`, true},
+		{`"aaa".replace("a", "b")`, "bbb"},
+		{`[1, 2, 3].len()`, 3},
+		{`[1, 2, 3].map(fn(x) { x * 2 }).join(",")`, "2,4,6"},
+		{`[1, 2, 3, 4].filter(fn(x) { x % 2 == 0 }).join(",")`, "2,4"},
+		{`[1, 2, 3].reduce(fn(acc, x) { acc + x }, 10)`, 16},
+		{`let a = [1]; let b = a.push(2); a.len() * 10 + b.len()`, 12},
+		{`[1, 2].map(len).join(",")`, "ERROR"},
+		{`{"b": 2, "a": 1}.keys().join(",")`, "a,b"},
+		{`{"b": 2, "a": 1}.values().join(",")`, "1,2"},
+		{`{"a": 1}.has("a")`, true},
+		{`{"a": 1}.has("b")`, false},
+		{`let up = "abc".upper; up()`, "ABC"},
+		{`let n = 10; [1, 2].map(fn(x) { x + n }).reduce(fn(a, b) { a + b }, 0)`, 23},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			if expected == "ERROR" {
+				if _, ok := evaluated.(*object.Error); !ok {
+					t.Errorf("expected error for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				}
+				continue
+			}
+			testStringObject(t, evaluated, expected)
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestNullAndOptionalChaining(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"null", nil},
+		{"null == null", true},
+		{"1 == null", false},
+		{"!null", true},
+		{"if (null) { 1 } else { 2 }", 2},
+		{"first([]) == null", true},
+		{"null ?? 5", 5},
+		{"0 ?? 5", 0},
+		{"false ?? 5", false},
+		{"null ?? null ?? 3", 3},
+		{"let h = {}; h[\"missing\"] ?? \"default\"", "default"},
+		{"let calls = 0; let f = fn() { calls += 1; 1 }; 2 ?? f(); calls", 0},
+		{"let h = null; h?.a", nil},
+		{"let h = null; h?.a.b.c", nil},
+		{"let h = null; h?[0][1]", nil},
+		{"let h = null; h?.upper()", nil},
+		{"let h = {\"a\": {\"b\": 7}}; h?.a?.b", 7},
+		{"let h = {\"a\": null}; h.a?.b ?? 9", 9},
+		{"let s = \"abc\"; s?.upper()", "ABC"},
+		{"let a = [1, 2]; a?[1]", 2},
+		{"let calls = 0; let f = fn() { calls += 1; 0 }; let a = null; a?[f()]; calls", 0},
+		{"let h = null; h?.a ?? \"none\"", "none"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			testStringObject(t, evaluated, expected)
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -302,6 +793,265 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let [a, b] = [1, 2]; a * 10 + b", 12},
+		{"let [a, ...rest] = [1, 2, 3]; a + len(rest) * 10 + rest[1]", 24},
+		{"let [...rest] = []; len(rest)", 0},
+		{"let pair = [3, 4]; let [x, y] = pair; pair[0] = 9; x * y", 12},
+		{"let [a, b] = [1, 2]; let [a, b] = [b, a]; a * 10 + b", 21},
+		{`let cfg = {"name": 1, "port": 8080}; let {name, port: p} = cfg; name + p`, 8081},
+		{`let {} = {"a": 1}; 5`, 5},
+		{"fn(p) { let [a, b] = p; let f = fn() { a + b }; f() }([5, 6])", 11},
+		{"let total = 0; for (p in [[1, 2], [3, 4]]) { let [a, b] = p; total += a * b; } total", 14},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let f = fn(a, b = 10) { a + b }; f(1)", 11},
+		{"let f = fn(a, b = 10) { a + b }; f(1, 2)", 3},
+		{"let f = fn(a = 1, b = a * 2) { a + b }; f()", 3},
+		{"let f = fn(a = 1, b = a * 2) { a + b }; f(5)", 15},
+		{"let f = fn(a, b = 0, c = 0) { a * 100 + b * 10 + c }; f(1, 2)", 120},
+		{"let f = fn(a, b = fn() { a }) { b() }; f(7)", 7},
+		{"let n = 0; let f = fn(a = n) { a }; n = 4; f()", 4},
+		{"let f = fn(a = if (true) { return 5 }) { 1 }; f()", 5},
+		{"let f = fn(a = (f = 3)) { a }; f(); f", 3},
+		{"let f = fn(...xs) { len(xs) }; f()", 0},
+		{"let f = fn(a, ...xs) { a + len(xs) * 10 }; f(1, 2, 3)", 21},
+		{"let f = fn(a, b = 2, ...xs) { a + b + len(xs) }; f(1)", 3},
+		{"let f = fn(a, b = 2, ...xs) { a + b + len(xs) }; f(1, 5, 0, 0)", 8},
+		{"let sum = fn(...xs) { xs.reduce(fn(a, b) { a + b }, 0) }; sum(1, 2, 3, 4)", 10},
+		{"let add = fn(a, b, c) { a + b * 10 + c * 100 }; let xs = [2, 3]; add(1, ...xs)", 321},
+		{"let add = fn(a, b, c) { a + b * 10 + c * 100 }; add(...[1], 2, ...[3])", 321},
+		{"let f = fn(...xs) { len(xs) }; f(...[], ...[1, 2], 3, ...[])", 3},
+		{"len(...[[1, 2, 3]])", 3},
+		{"[1, 2].reduce(...[fn(a, b) { a + b }, 10])", 13},
+		{"let f = fn(...xs) { xs[0] = 9; 0 }; let a = [1]; f(...a); a[0]", 1},
+		{"let fact = fn(n, acc = 1) { if (n < 2) { acc } else { fact(n - 1, acc * n) } }; fact(5)", 120},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestMatchExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`match (1) { 1 => "one", _ => "other" }`, "one"},
+		{`match (5) { 1 => "one", _ => "other" }`, "other"},
+		{`match (-2) { -2 => "minus two", _ => "other" }`, "minus two"},
+		{`match (2.0) { 2 => "two", _ => "other" }`, "two"},
+		{`match ("b") { "a" => "A", "b" => "B" }`, "B"},
+		{`match (null) { false => "false", null => "null" }`, "null"},
+		{`match (true) { 1 => "one", true => "true" }`, "true"},
+		{`match ("1") { 1 => "int", _ => "other" }`, "other"},
+		{`match (7) { n => "n=${n}" }`, "n=7"},
+		{`match ([1, 2]) { [a] => "one", [a, b] => "${a},${b}", _ => "many" }`, "1,2"},
+		{`match ([1, 2, 3]) { [a, ...rest] => "${a}|${rest}" }`, "1|[2, 3]"},
+		{`match ([1, [2, 3]]) { [x, [y, z]] => "${x + y + z}" }`, "6"},
+		{`match ([1, [2]]) { [x, [y, z]] => "three", [x, [y]] => "two" }`, "two"},
+		{`match ([0, 9]) { [1, x] => "one", [0, x] => "zero ${x}" }`, "zero 9"},
+		{`match ([1, 2]) { [_, _, _] => "three", [_, _] => "two" }`, "two"},
+		{`match (5) { [a] => "array", {a} => "hash", _ => "other" }`, "other"},
+		{`let op = {"type": "add", "lhs": 1, "rhs": 2}; match (op) { {type: "sub", lhs, rhs} => "${lhs - rhs}", {type: "add", lhs, rhs} => "${lhs + rhs}" }`, "3"},
+		{`match ({"a": 1}) { {a, b} => "both", {a: x} => "x=${x}" }`, "x=1"},
+		{`match ({"p": [1, 2]}) { {p: [a, b]} => "${a * b}" }`, "2"},
+		{`match (3) { n if n > 5 => "big", n if n > 1 => "medium", _ => "small" }`, "medium"},
+		{`match ([4, 2]) { [a, b] if a < b => "asc", [a, b] => "desc" }`, "desc"},
+		{`let a = "outer"; match (1) { a if false => a, _ => a }`, "outer"},
+		{`let a = "outer"; let r = match ([1]) { [a] => a }; "${r} ${a}"`, "1 outer"},
+		{`let f = match (2) { n => fn() { n * 10 } }; "${f()}"`, "20"},
+		{`let describe = fn(x) { match (x) { 0 => "zero", [h, ...t] => "list", _ => "thing" } }; describe(0) + describe([1]) + describe("s")`, "zerolistthing"},
+		{`let s = ""; for (x in [1, "a", [2]]) { s += match (x) { 1 => "I", "a" => "A", [n] => "L${n}" }; } s`, "IAL2"},
+		{`"${match (9) { 1 => "one" }}"`, "null"},
+		// 循环中每次匹配都是新的绑定，闭包各自捕获自己的那一个
+		{`let f = fn() { let fs = []; for (x in [1, 2, 3]) { fs = push(fs, match (x) { v => fn() { v } }) } [fs[0](), fs[1](), fs[2]()] }; "${f()}"`, "[1, 2, 3]"},
+		{`let f = fn() { let fs = []; for (x in [1, 2, 3]) { fs = push(fs, match ([x]) { [v] => fn() { v } }) } [fs[0](), fs[1](), fs[2]()] }; "${f()}"`, "[1, 2, 3]"},
+		{`let fs = []; for (x in [[1], [2]]) { fs = push(fs, match (x) { [a] => fn() { a } }) }; "${[fs[0](), fs[1]()]}"`, "[1, 2]"},
+		{`let fs = []; for (x in [1, 2]) { fs = push(fs, match (x) { v => fn() { fn() { v } } }) }; "${[fs[0]()(), fs[1]()()]}"`, "[1, 2]"},
+		{`let fs = []; for (x in [[1, 2], [3]]) { fs = push(fs, match (x) { [_, ...r] => fn() { r } }) }; "${[fs[0](), fs[1]()]}"`, "[[2], []]"},
+		// 闭包和外面对同一次绑定的赋值互相可见
+		{`let r = match (1) { v => [fn() { v }, v = 2] }; "${r[0]()}"`, "2"},
+		{`match (1) { v => fn() { let g = fn() { v }; v = 2; "${g()}" }() }`, "2"},
+		{`let r = match (1) { v => fn() { let g = fn() { v = 3 }; g(); v }() }; "${r}"`, "3"},
+	}
+
+	for _, tt := range tests {
+		testStringObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestTryCatchFinally(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`try { 1 / 0 } catch (e) { e.message }`, "division by zero"},
+		{`try { throw "boom" } catch (e) { "caught ${e}" }`, "caught boom"},
+		{`"${1 + try { throw 5 } catch (e) { e * 2 }}"`, "11"},
+		{`try { "ok" } catch (e) { "caught" }`, "ok"},
+		{`try { throw 1 } catch { "no param" }`, "no param"},
+		{`try { len(1) } catch (e) { e.message }`, "argument to `len` not supported, got INTEGER"},
+		{`try { [1, 0].map(fn(x) { 1 / x }) } catch (e) { e.message }`, "division by zero"},
+		{`let check = fn(x) { if (x < 0) { throw {"code": 400} } x }; let f = fn(x) { check(x) + 1 }; try { f(-1) } catch (e) { "code ${e.code}" }`, "code 400"},
+		{`let s = ""; let r = try { s += "t"; "value" } finally { s += "f" }; "${r} ${s}"`, "value tf"},
+		{`let s = ""; try { try { throw "x" } finally { s += "inner " } } catch (e) { s += "outer ${e}" }; s`, "inner outer x"},
+		{`let s = ""; let f = fn() { try { return "r" } finally { s += "f" } }; "${f()} ${s}"`, "r f"},
+		{`let f = fn() { try { return "try" } finally { return "finally" } }; f()`, "finally"},
+		{`let s = ""; for (x in [1, 2, 3]) { try { if (x == 2) { break } s += "${x}" } finally { s += "f" } }; s`, "1ff"},
+		{`let s = ""; let i = 0; while (i < 3) { i += 1; try { if (i == 2) { continue } s += "${i}" } finally { s += "." } }; s`, "1..3."},
+		{`let f = fn() { try { throw 1 } catch (e) { throw e + 1 } }; try { f() } catch (e) { "${e}" }`, "2"},
+		{`let e = "outer"; try { throw "inner" } catch (e) { e }; e`, "outer"},
+		{`let total = 0; for (x in [1, 0, 2]) { total += try { 10 / x } catch { 100 } }; "${total}"`, "115"},
+		{`let f = fn(n) { if (n == 0) { throw "bottom" } try { f(n - 1) } finally { 0 } }; try { f(3) } catch (e) { e }`, "bottom"},
+		// 循环中每次catch都是新的绑定
+		{`let f = fn() { let fs = []; for (x in [1, 2, 3]) { fs = push(fs, try { throw x } catch (e) { fn() { e } }) } [fs[0](), fs[1](), fs[2]()] }; "${f()}"`, "[1, 2, 3]"},
+		{`let fs = []; for (x in [1, 2]) { fs = push(fs, try { throw x } catch (e) { fn() { e } }) }; "${[fs[0](), fs[1]()]}"`, "[1, 2]"},
+		// 表达式中间的break先运行finally
+		{`let s = ""; for (x in [1, 2, 3]) { let y = [x, try { if (x == 2) { break } 0 } finally { s += "f" }]; s += "${x}" }; s`, "f1f"},
+	}
+
+	for _, tt := range tests {
+		testStringObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input    string
+		limits   Limits
+		ctx      context.Context
+		expected error // 期望的中止原因，nil表示正常求值完
+	}{
+		{"1 + 2", Limits{MaxInstructions: 100}, context.Background(), nil},
+		{"let f = fn() { f() }; f()", Limits{MaxInstructions: 10000}, context.Background(), object.ErrInstructionBudget},
+		{"try { while (true) {} } catch (e) { 1 } finally { 2 }", Limits{MaxInstructions: 1000}, context.Background(), object.ErrInstructionBudget},
+		{"[1].map(fn(x) { while (true) {} })", Limits{MaxInstructions: 1000}, context.Background(), object.ErrInstructionBudget},
+		{"let a = []; while (true) { a = push(a, 1) }", Limits{MaxAllocations: 10000}, context.Background(), object.ErrAllocationBudget},
+		{`let s = ""; while (true) { s = s + "abc" }`, Limits{MaxAllocations: 10000}, context.Background(), object.ErrAllocationBudget},
+		// hash中插入新键、剩余参数和解构剩余元素创建的数组也计入分配量
+		{"let h = {}; let i = 0; while (i < 200000) { h[i] = i; i += 1 }", Limits{MaxAllocations: 1000}, context.Background(), object.ErrAllocationBudget},
+		{`let h = {"a": 0}; let i = 0; while (i < 2000) { h["a"] = i; i += 1 }`, Limits{MaxAllocations: 1000}, context.Background(), nil},
+		{"let f = fn(...xs) { 0 }; while (true) { f(1, 2, 3) }", Limits{MaxAllocations: 1000}, context.Background(), object.ErrAllocationBudget},
+		{"let a = [1, 2, 3]; while (true) { let [x, ...r] = a; }", Limits{MaxAllocations: 1000}, context.Background(), object.ErrAllocationBudget},
+		{"[1, 2, 3]", Limits{MaxAllocations: 4}, context.Background(), nil},
+		{"[1, 2, 3]", Limits{MaxAllocations: 3}, context.Background(), object.ErrAllocationBudget},
+		{"1", Limits{}, cancelled, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		_, err := EvalContext(tt.ctx, program, object.NewEnvironment(), tt.limits)
+		if tt.expected == nil {
+			if err != nil {
+				t.Errorf("eval error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		var abort *object.AbortError
+		if !errors.As(err, &abort) || !errors.Is(err, tt.expected) {
+			t.Errorf("wrong error for %q. want abort with %q, got=%T (%v)", tt.input, tt.expected, err, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	program := parser.New(lexer.New("let f = fn() { f() }; f()")).ParseProgram()
+	_, err := EvalContext(ctx, program, object.NewEnvironment(), Limits{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded. got=%T (%v)", err, err)
+	}
+
+	// 调用深度有限制，深递归返回错误而不是耗尽Go的栈；尾调用不加深调用
+	depthTests := []struct {
+		input    string
+		limits   Limits
+		expected interface{} // string表示期望的错误消息
+	}{
+		{"let f = fn(n) { 1 + f(n + 1) }; f(0)", Limits{}, "maximum call depth exceeded"},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(1000)", Limits{}, 1000},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(10)", Limits{MaxDepth: 10}, "maximum call depth exceeded"},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(9)", Limits{MaxDepth: 10}, 9},
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(100000)", Limits{MaxDepth: 10}, 0},
+		{"let f = fn(n) { [n].map(fn(x) { f(x) }) }; f(0)", Limits{}, "maximum call depth exceeded"},
+	}
+	for _, tt := range depthTests {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		result, err := EvalContext(ctx, program, object.NewEnvironment(), tt.limits)
+		cancel()
+		if err != nil {
+			t.Fatalf("unexpected abort for %q: %s", tt.input, err)
+		}
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, result, int64(expected))
+		case string:
+			errObj, ok := result.(*object.Error)
+			if !ok || errObj.Message != expected {
+				t.Errorf("wrong result for %q. want error %q, got=%T (%+v)", tt.input, expected, result, result)
+			}
+		}
+	}
+
+	// 脚本自身的错误作为结果返回
+	program = parser.New(lexer.New("1 / 0")).ParseProgram()
+	result, err := EvalContext(context.Background(), program, object.NewEnvironment(), Limits{MaxInstructions: 100})
+	if err != nil {
+		t.Fatalf("unexpected abort: %s", err)
+	}
+	if errObj, ok := result.(*object.Error); !ok || errObj.Message != "division by zero" {
+		t.Fatalf("expected division by zero error. got=%T (%+v)", result, result)
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + 1) } }; loop(100000, 0)`, 100000},
+		{`let loop = fn(n, acc) { if (n == 0) { return acc; } return loop(n - 1, acc + n); }; loop(100000, 0)`, 5000050000},
+		{`let isOdd = null; let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1) } }; isOdd = fn(n) { if (n == 0) { false } else { isEven(n - 1) } }; isEven(100001)`, false},
+		{`let count = fn(n, acc = 0) { if (n == 0) { acc } else { count(n - 1, acc + 1) } }; count(50000)`, 50000},
+		{`let last = fn(first, ...rest) { if (len(rest) == 0) { first } else { last(...rest) } }; last(1, 2, 3)`, 3},
+		{`let size = fn(x) { len(x) }; size([1, 2, 3])`, 3},
+		{`let f = fn(n) { if (n == 0) { return "done"; } try { return f(n - 1); } catch (e) { "caught" } }; f(100)`, "done"},
+		{`let adders = []; let make = fn(n) { if (n == 0) { adders } else { adders = push(adders, fn(x) { x + n }); make(n - 1) } }; make(3)[0](10)`, 13},
+		{`let apply = fn(f, x) { f(x) }; apply(fn(x) { x * 2 }, 21)`, 42},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			testStringObject(t, evaluated, expected)
+		}
+	}
+}
+
 func TestFunctionObject(t *testing.T) {
 	input := "fn(x) { x + 2; };"
 
@@ -353,12 +1103,17 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
+		{`len("é")`, 1},
+		{`len("日本語")`, 3},
+		{`len(bytes("日本語"))`, 9},
 		{`len([1,2,3])`, 3},
 		{`len([3+2,5+1,1*2,999])`, 4},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
 		{`first([1,2,3])`, 1},
 		{`last([1,2,3])`, 3},
+		{`bytes("é")[0]`, 195},
+		{`bytes(1)`, "argument to `bytes` must be STRING, got INTEGER"},
 	}
 
 	for _, tt := range tests {
@@ -460,6 +1215,29 @@ func TestArrayIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestStringIndexExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`"abc"[0]`, "a"},
+		{`"héllo"[1]`, "é"},
+		{`let s = "日本語"; s[len(s) - 1]`, "語"},
+		{`"abc"[3]`, nil},
+		{`"abc"[-1]`, nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		str, ok := tt.expected.(string)
+		if ok {
+			testStringObject(t, evaluated, str)
+		} else {
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
 func TestStringHashKey(t *testing.T) {
 	hello1 := &object.String{Value: "Hello World"}
 	hello2 := &object.String{Value: "Hello World"}
@@ -479,6 +1257,27 @@ func TestStringHashKey(t *testing.T) {
 	}
 }
 
+func TestFloatHashKey(t *testing.T) {
+	one := &object.Integer{Value: 1}
+	oneFloat := &object.Float{Value: 1.0}
+	half1 := &object.Float{Value: 0.5}
+	half2 := &object.Float{Value: 0.5}
+	quarter := &object.Float{Value: 0.25}
+
+	if one.HashKey() != oneFloat.HashKey() {
+		t.Errorf("1 and 1.0 have different hash keys")
+	}
+	if half1.HashKey() != half2.HashKey() {
+		t.Errorf("floats with same content have different hash keys")
+	}
+	if half1.HashKey() == quarter.HashKey() {
+		t.Errorf("floats with different content have same hash keys")
+	}
+
+	evaluated := testEval(`{1.0: "one", 0.5: "half"}[1]`)
+	testStringObject(t, evaluated, "one")
+}
+
 func TestHashLiterals(t *testing.T) {
 	input := `let two = "two";
     {
@@ -0,0 +1,98 @@
+package evaluator
+
+import (
+	"monkey/ast"
+	"monkey/object"
+	"monkey/token"
+)
+
+// quote(x)不对x求值，而是返回它的ast；x中的unquote(y)先求值，再把结果转回ast替换进去
+func quote(node ast.Node, env *object.Environment) object.Object {
+	node, err := evalUnquoteCalls(node, env)
+	if err != nil {
+		return err
+	}
+	return &object.Quote{Node: node}
+}
+
+// unquote求值时出错或遇到break、continue、return，err是要传出去的结果
+func evalUnquoteCalls(quoted ast.Node, env *object.Environment) (node ast.Node, err object.Object) {
+
+	node = ast.Modify(quoted, func(node ast.Node) ast.Node {
+		if err != nil || !isUnquoteCall(node) {
+			return node
+		}
+
+		call := node.(*ast.CallExpression)
+		if len(call.Arguments) != 1 {
+			err = newError("wrong number of arguments to `unquote`. got=%d, want=1", len(call.Arguments))
+			return node
+		}
+
+		unquoted := Eval(call.Arguments[0], env)
+		if isError(unquoted) {
+			err = unquoted
+			return node
+		}
+		converted := convertObjectToASTNode(unquoted, call)
+		if converted == nil {
+			err = newError("cannot unquote %s", unquoted.Type())
+			return node
+		}
+		return converted
+	})
+
+	return node, err
+}
+
+func isUnquoteCall(node ast.Node) bool {
+	call, ok := node.(*ast.CallExpression)
+	if !ok {
+		return false
+	}
+	ident, ok := call.Function.(*ast.Identifier)
+	return ok && ident.Value == "unquote"
+}
+
+// 生成的节点使用unquote调用的位置；不能表示成字面量的对象返回nil
+func convertObjectToASTNode(obj object.Object, at ast.Node) ast.Expression {
+	tok := token.Token{Literal: obj.Inspect(), Pos: at.Pos(), End: at.End()}
+
+	switch obj := obj.(type) {
+	case *object.Integer:
+		tok.Type = token.INT
+		return &ast.IntegerLiteral{Token: tok, Value: obj.Value}
+	case *object.Float:
+		tok.Type = token.FLOAT
+		return &ast.FloatLiteral{Token: tok, Value: obj.Value}
+	case *object.String:
+		tok.Type = token.STRING
+		return &ast.StringLiteral{Token: tok, Value: obj.Value}
+	case *object.Boolean:
+		if obj.Value {
+			tok.Type = token.TRUE
+		} else {
+			tok.Type = token.FALSE
+		}
+		return &ast.Boolean{Token: tok, Value: obj.Value}
+	case *object.Null:
+		tok.Type = token.NULL
+		return &ast.NullLiteral{Token: tok}
+	case *object.Array:
+		tok.Type, tok.Literal = token.LBRACKET, "["
+		array := &ast.ArrayLiteral{Token: tok, EndToken: tok}
+		for _, el := range obj.Elements {
+			converted := convertObjectToASTNode(el, at)
+			if converted == nil {
+				return nil
+			}
+			array.Elements = append(array.Elements, converted)
+		}
+		return array
+	case *object.Quote:
+		expression, _ := obj.Node.(ast.Expression)
+		return expression
+	default:
+		return nil
+	}
+}
@@ -1,41 +1,132 @@
 package lexer
 
-import "monkey/token"
+import (
+	"fmt"
+	"monkey/diagnostic"
+	"monkey/token"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 type Lexer struct {
 	input        string
 	position     int
-	readPosition int
-	ch           byte
+	readPosition int  // 下一个字符的字节偏移
+	ch           rune // 当前字符，按UTF-8解码
+
+	filename string
+	line     int // l.ch所在行
+	column   int // l.ch所在列
+
+	errors []diagnostic.Diagnostic
+
+	interps []interpolation // 正在读取的字符串插值，最内层在最后
+}
+
+// 字符串中的${...}，遇到与之匹配的'}'时回到字符串中继续读取
+type interpolation struct {
+	start  token.Position // 所在字符串的开头，用于报告字符串没有闭合
+	braces int            // 插值表达式内部未闭合的'{'个数
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewWithFilename("", input)
+}
+
+// 词法单元的位置信息会带上文件名
+func NewWithFilename(filename, input string) *Lexer {
+	l := &Lexer{input: input, filename: filename, line: 1}
 	l.readChar()
 	return l
 }
 
 func (l *Lexer) readChar() {
+	if l.readPosition > len(l.input) { // 已经停在末尾，位置不再前进
+		return
+	}
+
+	// 离开换行符时换行，"\r\n"只算一次
+	if l.ch == '\n' || (l.ch == '\r' && l.peekChar() != '\n') {
+		l.line++
+		l.column = 0
+	}
+
+	size := 1
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
-		l.ch = l.input[l.readPosition]
+		l.ch, size = utf8.DecodeRuneInString(l.input[l.readPosition:])
 	}
 	l.position = l.readPosition
-	l.readPosition += 1
+	l.readPosition += size
+	l.column++ // 列号按字符计算
 }
 
-func (l *Lexer) peekChar() byte {
+// 当前字符l.ch的位置
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{
+		Filename: l.filename,
+		Offset:   l.position,
+		Line:     l.line,
+		Column:   l.column,
+	}
+}
+
+// 词法分析中遇到的错误
+func (l *Lexer) Errors() []diagnostic.Diagnostic {
+	return l.errors
+}
+
+// 记录一条范围为[pos, end)的错误
+func (l *Lexer) errorAt(pos, end token.Position, code diagnostic.Code, format string, a ...interface{}) {
+	l.errors = append(l.errors, diagnostic.Diagnostic{
+		Severity: diagnostic.Error,
+		Code:     code,
+		Message:  fmt.Sprintf(format, a...),
+		Pos:      pos,
+		End:      end,
+	})
+}
+
+// 紧跟在l.ch后面的位置
+func (l *Lexer) nextPosition() token.Position {
+	pos := l.currentPosition()
+	if l.position < len(l.input) {
+		pos.Offset = l.readPosition
+		pos.Column++
+	}
+	return pos
+}
+
+// 是否已经读完输入
+func (l *Lexer) atEOF() bool {
+	return l.position >= len(l.input)
+}
+
+func (l *Lexer) peekChar() rune {
 	if l.readPosition >= len(l.input) {
 		return 0
 	}
-	return l.input[l.readPosition]
+	ch, _ := utf8.DecodeRuneInString(l.input[l.readPosition:])
+	return ch
 }
 
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
+	comments := l.skipWhitespaceAndComments()
+
+	start := l.currentPosition()
+	tok := l.readToken()
+	tok.Pos = start
+	tok.End = l.currentPosition()
+	tok.Comments = comments
 
-	l.skipWhitespace()
+	return tok
+}
+
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
 
 	switch l.ch {
 	case '=':
@@ -43,18 +134,24 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = makeTwoCharToken(token.EQ, ch, l.ch)
+		} else if l.peekChar() == '>' {
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.ARROW, ch, l.ch)
 		} else {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
 
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		tok = l.readCompoundAssign(token.PLUS, token.PLUS_ASSIGN)
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		tok = l.readCompoundAssign(token.MINUS, token.MINUS_ASSIGN)
 	case '/':
-		tok = newToken(token.SLASH, l.ch)
+		tok = l.readCompoundAssign(token.SLASH, token.SLASH_ASSIGN)
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		tok = l.readCompoundAssign(token.ASTERISK, token.ASTERISK_ASSIGN)
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
 	case '!':
 		if l.peekChar() == '=' {
 			ch := l.ch
@@ -64,18 +161,96 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.BANG, l.ch)
 		}
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '=' {
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.LT_EQ, ch, l.ch)
+		} else if l.peekChar() == '<' {
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.SHL, ch, l.ch)
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '=' {
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.GT_EQ, ch, l.ch)
+		} else if l.peekChar() == '>' {
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.SHR, ch, l.ch)
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
+	case '&':
+		if l.peekChar() == '&' {
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.AND, ch, l.ch)
+		} else {
+			tok = newToken(token.AMPERSAND, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.OR, ch, l.ch)
+		} else {
+			tok = newToken(token.PIPE, l.ch)
+		}
+	case '^':
+		tok = newToken(token.CARET, l.ch)
+	case '~':
+		tok = newToken(token.TILDE, l.ch)
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case ':':
 		tok = newToken(token.COLON, l.ch)
+	case '.':
+		if strings.HasPrefix(l.input[l.position:], "...") {
+			l.readChar()
+			l.readChar()
+			tok = token.Token{Type: token.ELLIPSIS, Literal: "..."}
+		} else {
+			tok = newToken(token.DOT, l.ch)
+		}
+	case '?':
+		switch l.peekChar() {
+		case '?':
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.NULLISH, ch, l.ch)
+		case '.':
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.OPT_DOT, ch, l.ch)
+		case '[':
+			ch := l.ch
+			l.readChar()
+			tok = makeTwoCharToken(token.OPT_LBRACKET, ch, l.ch)
+		default:
+			l.illegalCharacter()
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '{':
+		if n := len(l.interps); n > 0 {
+			l.interps[n-1].braces++
+		}
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
+		if n := len(l.interps); n > 0 {
+			if l.interps[n-1].braces == 0 { // 插值结束，继续读字符串剩下的部分
+				start := l.interps[n-1].start
+				l.interps = l.interps[:n-1]
+				tok = l.readStringPart(start, false)
+				break
+			}
+			l.interps[n-1].braces--
+		}
 		tok = newToken(token.RBRACE, l.ch)
 	case '[':
 		tok = newToken(token.LBRACKET, l.ch)
@@ -86,9 +261,15 @@ func (l *Lexer) NextToken() token.Token {
 	case ')':
 		tok = newToken(token.RPAREN, l.ch)
 	case '"':
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok = l.readString()
+	case '`':
+		tok = l.readRawString()
 	case 0:
+		if !l.atEOF() {
+			l.illegalCharacter()
+			tok = newToken(token.ILLEGAL, l.ch)
+			break
+		}
 		tok.Literal = ""
 		tok.Type = token.EOF
 	default:
@@ -100,10 +281,10 @@ func (l *Lexer) NextToken() token.Token {
 			// 提前运行了 l.readChar() 所以在这儿提前退出
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Literal = l.readNumber()
-			tok.Type = token.INT
+			tok.Literal, tok.Type = l.readNumber()
 			return tok
 		} else {
+			l.illegalCharacter()
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
@@ -113,11 +294,21 @@ func (l *Lexer) NextToken() token.Token {
 
 }
 
-func newToken(tokenType token.TokenType, ch byte) token.Token {
+func newToken(tokenType token.TokenType, ch rune) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
 
-func makeTwoCharToken(tokenType token.TokenType, ch1 byte, ch2 byte) token.Token {
+// 运算符后面紧跟'='时是复合赋值，如"+="
+func (l *Lexer) readCompoundAssign(op, assign token.TokenType) token.Token {
+	if l.peekChar() == '=' {
+		ch := l.ch
+		l.readChar()
+		return makeTwoCharToken(assign, ch, l.ch)
+	}
+	return newToken(op, l.ch)
+}
+
+func makeTwoCharToken(tokenType token.TokenType, ch1 rune, ch2 rune) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch1) + string(ch2)}
 }
 
@@ -127,11 +318,68 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
-func isLetter(ch byte) bool {
-	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
+// 跳过空白和注释，返回跳过的注释
+func (l *Lexer) skipWhitespaceAndComments() []token.Comment {
+	var comments []token.Comment
+
+	for {
+		l.skipWhitespace()
+
+		if l.ch != '/' || (l.peekChar() != '/' && l.peekChar() != '*') {
+			return comments
+		}
+
+		start := l.currentPosition()
+		if l.peekChar() == '/' {
+			l.skipLineComment()
+		} else {
+			l.skipBlockComment(start)
+		}
+		comments = append(comments, token.Comment{
+			Text: l.input[start.Offset:l.position],
+			Pos:  start,
+			End:  l.currentPosition(),
+		})
+	}
+}
+
+// 行注释到行尾为止，不包括换行符
+func (l *Lexer) skipLineComment() {
+	for l.ch != '\n' && l.ch != '\r' && l.ch != 0 {
+		l.readChar()
+	}
+}
+
+// 块注释可以嵌套，"/* a /* b */ c */"是一整个注释
+func (l *Lexer) skipBlockComment(start token.Position) {
+	depth := 0
+	for {
+		switch {
+		case l.atEOF():
+			l.errorAt(start, l.currentPosition(), diagnostic.UnterminatedComment, "unterminated block comment")
+			return
+		case l.ch == '/' && l.peekChar() == '*':
+			depth++
+			l.readChar()
+		case l.ch == '*' && l.peekChar() == '/':
+			depth--
+			l.readChar()
+			if depth == 0 {
+				l.readChar()
+				return
+			}
+		}
+		l.readChar()
+	}
 }
 
-func isDigit(ch byte) bool {
+// 除了ASCII字母外也接受Unicode字母
+func isLetter(ch rune) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' ||
+		ch >= utf8.RuneSelf && unicode.IsLetter(ch)
+}
+
+func isDigit(ch rune) bool {
 	return '0' <= ch && ch <= '9'
 }
 
@@ -143,21 +391,308 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[position:l.position]
 }
 
-func (l *Lexer) readNumber() string {
-	position := l.position
-	for isDigit(l.ch) {
+// 读取整数或浮点数，浮点数形如 3.14、1e9、2.5E-3，
+// 整数还可以写成 0xFF、0o17、0b1010，数字之间可以用'_'分隔。
+// 格式错误时返回ILLEGAL
+func (l *Lexer) readNumber() (string, token.TokenType) {
+	start := l.currentPosition()
+
+	if l.ch == '0' && isBasePrefix(l.peekChar()) {
+		return l.readPrefixedInteger(start)
+	}
+
+	tokType := token.TokenType(token.INT)
+
+	l.readDigits()
+
+	// 小数点后必须紧跟数字，"1."不是浮点数
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokType = token.FLOAT
 		l.readChar()
+		l.readDigits()
 	}
-	return l.input[position:l.position]
+
+	if (l.ch == 'e' || l.ch == 'E') && l.exponentFollows() {
+		tokType = token.FLOAT
+		l.readChar()
+		if l.ch == '+' || l.ch == '-' {
+			l.readChar()
+		}
+		l.readDigits()
+	}
+
+	literal := l.input[start.Offset:l.position]
+
+	switch {
+	case !validUnderscores(literal, isDigit):
+		l.errorAt(start, l.currentPosition(), diagnostic.MalformedNumber,
+			"'_' must separate successive digits in %q", literal)
+		return literal, token.ILLEGAL
+	case tokType == token.INT && len(literal) > 1 && literal[0] == '0':
+		l.errorAt(start, l.currentPosition(), diagnostic.MalformedNumber,
+			"invalid integer literal %q: leading zeros are not allowed, use the 0o prefix for octal", literal)
+		return literal, token.ILLEGAL
+	}
+
+	return literal, tokType
+}
+
+// 0x、0o、0b开头的整数，字母和数字一起读进来，方便报告非法的数字
+func (l *Lexer) readPrefixedInteger(start token.Position) (string, token.TokenType) {
+	l.readChar()
+	prefix := l.ch
+	l.readChar()
+
+	for isLetter(l.ch) || isDigit(l.ch) {
+		l.readChar()
+	}
+
+	literal := l.input[start.Offset:l.position]
+	digits := literal[2:]
+
+	var name string
+	var isValidDigit func(rune) bool
+	switch prefix {
+	case 'x', 'X':
+		name, isValidDigit = "hexadecimal", isHexDigit
+	case 'o', 'O':
+		name, isValidDigit = "octal", func(ch rune) bool { return '0' <= ch && ch <= '7' }
+	default:
+		name, isValidDigit = "binary", func(ch rune) bool { return ch == '0' || ch == '1' }
+	}
+
+	if strings.Trim(digits, "_") == "" {
+		l.errorAt(start, l.currentPosition(), diagnostic.MalformedNumber,
+			"%s literal %q has no digits", name, literal)
+		return literal, token.ILLEGAL
+	}
+
+	for _, ch := range digits {
+		if ch != '_' && !isValidDigit(ch) {
+			l.errorAt(start, l.currentPosition(), diagnostic.MalformedNumber,
+				"invalid digit %q in %s literal %q", ch, name, literal)
+			return literal, token.ILLEGAL
+		}
+	}
+
+	// 前缀后面紧跟的'_'是允许的，比如0x_FF
+	if !validUnderscores("0"+digits, isHexDigit) {
+		l.errorAt(start, l.currentPosition(), diagnostic.MalformedNumber,
+			"'_' must separate successive digits in %q", literal)
+		return literal, token.ILLEGAL
+	}
+
+	return literal, token.INT
+}
+
+func (l *Lexer) readDigits() {
+	for isDigit(l.ch) || l.ch == '_' {
+		l.readChar()
+	}
+}
+
+func isBasePrefix(ch rune) bool {
+	switch ch {
+	case 'x', 'X', 'o', 'O', 'b', 'B':
+		return true
+	}
+	return false
+}
+
+// 每个'_'的两边都必须是数字
+func validUnderscores(literal string, isDigit func(rune) bool) bool {
+	for i := 0; i < len(literal); i++ {
+		if literal[i] != '_' {
+			continue
+		}
+		if i == 0 || i == len(literal)-1 ||
+			!isDigit(rune(literal[i-1])) || !isDigit(rune(literal[i+1])) {
+			return false
+		}
+	}
+	return true
+}
+
+// l.ch为'e'时，后面是否为指数部分（可带符号的数字）
+func (l *Lexer) exponentFollows() bool {
+	rest := l.input[l.readPosition:]
+	if len(rest) > 0 && (rest[0] == '+' || rest[0] == '-') {
+		rest = rest[1:]
+	}
+	return len(rest) > 0 && '0' <= rest[0] && rest[0] <= '9'
+}
+
+func (l *Lexer) illegalCharacter() {
+	if l.ch == utf8.RuneError && l.readPosition-l.position == 1 {
+		l.errorAt(l.currentPosition(), l.nextPosition(), diagnostic.IllegalCharacter,
+			"invalid UTF-8 encoding")
+		return
+	}
+	l.errorAt(l.currentPosition(), l.nextPosition(), diagnostic.IllegalCharacter,
+		"unexpected character %q", l.ch)
+}
+
+// 读取双引号字符串并处理转义，结束时l.ch停在右引号上。
+// 字符串没有闭合或含有非法转义时返回ILLEGAL，Literal为原始源码
+func (l *Lexer) readString() token.Token {
+	return l.readStringPart(l.currentPosition(), true)
+}
+
+// 读取字符串的一段，进入时l.ch为开头的'"'或结束插值的'}'。
+// 没有插值的字符串是一个STRING；遇到"${"时返回这一段，l.ch停在'{'上
+func (l *Lexer) readStringPart(start token.Position, first bool) token.Token {
+	partStart := l.position
+	var out strings.Builder
+	valid := true
+
+	for {
+		l.readChar()
+
+		switch {
+		case l.atEOF():
+			l.errorAt(start, l.currentPosition(), diagnostic.UnterminatedString, "unterminated string literal")
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[partStart:]}
+		case l.ch == '"':
+			if !valid {
+				return token.Token{Type: token.ILLEGAL, Literal: l.input[partStart:l.readPosition]}
+			}
+			if first {
+				return token.Token{Type: token.STRING, Literal: out.String()}
+			}
+			return token.Token{Type: token.INTERP_END, Literal: out.String()}
+		case l.ch == '$' && l.peekChar() == '{':
+			l.readChar()
+			l.interps = append(l.interps, interpolation{start: start})
+			if !valid {
+				return token.Token{Type: token.ILLEGAL, Literal: l.input[partStart:l.readPosition]}
+			}
+			if first {
+				return token.Token{Type: token.INTERP_START, Literal: out.String()}
+			}
+			return token.Token{Type: token.INTERP_MID, Literal: out.String()}
+		case l.ch == '\\':
+			if !l.readEscape(&out) {
+				valid = false
+			}
+		default:
+			out.WriteString(l.input[l.position:l.readPosition]) // 原样保留，非法的UTF-8字节也不做替换
+		}
+	}
+}
+
+// 读取一个转义序列，进入时l.ch为'\\'，返回时l.ch停在转义序列的最后一个字符上
+func (l *Lexer) readEscape(out *strings.Builder) bool {
+	start := l.currentPosition()
+
+	switch l.peekChar() {
+	case 'n':
+		out.WriteByte('\n')
+	case 't':
+		out.WriteByte('\t')
+	case 'r':
+		out.WriteByte('\r')
+	case '0':
+		out.WriteByte(0)
+	case '\\':
+		out.WriteByte('\\')
+	case '"':
+		out.WriteByte('"')
+	case '$': // "\${"不是插值
+		out.WriteByte('$')
+	case 'x':
+		l.readChar()
+		return l.readHexEscape(start, out)
+	case 'u':
+		l.readChar()
+		return l.readUnicodeEscape(start, out)
+	default:
+		if l.readPosition >= len(l.input) {
+			return false // 交给readString报告字符串没有闭合
+		}
+		l.readChar()
+		l.errorAt(start, l.nextPosition(), diagnostic.InvalidEscape, "unknown escape sequence \\%c", l.ch)
+		return false
+	}
+
+	l.readChar()
+	return true
+}
+
+// \xNN，只允许00到7F，更大的字符用\u{...}
+func (l *Lexer) readHexEscape(start token.Position, out *strings.Builder) bool {
+	digits := ""
+	for len(digits) < 2 && isHexDigit(l.peekChar()) {
+		l.readChar()
+		digits += string(l.ch)
+	}
+
+	if len(digits) < 2 {
+		l.errorAt(start, l.nextPosition(), diagnostic.InvalidEscape,
+			"invalid escape sequence \\x%s: expected two hex digits", digits)
+		return false
+	}
+
+	value, _ := strconv.ParseUint(digits, 16, 8)
+	if value > 0x7F {
+		l.errorAt(start, l.nextPosition(), diagnostic.InvalidEscape,
+			"invalid escape sequence \\x%s: value must be at most \\x7F, use \\u{%s} instead", digits, digits)
+		return false
+	}
+
+	out.WriteByte(byte(value))
+	return true
 }
 
-func (l *Lexer) readString() string {
+// \u{XXXX}，花括号中为1到6位十六进制数
+func (l *Lexer) readUnicodeEscape(start token.Position, out *strings.Builder) bool {
+	if l.peekChar() != '{' {
+		l.errorAt(start, l.nextPosition(), diagnostic.InvalidEscape,
+			"invalid escape sequence \\u: expected '{'")
+		return false
+	}
+	l.readChar()
+
+	digits := ""
+	for isHexDigit(l.peekChar()) {
+		l.readChar()
+		digits += string(l.ch)
+	}
+
+	if l.peekChar() != '}' || len(digits) == 0 || len(digits) > 6 {
+		l.errorAt(start, l.nextPosition(), diagnostic.InvalidEscape,
+			"invalid escape sequence \\u{%s: expected 1 to 6 hex digits followed by '}'", digits)
+		return false
+	}
+	l.readChar()
+
+	value, _ := strconv.ParseUint(digits, 16, 32)
+	if !utf8.ValidRune(rune(value)) {
+		l.errorAt(start, l.nextPosition(), diagnostic.InvalidEscape,
+			"invalid escape sequence \\u{%s}: not a valid Unicode code point", digits)
+		return false
+	}
+
+	out.WriteRune(rune(value))
+	return true
+}
+
+// 反引号中的原始字符串，不处理任何转义
+func (l *Lexer) readRawString() token.Token {
+	start := l.currentPosition()
 	position := l.position + 1
+
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+		if l.atEOF() {
+			l.errorAt(start, l.currentPosition(), diagnostic.UnterminatedString, "unterminated raw string literal")
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[start.Offset:]}
+		}
+		if l.ch == '`' {
+			return token.Token{Type: token.STRING, Literal: l.input[position:l.position]}
 		}
 	}
-	return l.input[position:l.position]
+}
+
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
 }
@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"monkey/diagnostic"
 	"monkey/token"
 	"testing"
 )
@@ -13,7 +14,7 @@ func TestNextToken(t *testing.T) {
 	};
 
 	let result = add(five, ten);
-	!-/*5;
+	!-/ *5;
 	5 < 10 > 5;
 
 	if (5 < 10) {
@@ -28,6 +29,14 @@ func TestNextToken(t *testing.T) {
 	"foo bar"
 	[1, 2];
 	{"foo": "bar"}
+	a <= b >= c % 2;
+	x && y || z;
+	a & b | c ^ ~d << 1 >> 2;
+	while for in break continue
+	x += 1 -= 2 *= 3 /= 4
+	null ?? a?.b?[0]
+	[a, ...b]
+	match (x) { _ => 1 }
 	 `
 
 	tests := []struct {
@@ -120,6 +129,70 @@ func TestNextToken(t *testing.T) {
 		{token.COLON, ":"},
 		{token.STRING, "bar"},
 		{token.RBRACE, "}"},
+		{token.IDENT, "a"},
+		{token.LT_EQ, "<="},
+		{token.IDENT, "b"},
+		{token.GT_EQ, ">="},
+		{token.IDENT, "c"},
+		{token.PERCENT, "%"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.AND, "&&"},
+		{token.IDENT, "y"},
+		{token.OR, "||"},
+		{token.IDENT, "z"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.AMPERSAND, "&"},
+		{token.IDENT, "b"},
+		{token.PIPE, "|"},
+		{token.IDENT, "c"},
+		{token.CARET, "^"},
+		{token.TILDE, "~"},
+		{token.IDENT, "d"},
+		{token.SHL, "<<"},
+		{token.INT, "1"},
+		{token.SHR, ">>"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.WHILE, "while"},
+		{token.FOR, "for"},
+		{token.IN, "in"},
+		{token.BREAK, "break"},
+		{token.CONTINUE, "continue"},
+		{token.IDENT, "x"},
+		{token.PLUS_ASSIGN, "+="},
+		{token.INT, "1"},
+		{token.MINUS_ASSIGN, "-="},
+		{token.INT, "2"},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.INT, "3"},
+		{token.SLASH_ASSIGN, "/="},
+		{token.INT, "4"},
+		{token.NULL, "null"},
+		{token.NULLISH, "??"},
+		{token.IDENT, "a"},
+		{token.OPT_DOT, "?."},
+		{token.IDENT, "b"},
+		{token.OPT_LBRACKET, "?["},
+		{token.INT, "0"},
+		{token.RBRACKET, "]"},
+		{token.LBRACKET, "["},
+		{token.IDENT, "a"},
+		{token.COMMA, ","},
+		{token.ELLIPSIS, "..."},
+		{token.IDENT, "b"},
+		{token.RBRACKET, "]"},
+		{token.MATCH, "match"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.IDENT, "_"},
+		{token.ARROW, "=>"},
+		{token.INT, "1"},
+		{token.RBRACE, "}"},
 		{token.EOF, ""},
 	}
 
@@ -140,3 +213,399 @@ func TestNextToken(t *testing.T) {
 	}
 
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := "let x = 5;\r\nx +\n  \"ab\""
+
+	tests := []struct {
+		expectedType token.TokenType
+		line, column int
+		offset       int
+		endColumn    int
+	}{
+		{token.LET, 1, 1, 0, 4},
+		{token.IDENT, 1, 5, 4, 6},
+		{token.ASSIGN, 1, 7, 6, 8},
+		{token.INT, 1, 9, 8, 10},
+		{token.SEMICOLON, 1, 10, 9, 11},
+		{token.IDENT, 2, 1, 12, 2},
+		{token.PLUS, 2, 3, 14, 4},
+		{token.STRING, 3, 3, 18, 7},
+		{token.EOF, 3, 7, 22, 7},
+	}
+
+	l := NewWithFilename("main.mk", input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Pos.Filename != "main.mk" {
+			t.Fatalf("tests[%d] - filename wrong. got=%q", i, tok.Pos.Filename)
+		}
+		if tok.Pos.Line != tt.line || tok.Pos.Column != tt.column {
+			t.Fatalf("tests[%d] - position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.line, tt.column, tok.Pos.Line, tok.Pos.Column)
+		}
+		if tok.Pos.Offset != tt.offset {
+			t.Fatalf("tests[%d] - offset wrong. expected=%d, got=%d",
+				i, tt.offset, tok.Pos.Offset)
+		}
+		if tok.End.Column != tt.endColumn {
+			t.Fatalf("tests[%d] - end column wrong. expected=%d, got=%d",
+				i, tt.endColumn, tok.End.Column)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// 开头的注释
+let x = 1; // 行尾注释
+/* 块注释 /* 可以嵌套 */ 仍在注释中 */ x / 2;
+/**/x`
+
+	tests := []struct {
+		expectedType     token.TokenType
+		expectedLiteral  string
+		expectedComments []string
+	}{
+		{token.LET, "let", []string{"// 开头的注释"}},
+		{token.IDENT, "x", nil},
+		{token.ASSIGN, "=", nil},
+		{token.INT, "1", nil},
+		{token.SEMICOLON, ";", nil},
+		{token.IDENT, "x", []string{"// 行尾注释", "/* 块注释 /* 可以嵌套 */ 仍在注释中 */"}},
+		{token.SLASH, "/", nil},
+		{token.INT, "2", nil},
+		{token.SEMICOLON, ";", nil},
+		{token.IDENT, "x", []string{"/**/"}},
+		{token.EOF, "", nil},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+		if len(tok.Comments) != len(tt.expectedComments) {
+			t.Fatalf("tests[%d] - wrong number of comments. expected=%d, got=%d",
+				i, len(tt.expectedComments), len(tok.Comments))
+		}
+		for j, want := range tt.expectedComments {
+			c := tok.Comments[j]
+			if c.Text != want {
+				t.Errorf("tests[%d] - comments[%d] wrong. expected=%q, got=%q", i, j, want, c.Text)
+			}
+			if input[c.Pos.Offset:c.End.Offset] != want {
+				t.Errorf("tests[%d] - comments[%d] span wrong. got=%q",
+					i, j, input[c.Pos.Offset:c.End.Offset])
+			}
+		}
+	}
+
+	if len(l.Errors()) != 0 {
+		t.Errorf("unexpected lexer errors: %v", l.Errors())
+	}
+}
+
+func TestUnterminatedBlockComment(t *testing.T) {
+	l := New("let x = 1;\n/* a /* b */ c")
+
+	var tok token.Token
+	for tok.Type != token.EOF {
+		tok = l.NextToken()
+	}
+
+	errors := l.Errors()
+	if len(errors) != 1 {
+		t.Fatalf("wrong number of errors. want=1, got=%d", len(errors))
+	}
+	if errors[0].Message != "unterminated block comment" {
+		t.Errorf("wrong message. got=%q", errors[0].Message)
+	}
+	if errors[0].Pos.Line != 2 || errors[0].Pos.Column != 1 {
+		t.Errorf("wrong position. want=2:1, got=%s", errors[0].Pos)
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"a\"b"`, `a"b`},
+		{`"\n\t\r\\"`, "\n\t\r\\"},
+		{`"a\0b"`, "a\x00b"},
+		{`"\x41\x7f"`, "A\x7f"},
+		{`"\u{e9}\u{1F600}"`, "é😀"},
+		{"`a\\n\"b`", `a\n"b`},
+		{"`line1\nline2`", "line1\nline2"},
+	}
+
+	for i, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+
+		if tok.Type != token.STRING {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q (%v)",
+				i, token.STRING, tok.Type, l.Errors())
+		}
+		if tok.Literal != tt.expected {
+			t.Errorf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expected, tok.Literal)
+		}
+		if next := l.NextToken(); next.Type != token.EOF {
+			t.Errorf("tests[%d] - expected EOF after string, got=%q", i, next.Type)
+		}
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+		column          int
+		endColumn       int
+	}{
+		{`x = "abc`, "unterminated string literal", 5, 9},
+		{"x = `abc", "unterminated raw string literal", 5, 9},
+		{`x = "a\qb"`, `unknown escape sequence \q`, 7, 9},
+		{`x = "\x4"`, `invalid escape sequence \x4: expected two hex digits`, 6, 9},
+		{`x = "\xff"`, `invalid escape sequence \xff: value must be at most \x7F, use \u{ff} instead`, 6, 10},
+		{`x = "\uq"`, `invalid escape sequence \u: expected '{'`, 6, 8},
+		{`x = "\u{}"`, `invalid escape sequence \u{: expected 1 to 6 hex digits followed by '}'`, 6, 9},
+		{`x = "\u{D800}"`, `invalid escape sequence \u{D800}: not a valid Unicode code point`, 6, 14},
+		{`x = @`, `unexpected character '@'`, 5, 6},
+	}
+
+	for i, tt := range tests {
+		l := New(tt.input)
+		l.NextToken()
+		l.NextToken()
+		tok := l.NextToken()
+
+		if tok.Type != token.ILLEGAL {
+			t.Errorf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, token.ILLEGAL, tok.Type)
+		}
+		if next := l.NextToken(); next.Type != token.EOF {
+			t.Errorf("tests[%d] - expected EOF after bad string, got=%q", i, next.Type)
+		}
+
+		errors := l.Errors()
+		if len(errors) != 1 {
+			t.Fatalf("tests[%d] - wrong number of errors. want=1, got=%d: %v", i, len(errors), errors)
+		}
+		if errors[0].Message != tt.expectedMessage {
+			t.Errorf("tests[%d] - wrong message. want=%q, got=%q", i, tt.expectedMessage, errors[0].Message)
+		}
+		if errors[0].Pos.Column != tt.column || errors[0].End.Column != tt.endColumn {
+			t.Errorf("tests[%d] - wrong span. want=%d-%d, got=%d-%d",
+				i, tt.column, tt.endColumn, errors[0].Pos.Column, errors[0].End.Column)
+		}
+	}
+}
+
+func TestStringInterpolation(t *testing.T) {
+	input := `"a ${x} b ${ {"k": "${y}"}["k"] } c" "\${x}" "${z}"`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INTERP_START, "a "},
+		{token.IDENT, "x"},
+		{token.INTERP_MID, " b "},
+		{token.LBRACE, "{"},
+		{token.STRING, "k"},
+		{token.COLON, ":"},
+		{token.INTERP_START, ""},
+		{token.IDENT, "y"},
+		{token.INTERP_END, ""},
+		{token.RBRACE, "}"},
+		{token.LBRACKET, "["},
+		{token.STRING, "k"},
+		{token.RBRACKET, "]"},
+		{token.INTERP_END, " c"},
+		{token.STRING, "${x}"},
+		{token.INTERP_START, ""},
+		{token.IDENT, "z"},
+		{token.INTERP_END, ""},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+
+	if len(l.Errors()) != 0 {
+		t.Errorf("unexpected lexer errors: %v", l.Errors())
+	}
+
+	l = New(`"a ${x} b`)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+	}
+	errors := l.Errors()
+	if len(errors) != 1 || errors[0].Code != diagnostic.UnterminatedString || errors[0].Pos.Column != 1 {
+		t.Errorf("expected unterminated string at column 1. got=%v", errors)
+	}
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	input := "let 名字 = \"héllo\"; café + π"
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		column          int
+	}{
+		{token.LET, "let", 1},
+		{token.IDENT, "名字", 5},
+		{token.ASSIGN, "=", 8},
+		{token.STRING, "héllo", 10},
+		{token.SEMICOLON, ";", 17},
+		{token.IDENT, "café", 19},
+		{token.PLUS, "+", 24},
+		{token.IDENT, "π", 26},
+		{token.EOF, "", 27},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Pos.Column != tt.column {
+			t.Fatalf("tests[%d] - column wrong. expected=%d, got=%d",
+				i, tt.column, tok.Pos.Column)
+		}
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	input := "5 3.14 0.5 1e9 2.5E-3 7e+2 1. x.5 3e"
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INT, "5"},
+		{token.FLOAT, "3.14"},
+		{token.FLOAT, "0.5"},
+		{token.FLOAT, "1e9"},
+		{token.FLOAT, "2.5E-3"},
+		{token.FLOAT, "7e+2"},
+		{token.INT, "1"},
+		{token.DOT, "."},
+		{token.IDENT, "x"},
+		{token.DOT, "."},
+		{token.INT, "5"},
+		{token.INT, "3"},
+		{token.IDENT, "e"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestIntegerLiterals(t *testing.T) {
+	input := "0 0xff 0XFF 0o17 0b1010 1_000_000 0x_dead_beef 1_000.5 0"
+
+	expected := []string{"0", "0xff", "0XFF", "0o17", "0b1010", "1_000_000", "0x_dead_beef", "1_000.5", "0"}
+
+	l := New(input)
+
+	for i, want := range expected {
+		tok := l.NextToken()
+
+		if tok.Type != token.INT && tok.Type != token.FLOAT {
+			t.Fatalf("tests[%d] - tokentype wrong. got=%q (%v)", i, tok.Type, l.Errors())
+		}
+		if tok.Literal != want {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, want, tok.Literal)
+		}
+	}
+
+	if tok := l.NextToken(); tok.Type != token.EOF {
+		t.Fatalf("expected EOF, got=%q", tok.Type)
+	}
+}
+
+func TestMalformedNumbers(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"0x", `hexadecimal literal "0x" has no digits`},
+		{"0b_", `binary literal "0b_" has no digits`},
+		{"0xfg", `invalid digit 'g' in hexadecimal literal "0xfg"`},
+		{"0o78", `invalid digit '8' in octal literal "0o78"`},
+		{"0b102", `invalid digit '2' in binary literal "0b102"`},
+		{"1__000", `'_' must separate successive digits in "1__000"`},
+		{"1000_", `'_' must separate successive digits in "1000_"`},
+		{"0x1_", `'_' must separate successive digits in "0x1_"`},
+		{"1_.5", `'_' must separate successive digits in "1_.5"`},
+		{"012", `invalid integer literal "012": leading zeros are not allowed, use the 0o prefix for octal`},
+	}
+
+	for i, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+
+		if tok.Type != token.ILLEGAL {
+			t.Errorf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, token.ILLEGAL, tok.Type)
+		}
+
+		errors := l.Errors()
+		if len(errors) != 1 {
+			t.Fatalf("tests[%d] - wrong number of errors. want=1, got=%d: %v", i, len(errors), errors)
+		}
+		if errors[0].Message != tt.expectedMessage {
+			t.Errorf("tests[%d] - wrong message. want=%q, got=%q", i, tt.expectedMessage, errors[0].Message)
+		}
+		if errors[0].Pos.Column != 1 || errors[0].End.Offset != tok.End.Offset {
+			t.Errorf("tests[%d] - wrong span. got=%s-%s", i, errors[0].Pos, errors[0].End)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package object
+
+import (
+	"context"
+	"errors"
+)
+
+// 运行多少步检查一次ctx是否已经取消
+const cancelCheckInterval = 1024
+
+var (
+	ErrInstructionBudget = errors.New("instruction budget exceeded")
+	ErrAllocationBudget  = errors.New("allocation budget exceeded")
+)
+
+// 超出预算或ctx被取消时中止运行的错误。脚本中的try捕获不到它，
+// 调用方可以用errors.As和脚本自身的错误区分，再用errors.Is判断原因：
+// ErrInstructionBudget、ErrAllocationBudget，或者ctx.Err()
+type AbortError struct {
+	Err error
+}
+
+func (e *AbortError) Error() string { return "execution aborted: " + e.Err.Error() }
+func (e *AbortError) Unwrap() error { return e.Err }
+
+// 一次运行的执行预算，虚拟机和解释器共用。
+// 虚拟机每条指令、解释器每个节点算一步；分配量见allocationSize。
+// 调用深度只有解释器使用，虚拟机由帧数限制。上限为0表示不限制
+type Budget struct {
+	ctx            context.Context
+	maxSteps       int
+	maxAllocations int
+	maxDepth       int
+
+	steps       int
+	allocations int
+	depth       int
+}
+
+// 没有任何限制且ctx不会被取消时返回nil，nil的Budget什么也不检查
+func NewBudget(ctx context.Context, maxSteps, maxAllocations, maxDepth int) *Budget {
+	if ctx.Done() == nil && maxSteps <= 0 && maxAllocations <= 0 && maxDepth <= 0 {
+		return nil
+	}
+	return &Budget{ctx: ctx, maxSteps: maxSteps, maxAllocations: maxAllocations, maxDepth: maxDepth}
+}
+
+// 进入一层函数调用，超出最大调用深度时返回false
+func (b *Budget) Enter() bool {
+	if b == nil {
+		return true
+	}
+	if b.maxDepth > 0 && b.depth >= b.maxDepth {
+		return false
+	}
+	b.depth++
+	return true
+}
+
+// 离开Enter进入的一层函数调用
+func (b *Budget) Leave() {
+	if b != nil {
+		b.depth--
+	}
+}
+
+// 记一步，超出步数或ctx已经取消时返回AbortError
+func (b *Budget) Step() error {
+	if b == nil {
+		return nil
+	}
+	b.steps++
+	if b.maxSteps > 0 && b.steps > b.maxSteps {
+		return &AbortError{Err: ErrInstructionBudget}
+	}
+	if b.steps%cancelCheckInterval == 0 {
+		if err := b.ctx.Err(); err != nil {
+			return &AbortError{Err: err}
+		}
+	}
+	return nil
+}
+
+// 记下新创建的值，超出分配量时返回AbortError
+func (b *Budget) Allocate(obj Object) error {
+	return b.Grow(allocationSize(obj))
+}
+
+// 已有的值原地增长了n，如hash中插入新的键，和新创建的值一样计入分配量
+func (b *Budget) Grow(n int) error {
+	if b == nil || b.maxAllocations <= 0 {
+		return nil
+	}
+	b.allocations += n
+	if b.allocations > b.maxAllocations {
+		return &AbortError{Err: ErrAllocationBudget}
+	}
+	return nil
+}
+
+// 数组按元素个数、hash按键值对个数、字符串按字节数计算，其他值算1
+func allocationSize(obj Object) int {
+	switch obj := obj.(type) {
+	case *Array:
+		return 1 + len(obj.Elements)
+	case *Hash:
+		return 1 + len(obj.Pairs)
+	case *String:
+		return 1 + len(obj.Value)
+	default:
+		return 1
+	}
+}
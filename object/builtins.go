@@ -17,7 +17,7 @@ var Builtins = []struct {
 				case *Array:
 					return &Integer{Value: int64(len(arg.Elements))}
 				case *String:
-					return &Integer{Value: int64(len(arg.Value))}
+					return &Integer{Value: int64(arg.Len())}
 				default:
 					return newError("argument to `len` not supported, got %s", args[0].Type())
 				}
@@ -121,6 +121,28 @@ var Builtins = []struct {
 			},
 		},
 	},
+	{
+		"bytes",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				if args[0].Type() != STRING_OBJ {
+					return newError("argument to `bytes` must be STRING, got %s", args[0].Type())
+				}
+
+				// 字符串的UTF-8编码，每个字节是一个整数
+				str := args[0].(*String).Value
+				elements := make([]Object, len(str))
+				for i := 0; i < len(str); i++ {
+					elements[i] = &Integer{Value: int64(str[i])}
+				}
+
+				return &Array{Elements: elements}
+			},
+		},
+	},
 }
 
 func GetBuiltinByName(name string) *Builtin {
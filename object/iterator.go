@@ -0,0 +1,91 @@
+package object
+
+import "sort"
+
+// for-in循环使用的迭代器
+type Iterator struct {
+	next func() (Object, bool)
+}
+
+func (it *Iterator) Type() ObjectType { return ITERATOR_OBJ }
+func (it *Iterator) Inspect() string  { return "iterator" }
+
+// 取出下一个元素，没有了返回false
+func (it *Iterator) Next() (Object, bool) {
+	return it.next()
+}
+
+// 数组按顺序遍历元素，字符串按字符遍历，hash遍历排好序的键。
+// 不能遍历的对象返回false
+func NewIterator(obj Object) (*Iterator, bool) {
+	switch obj := obj.(type) {
+	case *Array:
+		i := 0
+		return &Iterator{next: func() (Object, bool) {
+			if i >= len(obj.Elements) {
+				return nil, false
+			}
+			el := obj.Elements[i]
+			i++
+			return el, true
+		}}, true
+	case *String:
+		runes := obj.Runes()
+		i := 0
+		return &Iterator{next: func() (Object, bool) {
+			if i >= len(runes) {
+				return nil, false
+			}
+			ch := &String{Value: string(runes[i])}
+			i++
+			return ch, true
+		}}, true
+	case *Hash:
+		keys := obj.SortedKeys()
+		i := 0
+		return &Iterator{next: func() (Object, bool) {
+			if i >= len(keys) {
+				return nil, false
+			}
+			key := keys[i]
+			i++
+			return key, true
+		}}, true
+	default:
+		return nil, false
+	}
+}
+
+// 按keyLess排好序的键，遍历、keys()等需要稳定顺序的地方使用
+func (h *Hash) SortedKeys() []Object {
+	keys := make([]Object, 0, len(h.Pairs))
+	for _, pair := range h.Pairs {
+		keys = append(keys, pair.Key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+	return keys
+}
+
+// hash的键没有顺序，遍历时数字按大小排，其余按类型和Inspect()排，保证结果稳定
+func keyLess(a, b Object) bool {
+	af, aok := numberValue(a)
+	bf, bok := numberValue(b)
+	if aok && bok {
+		return af < bf
+	}
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+	return a.Inspect() < b.Inspect()
+}
+
+func numberValue(obj Object) (float64, bool) {
+	switch obj := obj.(type) {
+	case *Integer:
+		return float64(obj.Value), true
+	case *Float:
+		return obj.Value, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,224 @@
+package object
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 方法里需要调用用户传入的函数（如map），解释器和虚拟机调用函数的方式不同，各自提供实现
+type CallFunction func(fn Object, args ...Object) Object
+
+type MethodFunction func(call CallFunction, receiver Object, args ...Object) Object
+
+// x.method取出的方法，已经和接收者x绑定，可以像函数一样调用
+type BoundMethod struct {
+	Receiver Object
+	Name     string
+	Fn       MethodFunction
+}
+
+func (bm *BoundMethod) Type() ObjectType { return BOUND_METHOD_OBJ }
+func (bm *BoundMethod) Inspect() string {
+	return fmt.Sprintf("builtin method %s.%s", bm.Receiver.Type(), bm.Name)
+}
+
+// 内置类型的方法表，按对象类型和方法名查找
+var methods = map[ObjectType]map[string]MethodFunction{
+	STRING_OBJ: {
+		"len": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("len", args); err != nil {
+				return err
+			}
+			return &Integer{Value: int64(receiver.(*String).Len())}
+		},
+		"upper": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("upper", args); err != nil {
+				return err
+			}
+			return &String{Value: strings.ToUpper(receiver.(*String).Value)}
+		},
+		"lower": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("lower", args); err != nil {
+				return err
+			}
+			return &String{Value: strings.ToLower(receiver.(*String).Value)}
+		},
+		"trim": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("trim", args); err != nil {
+				return err
+			}
+			return &String{Value: strings.TrimSpace(receiver.(*String).Value)}
+		},
+		"split": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("split", args, STRING_OBJ); err != nil {
+				return err
+			}
+			parts := strings.Split(receiver.(*String).Value, args[0].(*String).Value)
+			elements := make([]Object, len(parts))
+			for i, p := range parts {
+				elements[i] = &String{Value: p}
+			}
+			return &Array{Elements: elements}
+		},
+		"contains": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("contains", args, STRING_OBJ); err != nil {
+				return err
+			}
+			return &Boolean{Value: strings.Contains(receiver.(*String).Value, args[0].(*String).Value)}
+		},
+		"replace": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("replace", args, STRING_OBJ, STRING_OBJ); err != nil {
+				return err
+			}
+			old, repl := args[0].(*String).Value, args[1].(*String).Value
+			return &String{Value: strings.ReplaceAll(receiver.(*String).Value, old, repl)}
+		},
+	},
+	ARRAY_OBJ: {
+		"len": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("len", args); err != nil {
+				return err
+			}
+			return &Integer{Value: int64(len(receiver.(*Array).Elements))}
+		},
+		"push": func(call CallFunction, receiver Object, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments to `push`. got=%d, want=1", len(args))
+			}
+			elements := receiver.(*Array).Elements
+			newElements := make([]Object, len(elements)+1)
+			copy(newElements, elements)
+			newElements[len(elements)] = args[0]
+			return &Array{Elements: newElements}
+		},
+		"map": func(call CallFunction, receiver Object, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments to `map`. got=%d, want=1", len(args))
+			}
+			elements := receiver.(*Array).Elements
+			result := make([]Object, len(elements))
+			for i, el := range elements {
+				v := call(args[0], el)
+				if isError(v) {
+					return v
+				}
+				result[i] = v
+			}
+			return &Array{Elements: result}
+		},
+		"filter": func(call CallFunction, receiver Object, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments to `filter`. got=%d, want=1", len(args))
+			}
+			result := []Object{}
+			for _, el := range receiver.(*Array).Elements {
+				v := call(args[0], el)
+				if isError(v) {
+					return v
+				}
+				if isTruthy(v) {
+					result = append(result, el)
+				}
+			}
+			return &Array{Elements: result}
+		},
+		"reduce": func(call CallFunction, receiver Object, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments to `reduce`. got=%d, want=2", len(args))
+			}
+			acc := args[1]
+			for _, el := range receiver.(*Array).Elements {
+				acc = call(args[0], acc, el)
+				if isError(acc) {
+					return acc
+				}
+			}
+			return acc
+		},
+		"join": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("join", args, STRING_OBJ); err != nil {
+				return err
+			}
+			parts := []string{}
+			for _, el := range receiver.(*Array).Elements {
+				parts = append(parts, el.Inspect())
+			}
+			return &String{Value: strings.Join(parts, args[0].(*String).Value)}
+		},
+	},
+	HASH_OBJ: {
+		"len": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("len", args); err != nil {
+				return err
+			}
+			return &Integer{Value: int64(len(receiver.(*Hash).Pairs))}
+		},
+		"keys": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("keys", args); err != nil {
+				return err
+			}
+			return &Array{Elements: receiver.(*Hash).SortedKeys()}
+		},
+		"values": func(call CallFunction, receiver Object, args ...Object) Object {
+			if err := checkArgs("values", args); err != nil {
+				return err
+			}
+			hash := receiver.(*Hash)
+			keys := hash.SortedKeys()
+			values := make([]Object, len(keys))
+			for i, k := range keys {
+				values[i] = hash.Pairs[k.(Hashable).HashKey()].Value
+			}
+			return &Array{Elements: values}
+		},
+		"has": func(call CallFunction, receiver Object, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments to `has`. got=%d, want=1", len(args))
+			}
+			key, ok := args[0].(Hashable)
+			if !ok {
+				return newError("unusable as hash key: %s", args[0].Type())
+			}
+			_, ok = receiver.(*Hash).Pairs[key.HashKey()]
+			return &Boolean{Value: ok}
+		},
+	},
+}
+
+// 查找obj类型上名为name的方法，返回和obj绑定好的方法
+func GetMethod(obj Object, name string) (*BoundMethod, bool) {
+	fn, ok := methods[obj.Type()][name]
+	if !ok {
+		return nil, false
+	}
+	return &BoundMethod{Receiver: obj, Name: name, Fn: fn}, true
+}
+
+// 检查参数个数和类型
+func checkArgs(name string, args []Object, types ...ObjectType) *Error {
+	if len(args) != len(types) {
+		return newError("wrong number of arguments to `%s`. got=%d, want=%d", name, len(args), len(types))
+	}
+	for i, t := range types {
+		if args[i].Type() != t {
+			return newError("argument to `%s` must be %s, got %s", name, t, args[i].Type())
+		}
+	}
+	return nil
+}
+
+func isError(obj Object) bool {
+	return obj != nil && obj.Type() == ERROR_OBJ
+}
+
+// 解释器和虚拟机的null、true、false各自是单例，这里按类型判断
+func isTruthy(obj Object) bool {
+	switch obj := obj.(type) {
+	case *Boolean:
+		return obj.Value
+	case *Null:
+		return false
+	default:
+		return obj != nil
+	}
+}
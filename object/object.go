@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
 	"monkey/ast"
 	"monkey/code"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type ObjectType string
 
 const (
 	INTEGER_OBJ           = "INTEGER"
+	FLOAT_OBJ             = "FLOAT"
 	BOOLEAN_OBJ           = "BOOLEAN"
 	NULL_OBJ              = "NULL"
 	RETURN_VALUE_OBJ      = "RETURN_VALUE"
@@ -24,6 +28,14 @@ const (
 	HASH_OBJ              = "HASH"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
 	CLOSURE_OBJ           = "CLOSURE"
+	ITERATOR_OBJ          = "ITERATOR"
+	BREAK_OBJ             = "BREAK"
+	CONTINUE_OBJ          = "CONTINUE"
+	CELL_OBJ              = "CELL"
+	BOUND_METHOD_OBJ      = "BOUND_METHOD"
+	QUOTE_OBJ             = "QUOTE"
+	MACRO_OBJ             = "MACRO"
+	TAIL_CALL_OBJ         = "TAIL_CALL"
 )
 
 type Object interface {
@@ -38,8 +50,40 @@ type Integer struct {
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 
+type Float struct {
+	Value float64
+}
+
+// 整数值的浮点数也带上".0"，和整数区分开
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+
 type String struct {
 	Value string
+
+	runes []rune // 按需解码，字符串不可变所以可以缓存
+}
+
+// 字符串的长度、索引和遍历都以Unicode字符（code point）为单位，
+// 需要字节时用bytes()
+func (s *String) Runes() []rune {
+	if s.runes == nil {
+		s.runes = []rune(s.Value)
+	}
+	return s.runes
+}
+
+func (s *String) Len() int {
+	if s.runes != nil {
+		return len(s.runes)
+	}
+	return utf8.RuneCountInString(s.Value)
 }
 
 func (s *String) Type() ObjectType { return STRING_OBJ }
@@ -64,20 +108,43 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// 解释器中break和continue的信号，和ReturnValue一样逐层向上传递直到循环
+type Break struct{}
+
+func (b *Break) Type() ObjectType { return BREAK_OBJ }
+func (b *Break) Inspect() string  { return "break" }
+
+type Continue struct{}
+
+func (c *Continue) Type() ObjectType { return CONTINUE_OBJ }
+func (c *Continue) Inspect() string  { return "continue" }
+
 type Function struct {
 	Parameters []*ast.Identifier
+	Defaults   []ast.Expression // 调用时在函数自己的环境里求值
+	Rest       *ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
 }
 
+// 同CompiledFunction.Arity
+func (f *Function) Arity() (minArgs, maxArgs int) {
+	for i := range f.Parameters {
+		if i >= len(f.Defaults) || f.Defaults[i] == nil {
+			minArgs++
+		}
+	}
+	if f.Rest != nil {
+		return minArgs, -1
+	}
+	return minArgs, len(f.Parameters)
+}
+
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
 func (f *Function) Inspect() string {
 	var out bytes.Buffer
 
-	params := []string{}
-	for _, p := range f.Parameters {
-		params = append(params, p.String())
-	}
+	params := ast.ParameterStrings(f.Parameters, f.Defaults, f.Rest)
 
 	out.WriteString("fn")
 	out.WriteString("(")
@@ -89,22 +156,126 @@ func (f *Function) Inspect() string {
 	return out.String()
 }
 
+// quote(...)的结果，保存未求值的ast节点
+type Quote struct {
+	Node ast.Node
+}
+
+func (q *Quote) Type() ObjectType { return QUOTE_OBJ }
+func (q *Quote) Inspect() string {
+	return "QUOTE(" + q.Node.String() + ")"
+}
+
+type Macro struct {
+	Parameters []*ast.Identifier
+	Body       *ast.BlockStatement
+	Env        *Environment
+}
+
+func (m *Macro) Type() ObjectType { return MACRO_OBJ }
+func (m *Macro) Inspect() string {
+	params := []string{}
+	for _, p := range m.Parameters {
+		params = append(params, p.String())
+	}
+	return "macro(" + strings.Join(params, ", ") + ") {\n" + m.Body.String() + "\n}"
+}
+
+// 解释器中处于尾部位置的调用，交给调用方循环执行，不会加深Go的调用栈
+type TailCall struct {
+	Fn   Object
+	Args []Object
+}
+
+func (tc *TailCall) Type() ObjectType { return TAIL_CALL_OBJ }
+func (tc *TailCall) Inspect() string  { return "tail call" }
+
+// 运行时错误和throw抛出的异常都用Error向外传递
 type Error struct {
 	Message string
+	Value   Object       // throw抛出的不是Error的值，catch时取回它；运行时错误为nil
+	Trace   []TraceEntry // 虚拟机中抛出时的调用栈，最内层的帧在前
+	Abort   *AbortError  // 解释器中止运行的原因，try不捕获这样的错误
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
 func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
 
+// 虚拟机把Error当作Go的error返回
+func (e *Error) Error() string { return e.Message }
+
+// catch (e)中e绑定的值：throw的原值；运行时错误包装成{"message": 消息}，
+// 否则Error作为普通的值使用时又会被当成错误继续传递
+func (e *Error) Caught() Object {
+	if e.Value != nil {
+		return e.Value
+	}
+	key := &String{Value: "message"}
+	return &Hash{Pairs: map[HashKey]HashPair{
+		key.HashKey(): {Key: key, Value: &String{Value: e.Message}},
+	}}
+}
+
+// 每个帧一行，如"at add (line 3, offset 12)"；省略的帧为一行"... 12 more frames"
+func (e *Error) StackTrace() string {
+	var out bytes.Buffer
+	for _, entry := range e.Trace {
+		if entry.Omitted == 0 {
+			out.WriteString("at ")
+		}
+		out.WriteString(entry.String() + "\n")
+	}
+	return out.String()
+}
+
+// 调用栈中的一个帧：所在函数、正在执行的指令的偏移和它对应的源码行
+type TraceEntry struct {
+	Function string
+	Offset   int
+	Line     int
+	Omitted  int // 不为0时这一条代表中间省略掉的帧数
+}
+
+func (te TraceEntry) String() string {
+	if te.Omitted > 0 {
+		return fmt.Sprintf("... %d more frames", te.Omitted)
+	}
+	if te.Line == 0 {
+		return fmt.Sprintf("%s (offset %d)", te.Function, te.Offset)
+	}
+	return fmt.Sprintf("%s (line %d, offset %d)", te.Function, te.Line, te.Offset)
+}
+
+// throw value抛出的异常
+func NewException(value Object) *Error {
+	return &Error{Message: "uncaught exception: " + value.Inspect(), Value: value}
+}
+
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	store  map[string]Object
+	outer  *Environment
+	budget *Budget // 只记在最外层的环境上，函数的环境沿着outer找到它
+}
+
+// 本次运行的执行预算，没有限制时为nil
+func (e *Environment) Budget() *Budget {
+	for e.outer != nil {
+		e = e.outer
+	}
+	return e.budget
+}
+
+func (e *Environment) SetBudget(b *Budget) {
+	for e.outer != nil {
+		e = e.outer
+	}
+	e.budget = b
 }
 
 func (e *Environment) Get(name string) (Object, bool) {
 	obj, ok := e.store[name]
 	if !ok && e.outer != nil {
-		obj, ok = e.outer.store[name] // 这层找不到就在外层找
+		obj, ok = e.outer.Get(name) // 这层找不到就在外层找
 	}
 	return obj, ok
 }
@@ -113,6 +284,18 @@ func (e *Environment) Set(name string, val Object) Object {
 	return val
 }
 
+// 修改已有的绑定，绑定在哪一层就改哪一层；name未定义时返回false
+func (e *Environment) Assign(name string, val Object) (Object, bool) {
+	if _, ok := e.store[name]; ok {
+		e.store[name] = val
+		return val, true
+	}
+	if e.outer != nil {
+		return e.outer.Assign(name, val)
+	}
+	return nil, false
+}
+
 // 用到环境绑定name和值
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
@@ -134,6 +317,8 @@ type Builtin struct {
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
 func (b *Builtin) Inspect() string  { return "builtin function" }
 
+// 数组和hash是可变的引用类型：赋值、传参得到的是同一个对象，
+// a[i] = v会被所有引用者看到。push、rest等内置函数返回新对象，不修改原对象
 type Array struct {
 	Elements []Object
 }
@@ -179,6 +364,14 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+// 1.0 == 1，所以值为整数的浮点数和对应的整数使用同一个键
+func (f *Float) HashKey() HashKey {
+	if f.Value == math.Trunc(f.Value) && f.Value >= math.MinInt64 && f.Value < math.MaxInt64 {
+		return (&Integer{Value: int64(f.Value)}).HashKey()
+	}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(f.Value)}
+}
+
 func (s *String) HashKey() HashKey {
 	h := fnv.New64a()
 	h.Write([]byte(s.Value))
@@ -191,6 +384,7 @@ type HashPair struct {
 	Value Object
 }
 
+// 和Array一样可变且按引用共享
 type Hash struct {
 	Pairs map[HashKey]HashPair
 }
@@ -214,7 +408,79 @@ func (h *Hash) Inspect() string {
 type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
-	NumParameters int
+	NumParameters int  // 不含...rest
+	Variadic      bool // 有...rest参数，它占用参数之后的一个局部变量槽
+	// 缺少第i个默认参数时从DefaultOffsets[i]开始运行，依次求出缺少的默认值；
+	// 参数都传了时从BodyOffset开始运行
+	DefaultOffsets []int
+	BodyOffset     int
+	Handlers       []ExceptionHandler // 内层try的处理器排在外层前面
+	Name           string             // 用let绑定时的名字，用于调用栈
+	Lines          []LineInfo         // 按Offset升序
+}
+
+// 从Offset开始的指令由源码第Line行编译而来，直到下一项的Offset
+type LineInfo struct {
+	Offset int
+	Line   int
+}
+
+// ip处的指令对应的源码行号，没有行号信息时为0
+func (cf *CompiledFunction) LineAt(ip int) int {
+	line := 0
+	for _, l := range cf.Lines {
+		if l.Offset > ip {
+			break
+		}
+		line = l.Line
+	}
+	return line
+}
+
+// 指令[Start, End)中抛出的异常跳到Target处理，此时栈恢复到运行第Slot个OpTry时的高度，
+// 再压入catch的值；finally处理器压入Error本身，以便原样重新抛出。
+// 一个处理器的保护范围可能被内联的finally分成几段，每段一项
+type ExceptionHandler struct {
+	Start   int
+	End     int
+	Target  int
+	Slot    int
+	Finally bool
+}
+
+// 找到保护ip处指令的最内层处理器
+func (cf *CompiledFunction) FindHandler(ip int) (ExceptionHandler, bool) {
+	for _, h := range cf.Handlers {
+		if h.Start <= ip && ip < h.End {
+			return h, true
+		}
+	}
+	return ExceptionHandler{}, false
+}
+
+// 函数可以接收的实参个数范围，maxArgs为-1表示没有上限
+func (cf *CompiledFunction) Arity() (minArgs, maxArgs int) {
+	minArgs = cf.NumParameters - len(cf.DefaultOffsets)
+	if cf.Variadic {
+		return minArgs, -1
+	}
+	return minArgs, cf.NumParameters
+}
+
+// 实参个数不在[minArgs, maxArgs]内时返回错误，maxArgs为-1表示没有上限
+func CheckArity(minArgs, maxArgs, numArgs int) error {
+	switch {
+	case maxArgs < 0:
+		if numArgs < minArgs {
+			return fmt.Errorf("wrong number of arguments: want at least %d, got=%d", minArgs, numArgs)
+		}
+	case numArgs < minArgs || numArgs > maxArgs:
+		if minArgs == maxArgs {
+			return fmt.Errorf("wrong number of arguments: want=%d, got=%d", minArgs, numArgs)
+		}
+		return fmt.Errorf("wrong number of arguments: want %d to %d, got=%d", minArgs, maxArgs, numArgs)
+	}
+	return nil
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
@@ -227,6 +493,15 @@ type Closure struct {
 	Free []Object
 }
 
+// 被闭包捕获的局部变量装在Cell里，外层函数和闭包共享同一个Cell，
+// 一方的赋值另一方可以看到。Cell只存在于局部变量槽和Closure.Free中，不会出现在栈上
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string  { return c.Value.Inspect() }
+
 // Closure是运行时创建，不能在编译时使用
 // 而CompiledFunction在编译时，需要把函数装着压到常量池里
 func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
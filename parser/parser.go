@@ -1,11 +1,15 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"monkey/ast"
+	"monkey/diagnostic"
 	"monkey/lexer"
 	"monkey/token"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type (
@@ -19,7 +23,8 @@ type Parser struct {
 	curToken  token.Token
 	peekToken token.Token
 
-	errors []string
+	errors    []diagnostic.Diagnostic
+	panicking bool // 出错后进入恐慌模式，同步之前不再报告新的错误，避免连锁报错
 
 	// 用于检查是否有相关的前缀或中缀解析函数
 	prefixParseFns map[token.TokenType]prefixParseFn
@@ -30,10 +35,14 @@ type Parser struct {
 const (
 	_ int = iota
 	LOWEST
+	ASSIGN      // = or +=，右结合
+	NULLISH     // ??
+	OR          // ||
+	AND         // &&
 	EQUALS      // ==
 	LESSGREATER // > or <
-	SUM         // +
-	PRODUCT     // *
+	SUM         // + or | or ^
+	PRODUCT     // * or & or << or >>
 	PREFIX      // -X or !X
 	CALL        // myFunction(X)
 	INDEX       // myArray[index]
@@ -41,16 +50,36 @@ const (
 
 // 优先级表
 var precedences = map[token.TokenType]int{
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LPAREN:   CALL,
-	token.LBRACKET: INDEX,
+	token.ASSIGN:          ASSIGN,
+	token.PLUS_ASSIGN:     ASSIGN,
+	token.MINUS_ASSIGN:    ASSIGN,
+	token.ASTERISK_ASSIGN: ASSIGN,
+	token.SLASH_ASSIGN:    ASSIGN,
+	token.EQ:              EQUALS,
+	token.NOT_EQ:          EQUALS,
+	token.LT:              LESSGREATER,
+	token.GT:              LESSGREATER,
+	token.LT_EQ:           LESSGREATER,
+	token.GT_EQ:           LESSGREATER,
+	token.NULLISH:         NULLISH,
+	token.AND:             AND,
+	token.OR:              OR,
+	token.PLUS:            SUM,
+	token.MINUS:           SUM,
+	token.SLASH:           PRODUCT,
+	token.ASTERISK:        PRODUCT,
+	token.PERCENT:         PRODUCT,
+	// 和Go一样，位运算的优先级高于比较运算
+	token.PIPE:         SUM,
+	token.CARET:        SUM,
+	token.AMPERSAND:    PRODUCT,
+	token.SHL:          PRODUCT,
+	token.SHR:          PRODUCT,
+	token.LPAREN:       CALL,
+	token.LBRACKET:     INDEX,
+	token.DOT:          INDEX,
+	token.OPT_DOT:      INDEX,
+	token.OPT_LBRACKET: INDEX,
 }
 
 func (p *Parser) registerPrefix(tokenType token.TokenType, fn prefixParseFn) {
@@ -70,9 +99,27 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		p.errorAt(p.curToken, diagnostic.IntegerOverflow, "the largest integer is 9223372036854775807",
+			"integer literal %s overflows int64", p.curToken.Literal)
+		return nil
+	}
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.errorAt(p.curToken, diagnostic.InvalidInteger, "",
+			"could not parse %q as integer", p.curToken.Literal)
+		return nil
+	}
+	lit.Value = value
+	return lit
+}
+
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+	// 词法分析器已经检查过'_'的位置
+	value, err := strconv.ParseFloat(strings.ReplaceAll(p.curToken.Literal, "_", ""), 64)
+	if err != nil {
+		p.errorAt(p.curToken, diagnostic.InvalidFloat, "",
+			"could not parse %q as float", p.curToken.Literal)
 		return nil
 	}
 	lit.Value = value
@@ -83,6 +130,46 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+func (p *Parser) parseInterpolatedString() ast.Expression {
+	exp := &ast.InterpolatedString{Token: p.curToken}
+	exp.Parts = p.appendStringPart(exp.Parts)
+
+	for {
+		if p.peekTokenIs(token.INTERP_MID) || p.peekTokenIs(token.INTERP_END) {
+			p.emptyInterpolationError(p.curToken)
+			return nil
+		}
+		p.nextToken()
+		exp.Parts = append(exp.Parts, p.parseExpression(LOWEST))
+
+		if !p.peekTokenIs(token.INTERP_MID) {
+			break
+		}
+		p.nextToken()
+		exp.Parts = p.appendStringPart(exp.Parts)
+	}
+
+	if !p.expectPeek(token.INTERP_END) {
+		return nil
+	}
+	exp.Parts = p.appendStringPart(exp.Parts)
+	exp.EndToken = p.curToken
+
+	return exp
+}
+
+// 插值之间为空的字面量部分不保留
+func (p *Parser) appendStringPart(parts []ast.Expression) []ast.Expression {
+	if p.curToken.Literal == "" {
+		return parts
+	}
+	return append(parts, &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal})
+}
+
+func (p *Parser) parseNullLiteral() ast.Expression {
+	return &ast.NullLiteral{Token: p.curToken}
+}
+
 func (p *Parser) parseBoolean() ast.Expression {
 	return &ast.Boolean{Token: p.curToken, Value: p.curTokenIs(token.TRUE)}
 }
@@ -134,32 +221,87 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expression
 }
 
-func (p *Parser) parseFunctionParameters() []*ast.Identifier {
-	identifiers := []*ast.Identifier{}
+// try { } catch (e) { } finally { }，catch的参数可以省略
+func (p *Parser) parseTryExpression() ast.Expression {
+	expression := &ast.TryExpression{Token: p.curToken}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	expression.Block = p.parseBlockStatement()
 
-	// 参数为空
-	if p.peekTokenIs(token.RPAREN) {
+	if p.peekTokenIs(token.CATCH) {
 		p.nextToken()
-		return identifiers
+		if p.peekTokenIs(token.LPAREN) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			expression.Param = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			if !p.expectPeek(token.RPAREN) {
+				return nil
+			}
+		}
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expression.Catch = p.parseBlockStatement()
 	}
 
-	p.nextToken()
-
-	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-	identifiers = append(identifiers, ident)
-
-	for p.peekTokenIs(token.COMMA) {
-		p.nextToken()
+	if p.peekTokenIs(token.FINALLY) {
 		p.nextToken()
-		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-		identifiers = append(identifiers, ident)
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expression.Finally = p.parseBlockStatement()
 	}
 
-	if !p.expectPeek(token.RPAREN) {
+	if expression.Catch == nil && expression.Finally == nil {
+		p.errorAt(expression.Token, diagnostic.MissingHandler, "add a catch or finally block after the try block",
+			"try without catch or finally")
 		return nil
 	}
 
-	return identifiers
+	return expression
+}
+
+// 形参可以带默认值，如b = 1，之后的参数也都必须带默认值；最后可以有一个...rest
+func (p *Parser) parseFunctionParameters(lit *ast.FunctionLiteral) bool {
+	hasDefault := false
+
+	for !p.peekTokenIs(token.RPAREN) {
+		if p.peekTokenIs(token.ELLIPSIS) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return false
+			}
+			lit.Rest = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			break
+		}
+		if !p.expectPeek(token.IDENT) {
+			return false
+		}
+		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+		var value ast.Expression
+		if p.peekTokenIs(token.ASSIGN) {
+			p.nextToken()
+			p.nextToken()
+			value = p.parseExpression(LOWEST)
+			hasDefault = true
+		} else if hasDefault {
+			p.errorAtNode(ident, diagnostic.MissingDefault, "give it a default value or move it before the parameters with defaults",
+				"parameter %s without default follows parameter with default", ident.Value)
+			return false
+		}
+		lit.Parameters = append(lit.Parameters, ident)
+		lit.Defaults = append(lit.Defaults, value)
+
+		if !p.peekTokenIs(token.RPAREN) && !p.expectPeek(token.COMMA) {
+			return false
+		}
+	}
+
+	return p.expectPeek(token.RPAREN)
 }
 
 func (p *Parser) parseFunctionLiteral() ast.Expression {
@@ -169,7 +311,9 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
-	lit.Parameters = p.parseFunctionParameters()
+	if !p.parseFunctionParameters(lit) {
+		return nil
+	}
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
@@ -180,9 +324,34 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	return lit
 }
 
+// 宏的参数只能是标识符，没有默认值和...rest
+func (p *Parser) parseMacroLiteral() ast.Expression {
+	lit := &ast.MacroLiteral{Token: p.curToken, Parameters: []*ast.Identifier{}}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	for !p.peekTokenIs(token.RPAREN) {
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		lit.Parameters = append(lit.Parameters, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+		if !p.peekTokenIs(token.RPAREN) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+	if !p.expectPeek(token.RPAREN) || !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	lit.Body = p.parseBlockStatement()
+	return lit
+}
+
 func (p *Parser) parseArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
 	array.Elements = p.parseExpressionList(token.RBRACKET)
+	array.EndToken = p.curToken
 	return array
 }
 
@@ -238,6 +407,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	if !p.expectPeek(token.RBRACE) {
 		return nil
 	}
+	hash.EndToken = p.curToken
 
 	return hash
 
@@ -257,19 +427,89 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return exp
 }
 
+func (p *Parser) parseAssignExpression(target ast.Expression) ast.Expression {
+	exp := &ast.AssignExpression{
+		Token:    p.curToken,
+		Operator: p.curToken.Literal,
+		Target:   target,
+	}
+
+	if !isAssignable(target) {
+		p.errorAtNode(target, diagnostic.InvalidAssign, "",
+			"cannot assign to %s", target.String())
+		return nil
+	}
+
+	// 右结合：a = b = 1 解析为 a = (b = 1)
+	p.nextToken()
+	exp.Value = p.parseExpression(ASSIGN - 1)
+
+	return exp
+}
+
+// 可选链可能得到null，不能作为赋值目标
+func isAssignable(target ast.Expression) bool {
+	switch target := target.(type) {
+	case *ast.Identifier:
+		return true
+	case *ast.IndexExpression:
+		return !target.Optional
+	case *ast.MemberExpression:
+		return !target.Optional
+	default:
+		return false
+	}
+}
+
 func (p *Parser) parseCallExpression(fn ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{
 		Token:    p.curToken,
 		Function: fn,
 	}
-	exp.Arguments = p.parseExpressionList(token.RPAREN)
+	exp.Arguments = p.parseCallArguments()
+	exp.EndToken = p.curToken
 	return exp
 }
 
+// 和parseExpressionList相同，但实参可以写成...xs
+func (p *Parser) parseCallArguments() []ast.Expression {
+	list := []ast.Expression{}
+
+	if p.peekTokenIs(token.RPAREN) {
+		p.nextToken()
+		return list
+	}
+
+	p.nextToken()
+	list = append(list, p.parseCallArgument())
+
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		p.nextToken()
+		list = append(list, p.parseCallArgument())
+	}
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	return list
+}
+
+func (p *Parser) parseCallArgument() ast.Expression {
+	if !p.curTokenIs(token.ELLIPSIS) {
+		return p.parseExpression(LOWEST)
+	}
+
+	spread := &ast.SpreadExpression{Token: p.curToken}
+	p.nextToken()
+	spread.Value = p.parseExpression(LOWEST)
+	return spread
+}
+
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	exp := &ast.IndexExpression{
-		Token: p.curToken,
-		Left:  left,
+		Token:    p.curToken,
+		Left:     left,
+		Optional: p.curTokenIs(token.OPT_LBRACKET),
 	}
 
 	p.nextToken()
@@ -278,6 +518,23 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
+	exp.EndToken = p.curToken
+
+	return exp
+}
+
+// x.method(args)先解析成成员表达式，再由'('解析成调用
+func (p *Parser) parseMemberExpression(object ast.Expression) ast.Expression {
+	exp := &ast.MemberExpression{
+		Token:    p.curToken,
+		Object:   object,
+		Optional: p.curTokenIs(token.OPT_DOT),
+	}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	exp.Property = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 
 	return exp
 }
@@ -305,7 +562,7 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 }
 
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l, errors: []string{}}
+	p := &Parser{l: l, errors: []diagnostic.Diagnostic{}}
 
 	// 读两个Token用于初始化
 	p.nextToken()
@@ -315,11 +572,18 @@ func New(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
+	p.registerPrefix(token.NULL, p.parseNullLiteral)
+	p.registerPrefix(token.MATCH, p.parseMatchExpression)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
+	p.registerPrefix(token.MACRO, p.parseMacroLiteral)
+	p.registerPrefix(token.INTERP_START, p.parseInterpolatedString)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
+	p.registerPrefix(token.TILDE, p.parsePrefixExpression)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
@@ -336,8 +600,27 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.OR, p.parseInfixExpression)
+	p.registerInfix(token.AMPERSAND, p.parseInfixExpression)
+	p.registerInfix(token.PIPE, p.parseInfixExpression)
+	p.registerInfix(token.CARET, p.parseInfixExpression)
+	p.registerInfix(token.SHL, p.parseInfixExpression)
+	p.registerInfix(token.SHR, p.parseInfixExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PLUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.MINUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.ASTERISK_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.SLASH_ASSIGN, p.parseAssignExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)    // 把'('当作中缀运算符，用于解析调用表达式
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression) // 把'['当作中缀运算符，用于解析索引表达式
+	p.registerInfix(token.DOT, p.parseMemberExpression)
+	p.registerInfix(token.OPT_DOT, p.parseMemberExpression)
+	p.registerInfix(token.OPT_LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.NULLISH, p.parseInfixExpression)
 
 	return p
 }
@@ -354,7 +637,9 @@ func (p *Parser) ParseProgram() *ast.Program {
 
 	for !p.curTokenIs(token.EOF) {
 		stmt := p.parseStatement()
-		if stmt != nil {
+		if p.panicking { // 出错的语句整条丢弃
+			p.synchronize()
+		} else if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
 		}
 		p.nextToken()
@@ -363,27 +648,212 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return program
 }
 
+// 返回的接口值不会包着nil指针
 func (p *Parser) parseStatement() ast.Statement {
+	var stmt ast.Statement
+
 	switch p.curToken.Type {
 	case token.LET:
-		return p.parseLetStatement()
+		if s := p.parseLetStatement(); s != nil {
+			stmt = s
+		}
 	case token.RETURN:
-		return p.parseReturnStatement()
+		if s := p.parseReturnStatement(); s != nil {
+			stmt = s
+		}
+	case token.THROW:
+		if s := p.parseThrowStatement(); s != nil {
+			stmt = s
+		}
+	case token.WHILE:
+		if s := p.parseWhileStatement(); s != nil {
+			stmt = s
+		}
+	case token.FOR:
+		stmt = p.parseForStatement()
+	case token.BREAK:
+		stmt = &ast.BreakStatement{Token: p.curToken}
+		if p.peekTokenIs(token.SEMICOLON) {
+			p.nextToken()
+		}
+	case token.CONTINUE:
+		stmt = &ast.ContinueStatement{Token: p.curToken}
+		if p.peekTokenIs(token.SEMICOLON) {
+			p.nextToken()
+		}
 	default:
-		return p.parseExpressionStatement()
+		if s := p.parseExpressionStatement(); s != nil {
+			stmt = s
+		}
+	}
+
+	return stmt
+}
+
+// while (<condition>) { <body> }
+func (p *Parser) parseWhileStatement() *ast.WhileStatement {
+	stmt := &ast.WhileStatement{Token: p.curToken}
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	p.nextToken()
+	stmt.Condition = p.parseExpression(LOWEST)
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseBlockStatement()
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// for (<init>; <condition>; <post>) { <body> } 或 for (<ident> in <iterable>) { <body> }
+func (p *Parser) parseForStatement() ast.Statement {
+	tok := p.curToken
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	// 只有两个词法单元的前瞻，所以先读进标识符再看后面是不是in
+	if p.peekTokenIs(token.IDENT) {
+		p.nextToken()
+		if p.peekTokenIs(token.IN) {
+			return p.parseForInStatement(tok)
+		}
+		return p.parseCStyleForStatement(tok, true)
+	}
+
+	return p.parseCStyleForStatement(tok, false)
+}
+
+// 进入时curToken为'('，或者为init的第一个词法单元（started为true时）
+func (p *Parser) parseCStyleForStatement(tok token.Token, started bool) ast.Statement {
+	stmt := &ast.ForStatement{Token: tok}
+
+	if !started && !p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+		started = true
 	}
+	if started {
+		stmt.Init = p.parseStatement()
+		if stmt.Init == nil || p.panicking {
+			return nil
+		}
+		if !p.curTokenIs(token.SEMICOLON) && !p.expectPeek(token.SEMICOLON) {
+			return nil
+		}
+	} else {
+		p.nextToken()
+	}
+
+	if !p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+		stmt.Condition = p.parseExpression(LOWEST)
+	}
+	if !p.expectPeek(token.SEMICOLON) {
+		return nil
+	}
+
+	if !p.peekTokenIs(token.RPAREN) {
+		p.nextToken()
+		stmt.Post = p.parseExpression(LOWEST)
+	}
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseBlockStatement()
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// 进入时curToken为循环变量
+func (p *Parser) parseForInStatement(tok token.Token) ast.Statement {
+	stmt := &ast.ForInStatement{Token: tok}
+	stmt.Variable = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	p.nextToken()
+	p.nextToken()
+	stmt.Iterable = p.parseExpression(LOWEST)
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseBlockStatement()
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// 恐慌模式下跳过词法单元，直到当前语句结束：
+// 停在';'上，或者停在下一条语句（关键字）、'}'、EOF之前，
+// 跳过的部分中成对的'{' '}'会被整体跳过。
+// 如果错误恰好发生在所属块的'}'上，则停在这个'}'上并返回true
+func (p *Parser) synchronize() bool {
+	p.panicking = false
+	depth := 0
+
+	for !p.curTokenIs(token.EOF) {
+		switch p.curToken.Type {
+		case token.LBRACE:
+			depth++
+		case token.RBRACE:
+			if depth == 0 {
+				return true
+			}
+			depth--
+		case token.SEMICOLON:
+			if depth == 0 {
+				return false
+			}
+		}
+
+		if depth == 0 {
+			switch p.peekToken.Type {
+			case token.LET, token.RETURN, token.THROW, token.WHILE, token.FOR, token.BREAK, token.CONTINUE,
+				token.RBRACE, token.EOF:
+				return false
+			}
+		}
+
+		p.nextToken()
+	}
+
+	return false
 }
 
 // 解析Let语句
 func (p *Parser) parseLetStatement() *ast.LetStatement {
 	stmt := &ast.LetStatement{Token: p.curToken}
 
-	if !p.expectPeek(token.IDENT) {
+	switch {
+	case p.peekTokenIs(token.LBRACKET), p.peekTokenIs(token.LBRACE):
+		p.nextToken()
+		stmt.Pattern = p.parsePattern(false)
+	case p.expectPeek(token.IDENT):
+		// 获得标识符
+		stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	default:
+		return nil
+	}
+	if stmt.Name == nil && (stmt.Pattern == nil || !p.checkPatternNames(stmt.Pattern)) {
 		return nil
 	}
-
-	// 获得标识符
-	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 
 	if !p.expectPeek(token.ASSIGN) {
 		return nil
@@ -392,18 +862,190 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
 
-	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok { // 如果是函数，有名字给加上
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok && stmt.Name != nil { // 如果是函数，有名字给加上
 		fl.Name = stmt.Name.Value
 	}
 
 	// LetStatement遇到分号结束
-	if p.peekTokenIs(token.SEMICOLON) {
+	if !p.panicking && p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
 
 	return stmt
 }
 
+// 从当前词法单元开始解析一个模式；只有match中可以使用字面量模式
+func (p *Parser) parsePattern(allowLiterals bool) ast.Pattern {
+	switch p.curToken.Type {
+	case token.IDENT:
+		if p.curToken.Literal == "_" {
+			return &ast.WildcardPattern{Token: p.curToken}
+		}
+		return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	case token.LBRACKET:
+		return p.parseArrayPattern(allowLiterals)
+	case token.LBRACE:
+		return p.parseHashPattern(allowLiterals)
+	case token.INT, token.FLOAT, token.STRING, token.TRUE, token.FALSE, token.NULL, token.MINUS:
+		if !allowLiterals {
+			p.errorAt(p.curToken, diagnostic.InvalidPattern, "literal patterns can only be used in match",
+				"unexpected %s in pattern", p.curToken.Literal)
+			return nil
+		}
+		return p.parseLiteralPattern()
+	default:
+		p.errorAt(p.curToken, diagnostic.InvalidPattern, "",
+			"unexpected %s in pattern", p.curToken.Literal)
+		return nil
+	}
+}
+
+// 直接调用前缀解析函数，不让1.len()之类的后缀表达式混进模式里
+func (p *Parser) parseLiteralPattern() ast.Pattern {
+	if !p.curTokenIs(token.MINUS) {
+		value := p.prefixParseFns[p.curToken.Type]()
+		if value == nil {
+			return nil
+		}
+		return &ast.LiteralPattern{Value: value}
+	}
+
+	exp := &ast.PrefixExpression{Token: p.curToken, Operator: p.curToken.Literal}
+	if !p.peekTokenIs(token.INT) && !p.peekTokenIs(token.FLOAT) {
+		p.peekError(token.INT)
+		return nil
+	}
+	p.nextToken()
+	exp.Right = p.prefixParseFns[p.curToken.Type]()
+	if exp.Right == nil {
+		return nil
+	}
+	return &ast.LiteralPattern{Value: exp}
+}
+
+// 解析[a, b, ...rest]，...rest只能放在最后
+func (p *Parser) parseArrayPattern(allowLiterals bool) ast.Pattern {
+	pattern := &ast.ArrayPattern{Token: p.curToken}
+
+	for !p.peekTokenIs(token.RBRACKET) {
+		if p.peekTokenIs(token.ELLIPSIS) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			pattern.Rest = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			break
+		}
+		p.nextToken()
+		element := p.parsePattern(allowLiterals)
+		if element == nil {
+			return nil
+		}
+		pattern.Elements = append(pattern.Elements, element)
+		if !p.peekTokenIs(token.RBRACKET) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+	pattern.EndToken = p.curToken
+	return pattern
+}
+
+// 解析{name, port: p}
+func (p *Parser) parseHashPattern(allowLiterals bool) ast.Pattern {
+	pattern := &ast.HashPattern{Token: p.curToken}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		key := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		var value ast.Pattern = key
+		if p.peekTokenIs(token.COLON) {
+			p.nextToken()
+			p.nextToken()
+			value = p.parsePattern(allowLiterals)
+			if value == nil {
+				return nil
+			}
+		}
+		pattern.Keys = append(pattern.Keys, key)
+		pattern.Values = append(pattern.Values, value)
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+	pattern.EndToken = p.curToken
+	return pattern
+}
+
+// match (x) { pattern if guard => body, ... }，最后一个分支后面的逗号可以省略
+func (p *Parser) parseMatchExpression() ast.Expression {
+	exp := &ast.MatchExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	p.nextToken()
+	exp.Subject = p.parseExpression(LOWEST)
+	if !p.expectPeek(token.RPAREN) || !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		p.nextToken()
+		arm := &ast.MatchArm{Pattern: p.parsePattern(true)}
+		if arm.Pattern == nil || !p.checkPatternNames(arm.Pattern) {
+			return nil
+		}
+		if p.peekTokenIs(token.IF) {
+			p.nextToken()
+			p.nextToken()
+			arm.Guard = p.parseExpression(LOWEST)
+		}
+		if !p.expectPeek(token.ARROW) {
+			return nil
+		}
+		p.nextToken()
+		arm.Body = p.parseExpression(LOWEST)
+		if arm.Body == nil {
+			return nil
+		}
+		exp.Arms = append(exp.Arms, arm)
+
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+	exp.EndToken = p.curToken
+	return exp
+}
+
+// 同一个模式里不能两次绑定同一个名字
+func (p *Parser) checkPatternNames(pattern ast.Pattern) bool {
+	seen := map[string]bool{}
+	for _, name := range ast.PatternNames(pattern) {
+		if seen[name.Value] {
+			p.errorAtNode(name, diagnostic.DuplicateName, "",
+				"duplicate name %s in pattern", name.Value)
+			return false
+		}
+		seen[name.Value] = true
+	}
+	return true
+}
+
 // 解析Return语句
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	stmt := &ast.ReturnStatement{Token: p.curToken}
@@ -412,6 +1054,23 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	stmt.ReturnValue = p.parseExpression(LOWEST)
 
 	// ReturnStatement遇到分号结束
+	if !p.panicking && p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// 解析Throw语句
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -426,11 +1085,16 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 
 	for !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
 		stmt := p.parseStatement()
-		if stmt != nil {
+		if p.panicking {
+			if p.synchronize() { // 已经停在块结尾的'}'上
+				break
+			}
+		} else if stmt != nil {
 			block.Statements = append(block.Statements, stmt)
 		}
 		p.nextToken()
 	}
+	block.EndToken = p.curToken
 
 	return block
 }
@@ -439,7 +1103,7 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 	stmt.Expression = p.parseExpression(LOWEST) // 最开始传入LOWEST用于保证该表达式能解析到分号为止
-	if p.peekTokenIs(token.SEMICOLON) {
+	if !p.panicking && p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
 	return stmt
@@ -459,7 +1123,8 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 
 	// 普拉特解析
 	// BRAVO!精妙的写法
-	for !p.peekTokenIs(token.SEMICOLON) && precedence < p.peekPrecedence() {
+	// 恐慌模式下不再继续吃掉后面的token，交给synchronize处理
+	for !p.panicking && !p.peekTokenIs(token.SEMICOLON) && precedence < p.peekPrecedence() {
 		// 如果下一个token是中缀运算符则进行解析
 		infix := p.infixParseFns[p.peekToken.Type]
 		if infix == nil {
@@ -503,17 +1168,84 @@ func (p *Parser) curPrecedence() int {
 	return LOWEST
 }
 
-func (p *Parser) Errors() []string {
-	return p.errors
+// 词法错误和语法错误合在一起，按在源码中的位置排序
+func (p *Parser) Errors() []diagnostic.Diagnostic {
+	lexErrors := p.l.Errors()
+	if len(lexErrors) == 0 {
+		return p.errors
+	}
+
+	all := make([]diagnostic.Diagnostic, 0, len(lexErrors)+len(p.errors))
+	all = append(all, lexErrors...)
+	all = append(all, p.errors...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Pos.Offset < all[j].Pos.Offset
+	})
+	return all
+}
+
+// 记录一条指向tok的错误
+func (p *Parser) errorAt(tok token.Token, code diagnostic.Code, hint string, format string, a ...interface{}) {
+	// ILLEGAL已经由词法分析器报告过了
+	if tok.Type == token.ILLEGAL {
+		p.panicking = true
+		return
+	}
+
+	p.errorIn(tok.Pos, tok.End, code, hint, format, a...)
+}
+
+// 记录一条覆盖整个节点的错误
+func (p *Parser) errorAtNode(node ast.Node, code diagnostic.Code, hint string, format string, a ...interface{}) {
+	p.errorIn(node.Pos(), node.End(), code, hint, format, a...)
+}
+
+func (p *Parser) errorIn(pos, end token.Position, code diagnostic.Code, hint string, format string, a ...interface{}) {
+	if p.panicking {
+		return
+	}
+	p.panicking = true
+
+	p.errors = append(p.errors, diagnostic.Diagnostic{
+		Severity: diagnostic.Error,
+		Code:     code,
+		Message:  fmt.Sprintf(format, a...),
+		Pos:      pos,
+		End:      end,
+		Hint:     hint,
+	})
 }
 
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead",
-		t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	var hint string
+	switch {
+	case t == token.RPAREN || t == token.RBRACKET || t == token.RBRACE:
+		hint = fmt.Sprintf("did you forget a closing '%s'?", t)
+	case t == token.INTERP_END:
+		hint = "did you forget the closing '}' of a string interpolation?"
+	case t == token.ASSIGN && p.peekTokenIs(token.EQ):
+		hint = "use '=' to bind a value; '==' compares two values"
+	}
+
+	p.errorAt(p.peekToken, diagnostic.UnexpectedToken, hint,
+		"expected next token to be %s, got %s instead", t, p.peekToken.Type)
+}
+
+// tok为插值前面的一段字符串，以"${"结尾，错误指向"${"
+func (p *Parser) emptyInterpolationError(tok token.Token) {
+	pos := tok.End
+	pos.Offset -= 2
+	pos.Column -= 2
+	p.errorIn(pos, tok.End, diagnostic.EmptyInterpolation,
+		"put an expression inside '${}', or write '\\${' for a literal '${'", "empty interpolation")
 }
 
 func (p *Parser) noPrefixParseFnError(t token.Token) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t.Literal)
-	p.errors = append(p.errors, msg)
+	var hint string
+	if t.Type == token.ASSIGN {
+		hint = "use '==' to compare two values"
+	}
+
+	p.errorAt(t, diagnostic.NoPrefixParseFn, hint,
+		"no prefix parse function for %s found", t.Literal)
 }
@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 	"monkey/ast"
+	"monkey/diagnostic"
 	"monkey/lexer"
 	"testing"
 )
@@ -42,6 +43,128 @@ func TestLetStatements(t *testing.T) {
 
 }
 
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []struct {
+		input         string
+		expected      string
+		expectedNames []string
+	}{
+		{"let [a, b] = pair;", "let [a, b] = pair;", []string{"a", "b"}},
+		{"let [a, ...rest] = arr;", "let [a, ...rest] = arr;", []string{"a", "rest"}},
+		{"let [...all] = arr;", "let [...all] = arr;", []string{"all"}},
+		{"let [] = arr;", "let [] = arr;", []string{}},
+		{"let {name, port: p} = cfg;", "let {name, port: p} = cfg;", []string{"name", "p"}},
+		{"let {a,} = h;", "let {a} = h;", []string{"a"}},
+		{"let [a, [b, _], {c: [d]}] = x;", "let [a, [b, _], {c: [d]}] = x;", []string{"a", "b", "d"}},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got=%d", len(program.Statements))
+		}
+		stmt, ok := program.Statements[0].(*ast.LetStatement)
+		if !ok {
+			t.Fatalf("stmt is not *ast.LetStatement. got=%T", program.Statements[0])
+		}
+		if stmt.Name != nil || stmt.Pattern == nil {
+			t.Fatalf("stmt is not a destructuring let. got=%s", stmt)
+		}
+		if stmt.String() != tt.expected {
+			t.Errorf("stmt.String() wrong. expected=%q, got=%q", tt.expected, stmt.String())
+		}
+
+		names := ast.PatternNames(stmt.Pattern)
+		if len(names) != len(tt.expectedNames) {
+			t.Fatalf("wrong number of names. want=%d, got=%d", len(tt.expectedNames), len(names))
+		}
+		for i, name := range tt.expectedNames {
+			testIdentifier(t, names[i], name)
+		}
+	}
+}
+
+func TestMatchExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"match (x) { 1 => a, _ => b }", "match (x) { 1 => a, _ => b }"},
+		{"match (x) { -1.5 => a, \"s\" => b, true => c, null => d, }", "match (x) { (-1.5) => a, s => b, true => c, null => d }"},
+		{"match (f(x)) { [a, ...r] if a > 0 => a + 1 }", "match (f(x)) { [a, ...r] if (a > 0) => (a + 1) }"},
+		{"match (x) { {type: \"add\", lhs} => lhs }", "match (x) { {type: add, lhs} => lhs }"},
+		{"match (x) {}", "match (x) {  }"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	l := lexer.New("match (x) { [a, 1] if a => a, n => 0 }")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.MatchExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.MatchExpression. got=%T", stmt.Expression)
+	}
+	testIdentifier(t, exp.Subject, "x")
+	if len(exp.Arms) != 2 {
+		t.Fatalf("exp.Arms has wrong length. want=2, got=%d", len(exp.Arms))
+	}
+	array, ok := exp.Arms[0].Pattern.(*ast.ArrayPattern)
+	if !ok {
+		t.Fatalf("exp.Arms[0].Pattern is not ast.ArrayPattern. got=%T", exp.Arms[0].Pattern)
+	}
+	if _, ok := array.Elements[1].(*ast.LiteralPattern); !ok {
+		t.Errorf("array.Elements[1] is not ast.LiteralPattern. got=%T", array.Elements[1])
+	}
+	testIdentifier(t, exp.Arms[0].Guard, "a")
+	if _, ok := exp.Arms[1].Pattern.(*ast.Identifier); !ok || exp.Arms[1].Guard != nil {
+		t.Errorf("exp.Arms[1] is not an unguarded binding. got=%s", exp.Arms[1])
+	}
+}
+
+func TestTryExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { f() } catch (e) { g(e) }", "try { f() } catch (e) { g(e) }"},
+		{"try { f() } catch { 0 }", "try { f() } catch { 0 }"},
+		{"try { f() } finally { close() }", "try { f() } finally { close() }"},
+		{"let x = try { f(); 1 } catch (e) { 0 } finally { g() };", "let x = try { f()1 } catch (e) { 0 } finally { g() };"},
+		{"throw e + 1;", "throw (e + 1);"},
+		{"fn() { throw {\"code\": 1} }", "fn()throw {code:1};"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+}
+
 func testLetStatement(t *testing.T, s ast.Statement, name string) bool {
 	if s.TokenLiteral() != "let" {
 		t.Errorf("s.TokenLiteral not 'let'. got=%q", s.TokenLiteral())
@@ -159,6 +282,72 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	testIntegerLiteral(t, stmt.Expression, int64(5))
 }
 
+func TestPrefixedIntegerLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"0xff;", 255},
+		{"0o17;", 15},
+		{"0b1010;", 10},
+		{"1_000_000;", 1000000},
+		{"0x_7FFF_FFFF_FFFF_FFFF;", 9223372036854775807},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		integ, ok := stmt.Expression.(*ast.IntegerLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.IntegerLiteral. got=%T", stmt.Expression)
+		}
+		if integ.Value != tt.expected {
+			t.Errorf("integ.Value not %d. got=%d", tt.expected, integ.Value)
+		}
+	}
+}
+
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14;", 3.14},
+		{"1e3;", 1000},
+		{"2.5E-1;", 0.25},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program has not enough statements. got=%d",
+				len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+				program.Statements[0])
+		}
+
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %g. got=%g", tt.expected, literal.Value)
+		}
+	}
+}
+
 func TestBooleanExpression(t *testing.T) {
 	input := "true;"
 	l := lexer.New(input)
@@ -336,6 +525,11 @@ func TestParsingInfixExpressions(t *testing.T) {
 		{"5 < 5;", 5, "<", 5},
 		{"5 == 5;", 5, "==", 5},
 		{"5 != 5;", 5, "!=", 5},
+		{"5 % 5;", 5, "%", 5},
+		{"5 <= 5;", 5, "<=", 5},
+		{"5 >= 5;", 5, ">=", 5},
+		{"true && false", true, "&&", false},
+		{"true || false", true, "||", false},
 		{"true == true", true, "==", true},
 		{"true != false", true, "!=", false},
 		{"false == false", false, "==", false},
@@ -471,6 +665,38 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
+		{
+			"a <= b == c >= d",
+			"((a <= b) == (c >= d))",
+		},
+		{
+			"a || b && c",
+			"(a || (b && c))",
+		},
+		{
+			"a == b && c < d || !e",
+			"(((a == b) && (c < d)) || (!e))",
+		},
+		{
+			"a | b & c ^ d",
+			"((a | (b & c)) ^ d)",
+		},
+		{
+			"a & b == c",
+			"((a & b) == c)",
+		},
+		{
+			"1 << 2 + 3 >> 1",
+			"((1 << 2) + (3 >> 1))",
+		},
+		{
+			"~a & -b",
+			"((~a) & (-b))",
+		},
 	}
 
 	for _, tt := range tests {
@@ -532,6 +758,230 @@ func TestIfExpression(t *testing.T) {
 
 }
 
+func TestLoopStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"while (x < 10) { x; }", "while (x < 10) x"},
+		{"while (true) { break; continue; }", "while true break;continue;"},
+		{"for (let i = 0; i < 10; i + 1) { i }", "for (let i = 0; (i < 10); (i + 1)) i"},
+		{"for (;;) { break }", "for (; ; ) break;"},
+		{"for (; x;) {}", "for (; x; ) "},
+		{"for (x in [1, 2]) { x }", "for (x in [1, 2]) x"},
+		{"for (c in \"abc\") { c; } 5", "for (c in abc) c5"},
+		{"while (false) { 1 }; 5", "while false 15"},
+		{"for (x in [1]) { x };", "for (x in [1]) x"},
+		{"for (;;) { break };", "for (; ; ) break;"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+}
+
+func TestAssignExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5", "x = 5"},
+		{"x = y + 1 * 2", "x = (y + (1 * 2))"},
+		{"x = y = z", "x = y = z"},
+		{"x += 1", "x += 1"},
+		{"x -= y *= 2", "x -= y *= 2"},
+		{"x /= a || b", "x /= (a || b)"},
+		{"let a = b = 1;", "let a = b = 1;"},
+		{"f(x = 1)", "f(x = 1)"},
+		{"a[0] = 1", "(a[0]) = 1"},
+		{"h[\"k\"][i + 1] += 2", "((h[k])[(i + 1)]) += 2"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	l := lexer.New("x *= 2")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.AssignExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.AssignExpression. got=%T", stmt.Expression)
+	}
+	if !testIdentifier(t, exp.Target, "x") {
+		return
+	}
+	if exp.Operator != "*=" {
+		t.Errorf("exp.Operator is not '*='. got=%q", exp.Operator)
+	}
+	testIntegerLiteral(t, exp.Value, 2)
+}
+
+func TestMemberExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a.b", "(a.b)"},
+		{"a.b.c", "((a.b).c)"},
+		{"-a.b", "(-(a.b))"},
+		{"a.b + c.d * 2", "((a.b) + ((c.d) * 2))"},
+		{"cfg.server.port", "((cfg.server).port)"},
+		{"\"abc\".upper()", "(abc.upper)()"},
+		{"[1, 2].map(f)[0]", "(([1, 2].map)(f)[0])"},
+		{"h.x = 1", "(h.x) = 1"},
+		{"h.n += a.b", "(h.n) += (a.b)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	l := lexer.New("a.b")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.MemberExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.MemberExpression. got=%T", stmt.Expression)
+	}
+	if !testIdentifier(t, exp.Object, "a") {
+		return
+	}
+	testIdentifier(t, exp.Property, "b")
+}
+
+func TestNullAndOptionalChaining(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"null", "null"},
+		{"x == null", "(x == null)"},
+		{"a ?? b", "(a ?? b)"},
+		{"a ?? b ?? c", "((a ?? b) ?? c)"},
+		{"a ?? b || c", "(a ?? (b || c))"},
+		{"x = a ?? 1", "x = (a ?? 1)"},
+		{"a?.b", "(a?.b)"},
+		{"a?.b.c", "((a?.b).c)"},
+		{"a?[0]", "(a?[0])"},
+		{"a?.b?[i + 1]", "((a?.b)?[(i + 1)])"},
+		{"a?.f(1) ?? 0", "((a?.f)(1) ?? 0)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+}
+
+func TestInterpolatedString(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"hello ${name}"`, "hello ${name}"},
+		{`"${a + 1}${b}"`, "${(a + 1)}${b}"},
+		{`"x=${f(x, "${y}")}!"`, "x=${f(x, ${y})}!"},
+		{`"${h["k"]}"`, "${(h[k])}"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	l := lexer.New(`"a ${x} b ${y + 1}"`)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.InterpolatedString)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.InterpolatedString. got=%T", stmt.Expression)
+	}
+	if len(exp.Parts) != 4 {
+		t.Fatalf("exp.Parts has wrong length. want=4, got=%d", len(exp.Parts))
+	}
+	if lit, ok := exp.Parts[0].(*ast.StringLiteral); !ok || lit.Value != "a " {
+		t.Errorf("exp.Parts[0] is not \"a \". got=%s", exp.Parts[0])
+	}
+	testIdentifier(t, exp.Parts[1], "x")
+	testInfixExpression(t, exp.Parts[3], "y", "+", 1)
+}
+
+func TestForInStatement(t *testing.T) {
+	input := `for (x in arr) { x }`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ForInStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ForInStatement. got=%T",
+			program.Statements[0])
+	}
+	if !testIdentifier(t, stmt.Variable, "x") {
+		return
+	}
+	if !testIdentifier(t, stmt.Iterable, "arr") {
+		return
+	}
+	if len(stmt.Body.Statements) != 1 {
+		t.Errorf("body is not 1 statements. got=%d\n", len(stmt.Body.Statements))
+	}
+}
+
 func TestIfElseExpression(t *testing.T) {
 	input := `if (x < y) { x } else { y }`
 	l := lexer.New(input)
@@ -628,6 +1078,53 @@ func TestFunctionLiteralParsing(t *testing.T) {
 
 }
 
+func TestMacroLiteralParsing(t *testing.T) {
+	input := `macro(x, y) { x + y; }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	macro, ok := stmt.Expression.(*ast.MacroLiteral)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.MacroLiteral. got=%T",
+			stmt.Expression)
+	}
+
+	if len(macro.Parameters) != 2 {
+		t.Fatalf("macro literal parameters wrong. want 2, got=%d\n",
+			len(macro.Parameters))
+	}
+
+	testLiteralExpression(t, macro.Parameters[0], "x")
+	testLiteralExpression(t, macro.Parameters[1], "y")
+
+	if len(macro.Body.Statements) != 1 {
+		t.Fatalf("macro.Body.Statements has not 1 statements. got=%d\n",
+			len(macro.Body.Statements))
+	}
+
+	bodyStmt, ok := macro.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("macro body stmt is not ast.ExpressionStatement. got=%T",
+			macro.Body.Statements[0])
+	}
+
+	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
+}
+
 func TestFunctionParameterParsing(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -657,6 +1154,74 @@ func TestFunctionParameterParsing(t *testing.T) {
 	}
 }
 
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		minArgs  int
+	}{
+		{"fn(a, b = 1) {}", "fn(a,b = 1)", 1},
+		{"fn(a = 1, b = a + 1) {}", "fn(a = 1,b = (a + 1))", 0},
+		{"fn(...rest) {}", "fn(...rest)", 0},
+		{"fn(a, b = [], ...rest) {}", "fn(a,b = [],...rest)", 1},
+		{"fn(a,) {}", "fn(a)", 1},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		function := stmt.Expression.(*ast.FunctionLiteral)
+
+		if function.String() != tt.expected {
+			t.Errorf("function.String() wrong. want=%q, got=%q", tt.expected, function.String())
+		}
+		if len(function.Defaults) != len(function.Parameters) {
+			t.Fatalf("function.Defaults has wrong length. want=%d, got=%d",
+				len(function.Parameters), len(function.Defaults))
+		}
+		minArgs := 0
+		for _, d := range function.Defaults {
+			if d == nil {
+				minArgs++
+			}
+		}
+		if minArgs != tt.minArgs {
+			t.Errorf("wrong number of required parameters. want=%d, got=%d", tt.minArgs, minArgs)
+		}
+	}
+}
+
+func TestSpreadArguments(t *testing.T) {
+	input := "f(1, ...xs, ...g(y))"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.CallExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.CallExpression. got=%T", stmt.Expression)
+	}
+	if len(exp.Arguments) != 3 {
+		t.Fatalf("wrong length of arguments. got=%d", len(exp.Arguments))
+	}
+	testLiteralExpression(t, exp.Arguments[0], 1)
+	spread, ok := exp.Arguments[1].(*ast.SpreadExpression)
+	if !ok {
+		t.Fatalf("exp.Arguments[1] is not ast.SpreadExpression. got=%T", exp.Arguments[1])
+	}
+	testIdentifier(t, spread.Value, "xs")
+	if exp.String() != "f(1, ...xs, ...g(y))" {
+		t.Errorf("exp.String() wrong. got=%q", exp.String())
+	}
+}
+
 func TestCallExpressionParsing(t *testing.T) {
 	input := "add(1, 2 * 3, 4 + 5);"
 
@@ -888,3 +1453,352 @@ func TestFunctionLiteralWithName(t *testing.T) {
 	}
 
 }
+
+func TestNodeSpans(t *testing.T) {
+	input := `let add = fn(a, b) {
+  a + b
+};
+add(1, [2, 3][0])`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d",
+			len(program.Statements))
+	}
+
+	let := program.Statements[0].(*ast.LetStatement)
+	fn := let.Value.(*ast.FunctionLiteral)
+	body := fn.Body.Statements[0].(*ast.ExpressionStatement).Expression
+	call := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.CallExpression)
+	index := call.Arguments[1]
+
+	tests := []struct {
+		node                   ast.Node
+		startLine, startColumn int
+		endLine, endColumn     int
+	}{
+		{let, 1, 1, 3, 2},
+		{fn, 1, 11, 3, 2},
+		{body, 2, 3, 2, 8},
+		{call, 4, 1, 4, 18},
+		{index, 4, 8, 4, 17},
+		{program, 1, 1, 4, 18},
+	}
+
+	for i, tt := range tests {
+		pos, end := tt.node.Pos(), tt.node.End()
+		if pos.Line != tt.startLine || pos.Column != tt.startColumn {
+			t.Errorf("tests[%d] - %q start wrong. want=%d:%d, got=%s",
+				i, tt.node, tt.startLine, tt.startColumn, pos)
+		}
+		if end.Line != tt.endLine || end.Column != tt.endColumn {
+			t.Errorf("tests[%d] - %q end wrong. want=%d:%d, got=%s",
+				i, tt.node, tt.endLine, tt.endColumn, end)
+		}
+	}
+}
+
+func TestParserDiagnostics(t *testing.T) {
+	tests := []struct {
+		input        string
+		code         diagnostic.Code
+		message      string
+		line, column int
+		hint         string
+	}{
+		{
+			"let x = (5;",
+			diagnostic.UnexpectedToken,
+			"expected next token to be ), got ; instead",
+			1, 11,
+			"did you forget a closing ')'?",
+		},
+		{
+			"let x == 5;",
+			diagnostic.UnexpectedToken,
+			"expected next token to be =, got == instead",
+			1, 7,
+			"use '=' to bind a value; '==' compares two values",
+		},
+		{
+			"\n  ;",
+			diagnostic.NoPrefixParseFn,
+			"no prefix parse function for ; found",
+			2, 3,
+			"",
+		},
+		{
+			"let x = 1;\nf(x) = 2;",
+			diagnostic.InvalidAssign,
+			"cannot assign to f(x)",
+			2, 1,
+			"",
+		},
+		{
+			"a?.b = 1",
+			diagnostic.InvalidAssign,
+			"cannot assign to (a?.b)",
+			1, 1,
+			"",
+		},
+		{
+			"a ? b",
+			diagnostic.IllegalCharacter,
+			"unexpected character '?'",
+			1, 3,
+			"",
+		},
+		{
+			`"a ${x y}"`,
+			diagnostic.UnexpectedToken,
+			"expected next token to be INTERP_END, got IDENT instead",
+			1, 8,
+			"did you forget the closing '}' of a string interpolation?",
+		},
+		{
+			`"${}"`,
+			diagnostic.EmptyInterpolation,
+			"empty interpolation",
+			1, 2,
+			"put an expression inside '${}', or write '\\${' for a literal '${'",
+		},
+		{
+			`"a ${x} b ${ }"`,
+			diagnostic.EmptyInterpolation,
+			"empty interpolation",
+			1, 11,
+			"put an expression inside '${}', or write '\\${' for a literal '${'",
+		},
+		{
+			"let [a, b, a] = arr;",
+			diagnostic.DuplicateName,
+			"duplicate name a in pattern",
+			1, 12,
+			"",
+		},
+		{
+			"let {x: y, y} = h;",
+			diagnostic.DuplicateName,
+			"duplicate name y in pattern",
+			1, 12,
+			"",
+		},
+		{
+			"let [...rest, a] = arr;",
+			diagnostic.UnexpectedToken,
+			"expected next token to be ], got , instead",
+			1, 13,
+			"did you forget a closing ']'?",
+		},
+		{
+			"let [a b] = arr;",
+			diagnostic.UnexpectedToken,
+			"expected next token to be ,, got IDENT instead",
+			1, 8,
+			"",
+		},
+		{
+			"fn(a = 1, b) {}",
+			diagnostic.MissingDefault,
+			"parameter b without default follows parameter with default",
+			1, 11,
+			"give it a default value or move it before the parameters with defaults",
+		},
+		{
+			"fn(...rest, a) {}",
+			diagnostic.UnexpectedToken,
+			"expected next token to be ), got , instead",
+			1, 11,
+			"did you forget a closing ')'?",
+		},
+		{
+			"fn(1) {}",
+			diagnostic.UnexpectedToken,
+			"expected next token to be IDENT, got INT instead",
+			1, 4,
+			"",
+		},
+		{
+			"let [a, 1] = x;",
+			diagnostic.InvalidPattern,
+			"unexpected 1 in pattern",
+			1, 9,
+			"literal patterns can only be used in match",
+		},
+		{
+			"match (x) { [a, a] => 1 }",
+			diagnostic.DuplicateName,
+			"duplicate name a in pattern",
+			1, 17,
+			"",
+		},
+		{
+			"match (x) { a + 1 => 1 }",
+			diagnostic.UnexpectedToken,
+			"expected next token to be =>, got + instead",
+			1, 15,
+			"",
+		},
+		{
+			"match (x) { (a) => 1 }",
+			diagnostic.InvalidPattern,
+			"unexpected ( in pattern",
+			1, 13,
+			"",
+		},
+		{
+			"match (x) { - a => 1 }",
+			diagnostic.UnexpectedToken,
+			"expected next token to be INT, got IDENT instead",
+			1, 15,
+			"",
+		},
+		{
+			"let x = try { f() };",
+			diagnostic.MissingHandler,
+			"try without catch or finally",
+			1, 9,
+			"add a catch or finally block after the try block",
+		},
+		{
+			"try { f() } catch e { 1 }",
+			diagnostic.UnexpectedToken,
+			"expected next token to be {, got IDENT instead",
+			1, 19,
+			"",
+		},
+		{
+			"a.1",
+			diagnostic.UnexpectedToken,
+			"expected next token to be IDENT, got INT instead",
+			1, 3,
+			"",
+		},
+		{
+			"let x = 9223372036854775808;",
+			diagnostic.IntegerOverflow,
+			"integer literal 9223372036854775808 overflows int64",
+			1, 9,
+			"the largest integer is 9223372036854775807",
+		},
+		{
+			"let x = 1; /* 未闭合",
+			diagnostic.UnterminatedComment,
+			"unterminated block comment",
+			1, 12,
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q, got none", tt.input)
+		}
+
+		d := errors[0]
+		if d.Severity != diagnostic.Error {
+			t.Errorf("wrong severity. want=%s, got=%s", diagnostic.Error, d.Severity)
+		}
+		if d.Code != tt.code {
+			t.Errorf("wrong code. want=%s, got=%s", tt.code, d.Code)
+		}
+		if d.Message != tt.message {
+			t.Errorf("wrong message. want=%q, got=%q", tt.message, d.Message)
+		}
+		if d.Pos.Line != tt.line || d.Pos.Column != tt.column {
+			t.Errorf("wrong position. want=%d:%d, got=%s", tt.line, tt.column, d.Pos)
+		}
+		if d.Hint != tt.hint {
+			t.Errorf("wrong hint. want=%q, got=%q", tt.hint, d.Hint)
+		}
+	}
+}
+
+func TestParserErrorRecovery(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedErrors []string
+		expectedStmts  []string
+	}{
+		{
+			"let x = (1 + 2; let y = 3;",
+			[]string{"1:15: error[E0101]: expected next token to be ), got ; instead"},
+			[]string{"let y = 3;"},
+		},
+		{
+			"let = 1; let y = 2; return ); z;",
+			[]string{
+				"1:5: error[E0101]: expected next token to be IDENT, got = instead",
+				"1:28: error[E0102]: no prefix parse function for ) found",
+			},
+			[]string{"let y = 2;", "z"},
+		},
+		{
+			"let f = fn(x) { let = 1; x }; let g = 2;",
+			[]string{"1:21: error[E0101]: expected next token to be IDENT, got = instead"},
+			[]string{"let f = fn<f>(x)x;", "let g = 2;"},
+		},
+		{
+			"if (x) { let y = ; } z",
+			[]string{"1:18: error[E0102]: no prefix parse function for ; found"},
+			[]string{"ifx ", "z"},
+		},
+		{
+			"fn(x) { x + }; 5",
+			[]string{"1:13: error[E0102]: no prefix parse function for } found"},
+			[]string{"fn(x)", "5"},
+		},
+		{
+			`let x = "a\qb"; let y = 1;`,
+			[]string{`1:11: error[E0003]: unknown escape sequence \q`},
+			[]string{"let y = 1;"},
+		},
+		{
+			"let @ = 1; 2",
+			[]string{"1:5: error[E0004]: unexpected character '@'"},
+			[]string{"2"},
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) != len(tt.expectedErrors) {
+			t.Errorf("wrong number of errors for %q. want=%d, got=%d: %v",
+				tt.input, len(tt.expectedErrors), len(errors), errors)
+			continue
+		}
+		for i, want := range tt.expectedErrors {
+			if errors[i].String() != want {
+				t.Errorf("errors[%d] wrong. want=%q, got=%q", i, want, errors[i].String())
+			}
+		}
+
+		if len(program.Statements) != len(tt.expectedStmts) {
+			t.Errorf("wrong number of statements for %q. want=%d, got=%d",
+				tt.input, len(tt.expectedStmts), len(program.Statements))
+			continue
+		}
+		for i, want := range tt.expectedStmts {
+			if program.Statements[i] == nil {
+				t.Fatalf("program.Statements[%d] is nil", i)
+			}
+			if program.Statements[i].String() != want {
+				t.Errorf("program.Statements[%d] wrong. want=%q, got=%q",
+					i, want, program.Statements[i].String())
+			}
+		}
+	}
+}
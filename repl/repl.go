@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"io"
 	"monkey/compiler"
+	"monkey/diagnostic"
+	"monkey/evaluator"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
 	"monkey/vm"
+	"strings"
 )
 
 const PROMPT = ">> "
@@ -21,6 +24,7 @@ func Start(in io.Reader, out io.Writer) {
 	// 用于保存全局变量
 	constants := []object.Object{}
 	globals := make([]object.Object, vm.GlobalsSize)
+	macroEnv := object.NewEnvironment() // 宏定义在各行之间保留
 	symbolTable := compiler.NewSymbolTable()
 	for i, v := range object.Builtins {
 		symbolTable.DefineBuiltin(i, v.Name)
@@ -39,7 +43,7 @@ func Start(in io.Reader, out io.Writer) {
 
 		program := p.ParseProgram()
 		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+			printDiagnostics(out, line, p.Errors())
 			continue
 		}
 
@@ -49,32 +53,54 @@ func Start(in io.Reader, out io.Writer) {
 		// 	io.WriteString(out, evaluated.Inspect())
 		// }
 
+		evaluator.DefineMacros(program, macroEnv)
+		expanded, err := evaluator.ExpandMacros(program, macroEnv)
+		if err != nil {
+			fmt.Fprintf(out, "Woops! Macro expansion failed:\n %s\n", err)
+			continue
+		}
+
 		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
+		err = comp.Compile(expanded)
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
 			continue
 		}
+		printDiagnostics(out, line, comp.Warnings())
 
 		code := comp.Bytecode()
 		constants = code.Constants // 更新constants，拿出来下次用
 
-		machine := vm.NewWithGlobalsStore(code, globals)
+		machine := vm.NewWithGlobalsStore(code, globals, vm.Config{})
 		err = machine.Run()
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
+			if exception, ok := err.(*object.Error); ok {
+				for _, line := range strings.SplitAfter(exception.StackTrace(), "\n") {
+					if line != "" {
+						io.WriteString(out, "   "+line)
+					}
+				}
+			}
 			continue
 		}
 
 		stackTop := machine.LastPoppedStackElem()
+		if stackTop == nil { // 只定义了宏的行没有值
+			continue
+		}
 		io.WriteString(out, stackTop.Inspect())
 
 		io.WriteString(out, "\n")
 	}
 }
 
-func printParserErrors(out io.Writer, errors []string) {
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+func printDiagnostics(out io.Writer, source string, diagnostics []diagnostic.Diagnostic) {
+	for _, d := range diagnostics {
+		for _, line := range strings.SplitAfter(d.Render(source), "\n") {
+			if line != "" {
+				io.WriteString(out, "\t"+line)
+			}
+		}
 	}
 }
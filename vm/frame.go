@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"fmt"
 	"monkey/code"
 	"monkey/object"
 )
@@ -10,6 +11,8 @@ type Frame struct {
 	cl          *object.Closure // 让Frame保持对Closure的支持
 	ip          int             // 指向该帧的命令指针
 	basePointer int             // 该帧执行完后恢复的命令指针值
+	loopBases   []int           // 每层循环开始时的栈高度，下标为循环的嵌套层数
+	tryBase     []int           // 运行各个OpTry时的栈指针，按槽号存放
 }
 
 func NewFrame(cl *object.Closure, basePointer int) *Frame {
@@ -24,15 +27,33 @@ func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
 
+// 记下第depth层循环开始时的栈高度
+func (f *Frame) markLoop(depth, sp int) {
+	for len(f.loopBases) <= depth {
+		f.loopBases = append(f.loopBases, 0)
+	}
+	f.loopBases[depth] = sp
+}
+
 // 每当pushFrame，就运行新进的指令
 func (vm *VM) currentFrame() *Frame {
 	return vm.frames[vm.framesIndex-1]
 }
 
-// 进入函数体时运行，将vm运行的指令推到新来的frame中
-func (vm *VM) pushFrame(f *Frame) {
+// 进入函数体时运行，将vm运行的指令推到新来的frame中。
+// 帧数组不够时翻倍增长，超过最大调用深度时报错
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= len(vm.frames) {
+		if vm.framesIndex >= vm.config.MaxFrames {
+			return fmt.Errorf("maximum call depth exceeded")
+		}
+		frames := make([]*Frame, min(len(vm.frames)*2, vm.config.MaxFrames))
+		copy(frames, vm.frames)
+		vm.frames = frames
+	}
 	vm.frames[vm.framesIndex] = f
 	vm.framesIndex++
+	return nil
 }
 
 func (vm *VM) popFrame() *Frame {
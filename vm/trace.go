@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"monkey/code"
+	"monkey/object"
+)
+
+// 调用栈很深时只记下最内层和最外层各traceEdge个帧，中间的帧合成一条
+const traceEdge = 10
+
+// 记下异常抛出时所有活动的帧，从内到外；重新抛出时保留第一次记下的调用栈
+func (vm *VM) recordTrace(exception *object.Error) {
+	if exception.Trace != nil {
+		return
+	}
+
+	n := vm.framesIndex
+	trace := make([]object.TraceEntry, 0, min(n, 2*traceEdge+1))
+	for i := n - 1; i >= 0; i-- {
+		if n > 2*traceEdge && i == n-1-traceEdge {
+			trace = append(trace, object.TraceEntry{Omitted: n - 2*traceEdge})
+			i = traceEdge // 跳到最外层的traceEdge个帧
+			continue
+		}
+
+		frame := vm.frames[i]
+		fn := frame.cl.Fn
+
+		name := fn.Name
+		switch {
+		case i == 0:
+			name = "<main>"
+		case name == "":
+			name = "<anonymous>"
+		}
+
+		offset := instructionStart(fn.Instructions, frame.ip)
+		trace = append(trace, object.TraceEntry{Function: name, Offset: offset, Line: fn.LineAt(offset)})
+	}
+	exception.Trace = trace
+}
+
+// 运行指令时ip已经越过了操作数，找到ip所在指令的开头；刚进入的帧ip为-1，算作0
+func instructionStart(ins code.Instructions, ip int) int {
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			break
+		}
+		width := 1
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if ip < i+width {
+			return i
+		}
+		i += width
+	}
+	return ip
+}
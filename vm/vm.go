@@ -1,16 +1,49 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"monkey/code"
 	"monkey/compiler"
 	"monkey/object"
+	"strings"
 )
 
-const StackSize = 2048
+// Config中没有设置的字段使用的默认值
+const StackSize = 65536
 const GlobalsSize = 65536
 const MaxFrames = 1024
 
+// 栈和帧开始时分配的大小，不够时翻倍增长到上限
+const initialStackSize = 256
+const initialFrames = 64
+
+// 虚拟机的资源上限。超出上限时返回运行时错误，而不是让宿主进程崩溃
+type Config struct {
+	StackSize   int // 栈的最大槽数
+	MaxFrames   int // 最大调用深度
+	GlobalsSize int // 全局变量的槽数
+
+	// 执行预算，0表示不限制。超出时中止运行，返回*object.AbortError
+	MaxInstructions int // 最多执行的指令条数
+	MaxAllocations  int // 最多创建的值，计算方法见object.Budget
+}
+
+// 把没有设置的字段换成默认值
+func (c Config) withDefaults() Config {
+	if c.StackSize <= 0 {
+		c.StackSize = StackSize
+	}
+	if c.MaxFrames <= 0 {
+		c.MaxFrames = MaxFrames
+	}
+	if c.GlobalsSize <= 0 {
+		c.GlobalsSize = GlobalsSize
+	}
+	return c
+}
+
 var (
 	True  = &object.Boolean{Value: true}
 	False = &object.Boolean{Value: false}
@@ -26,29 +59,44 @@ type VM struct {
 
 	frames      []*Frame
 	framesIndex int
+
+	config Config
+	budget *object.Budget // 本次运行的执行预算，没有限制时为nil
+
+	callErr error // 内置方法回调用户函数时发生的运行时错误，方法返回后再报告
 }
 
-func New(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+func New(bytecode *compiler.Bytecode, config Config) *VM {
+	config = config.withDefaults()
+
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		Handlers:     bytecode.Handlers,
+		Lines:        bytecode.Lines,
+	}
 	mainClosure := &object.Closure{Fn: mainFn} // 主函数一样视作闭包
 	mainFrame := NewFrame(mainClosure, 0)
 
-	frames := make([]*Frame, MaxFrames)
+	frames := make([]*Frame, min(initialFrames, config.MaxFrames))
 	frames[0] = mainFrame
 
 	return &VM{
 		constants: bytecode.Constants,
-		stack:     make([]object.Object, StackSize),
-		globals:   make([]object.Object, GlobalsSize),
+		stack:     make([]object.Object, min(initialStackSize, config.StackSize)),
+		globals:   make([]object.Object, config.GlobalsSize),
 		sp:        0,
 
 		frames:      frames,
 		framesIndex: 1,
+
+		config: config,
 	}
 }
 
-func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
-	vm := New(bytecode)
+// 使用外部传入的全局存储，全局变量的槽数以s的长度为准
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object, config Config) *VM {
+	config.GlobalsSize = len(s)
+	vm := New(bytecode, config)
 	vm.globals = s
 	return vm
 }
@@ -66,14 +114,42 @@ func (vm *VM) LastPoppedStackElem() object.Object {
 }
 
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+	if err := vm.ensureStack(vm.sp + 1); err != nil {
+		return err
 	}
 	vm.stack[vm.sp] = o
 	vm.sp++
 	return nil
 }
 
+// 保证栈至少有n个槽，不够时翻倍增长，超过上限时报错。
+// 栈增长后旧的切片不再更新，不能在可能增长栈的操作前后持有栈槽的指针
+func (vm *VM) ensureStack(n int) error {
+	if n <= len(vm.stack) {
+		return nil
+	}
+	if n > vm.config.StackSize {
+		return fmt.Errorf("stack overflow")
+	}
+
+	size := len(vm.stack) * 2
+	for size < n {
+		size *= 2
+	}
+	stack := make([]object.Object, min(size, vm.config.StackSize))
+	copy(stack, vm.stack)
+	vm.stack = stack
+	return nil
+}
+
+// 压入新创建的值，计入分配预算。内置函数的结果都按新创建的值计算
+func (vm *VM) pushAllocated(o object.Object) error {
+	if err := vm.budget.Allocate(o); err != nil {
+		return err
+	}
+	return vm.push(o)
+}
+
 func (vm *VM) pop() object.Object {
 	o := vm.stack[vm.sp-1]
 	vm.sp--
@@ -81,11 +157,81 @@ func (vm *VM) pop() object.Object {
 }
 
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// ctx被取消或超出Config中的执行预算时中止运行，返回*object.AbortError
+func (vm *VM) RunContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &object.AbortError{Err: err}
+	}
+	vm.budget = object.NewBudget(ctx, vm.config.MaxInstructions, vm.config.MaxAllocations, 0)
+	return vm.run(0)
+}
+
+// 执行指令，直到帧的数量降到stopAt或主函数执行完。
+// 内置方法回调用户函数时，以调用前的帧数为stopAt重入
+func (vm *VM) run(stopAt int) error {
+	for {
+		err := vm.execute(stopAt)
+		if err == nil {
+			return nil
+		}
+		// 交给try处理后从处理代码继续执行
+		err = vm.throw(err, stopAt)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 沿着帧向外寻找能处理异常的try，恢复进入try时的栈后压入异常值并跳到处理代码。
+// 只展开本次run的帧，找不到处理器时返回异常，由外层的run继续处理。
+// 异常可能离开抛出它的帧时记下调用栈；被catch接住的异常不需要
+func (vm *VM) throw(err error, stopAt int) error {
+	if _, ok := err.(*object.AbortError); ok { // 中止运行不交给try处理
+		vm.framesIndex = stopAt
+		return err
+	}
+
+	exception, ok := err.(*object.Error)
+	if !ok {
+		exception = &object.Error{Message: err.Error()}
+	}
+
+	for i := vm.framesIndex - 1; i >= stopAt; i-- {
+		frame := vm.frames[i]
+		handler, ok := frame.cl.Fn.FindHandler(frame.ip)
+		if !ok {
+			continue
+		}
+
+		var caught object.Object = exception
+		if handler.Finally {
+			vm.recordTrace(exception)
+		} else {
+			caught = exception.Caught()
+		}
+		vm.framesIndex = i + 1
+		vm.sp = frame.tryBase[handler.Slot]
+		frame.ip = handler.Target - 1
+		return vm.push(caught)
+	}
+
+	vm.recordTrace(exception)
+	vm.framesIndex = stopAt
+	return exception
+}
+
+func (vm *VM) execute(stopAt int) error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
-	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+	for vm.framesIndex > stopAt && vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		if err := vm.budget.Step(); err != nil {
+			return err
+		}
 		vm.currentFrame().ip++
 
 		ip = vm.currentFrame().ip
@@ -104,12 +250,46 @@ func (vm *VM) Run() error {
 		case code.OpSetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
-			vm.globals[globalIndex] = vm.pop()
+			if int(globalIndex) >= len(vm.globals) {
+				return fmt.Errorf("too many globals: limit is %d", len(vm.globals))
+			}
+			// 被闭包捕获的match或catch绑定装在Cell里，写入Cell让闭包也能看到
+			if cell, ok := vm.globals[globalIndex].(*object.Cell); ok {
+				cell.Value = vm.pop()
+			} else {
+				vm.globals[globalIndex] = vm.pop()
+			}
 		case code.OpGetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
+			if int(globalIndex) >= len(vm.globals) {
+				return fmt.Errorf("too many globals: limit is %d", len(vm.globals))
+			}
 
-			err := vm.push(vm.globals[globalIndex])
+			err := vm.push(deref(vm.globals[globalIndex]))
+			if err != nil {
+				return err
+			}
+		case code.OpBindGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+			if int(globalIndex) >= len(vm.globals) {
+				return fmt.Errorf("too many globals: limit is %d", len(vm.globals))
+			}
+			vm.globals[globalIndex] = vm.pop()
+		case code.OpGetGlobalCell:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+			if int(globalIndex) >= len(vm.globals) {
+				return fmt.Errorf("too many globals: limit is %d", len(vm.globals))
+			}
+
+			cell, ok := vm.globals[globalIndex].(*object.Cell)
+			if !ok {
+				cell = &object.Cell{Value: vm.globals[globalIndex]}
+				vm.globals[globalIndex] = cell
+			}
+			err := vm.push(cell)
 			if err != nil {
 				return err
 			}
@@ -122,6 +302,18 @@ func (vm *VM) Run() error {
 			// 将需要绑定的值弹出，并储存到相应位置
 			// 与全局绑定不同的是，局部绑定存储到栈中给函数预留的位置中
 			// 使用当前帧的基指针加上索引存储
+			// 被闭包捕获的局部变量装在Cell里，写入Cell让闭包也能看到
+			slot := &vm.stack[frame.basePointer+int(localIndex)]
+			if cell, ok := (*slot).(*object.Cell); ok {
+				cell.Value = vm.pop()
+			} else {
+				*slot = vm.pop()
+			}
+		case code.OpBindLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
 			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
 		case code.OpGetLocal:
 			localIndex := code.ReadUint8(ins[ip+1:])
@@ -129,7 +321,24 @@ func (vm *VM) Run() error {
 
 			frame := vm.currentFrame()
 
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			err := vm.push(deref(vm.stack[frame.basePointer+int(localIndex)]))
+			if err != nil {
+				return err
+			}
+		case code.OpGetLocalCell:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+
+			// 第一次被捕获时把局部变量原地换成Cell
+			slot := &vm.stack[frame.basePointer+int(localIndex)]
+			cell, ok := (*slot).(*object.Cell)
+			if !ok {
+				cell = &object.Cell{Value: *slot}
+				*slot = cell
+			}
+			err := vm.push(cell)
 			if err != nil {
 				return err
 			}
@@ -146,6 +355,21 @@ func (vm *VM) Run() error {
 			freeIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
 
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(deref(currentClosure.Free[freeIndex]))
+			if err != nil {
+				return err
+			}
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			currentClosure.Free[freeIndex].(*object.Cell).Value = vm.pop()
+		case code.OpGetFreeCell:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
 			currentClosure := vm.currentFrame().cl
 			err := vm.push(currentClosure.Free[freeIndex])
 			if err != nil {
@@ -176,6 +400,26 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.executeTailCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+		case code.OpCallSpread:
+			numPieces := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			numArgs, err := vm.spreadArguments(numPieces)
+			if err != nil {
+				return err
+			}
+			err = vm.executeCall(numArgs)
+			if err != nil {
+				return err
+			}
 		case code.OpReturnValue:
 			returnValue := vm.pop() // 函数返回的值
 
@@ -196,12 +440,14 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+			code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
 			}
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual,
+			code.OpLessThan, code.OpLessThanOrEqual:
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
@@ -222,7 +468,7 @@ func (vm *VM) Run() error {
 
 			array := vm.buildArray(vm.sp-int(numElements), vm.sp)
 			vm.sp = vm.sp - int(numElements) // 取出来就可以被覆盖了，移除所有数组元素
-			err := vm.push(array)
+			err := vm.pushAllocated(array)
 			if err != nil {
 				return err
 			}
@@ -232,8 +478,11 @@ func (vm *VM) Run() error {
 
 			// 类似Array处理
 			hash, err := vm.buildHash(vm.sp-int(numPairs), vm.sp)
+			if err != nil {
+				return err
+			}
 			vm.sp = vm.sp - int(numPairs)
-			err = vm.push(hash)
+			err = vm.pushAllocated(hash)
 			if err != nil {
 				return err
 			}
@@ -245,6 +494,34 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpGetMember:
+			nameIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			name := vm.constants[nameIndex].(*object.String).Value
+			err := vm.executeMember(vm.pop(), name)
+			if err != nil {
+				return err
+			}
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeSetIndex(left, index, value)
+			if err != nil {
+				return err
+			}
+		case code.OpDup:
+			n := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			for i := 0; i < n; i++ {
+				err := vm.push(vm.stack[vm.sp-n])
+				if err != nil {
+					return err
+				}
+			}
 		case code.OpJump:
 			pos := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip = pos - 1
@@ -255,6 +532,78 @@ func (vm *VM) Run() error {
 			if !isTruthy(condition) {
 				vm.currentFrame().ip = pos - 1
 			}
+		case code.OpConcat:
+			numParts := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			var out strings.Builder
+			for _, part := range vm.stack[vm.sp-numParts : vm.sp] {
+				out.WriteString(part.Inspect())
+			}
+			vm.sp = vm.sp - numParts
+
+			err := vm.pushAllocated(&object.String{Value: out.String()})
+			if err != nil {
+				return err
+			}
+		case code.OpDestructArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			hasRest := code.ReadUint8(ins[ip+3:]) == 1
+			vm.currentFrame().ip += 3
+
+			err := vm.executeDestructArray(vm.pop(), numElements, hasRest)
+			if err != nil {
+				return err
+			}
+		case code.OpDestructHash:
+			numKeys := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			keys := make([]object.Object, numKeys)
+			copy(keys, vm.stack[vm.sp-numKeys:vm.sp])
+			vm.sp = vm.sp - numKeys
+
+			err := vm.executeDestructHash(vm.pop(), keys)
+			if err != nil {
+				return err
+			}
+		case code.OpMatchArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			hasRest := code.ReadUint8(ins[ip+3:]) == 1
+			vm.currentFrame().ip += 3
+
+			array, ok := vm.pop().(*object.Array)
+			matched := ok && (len(array.Elements) == numElements ||
+				hasRest && len(array.Elements) > numElements)
+			err := vm.push(nativeBoolToBooleanObject(matched))
+			if err != nil {
+				return err
+			}
+		case code.OpMatchHash:
+			numKeys := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			keys := vm.stack[vm.sp-numKeys : vm.sp]
+			hash, matched := vm.stack[vm.sp-numKeys-1].(*object.Hash)
+			for _, key := range keys {
+				if !matched {
+					break
+				}
+				_, matched = hash.Pairs[key.(object.Hashable).HashKey()]
+			}
+			vm.sp = vm.sp - numKeys - 1
+
+			err := vm.push(nativeBoolToBooleanObject(matched))
+			if err != nil {
+				return err
+			}
+		case code.OpJumpNull, code.OpJumpNotNull:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+			isNull := vm.StackTop() == Null
+			if isNull == (op == code.OpJumpNull) {
+				vm.currentFrame().ip = pos - 1
+			}
 		case code.OpNull:
 			err := vm.push(Null)
 			if err != nil {
@@ -270,6 +619,61 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpBitNot:
+			err := vm.executeBitNotOperator()
+			if err != nil {
+				return err
+			}
+		case code.OpIter:
+			iterable := vm.pop()
+			iter, ok := object.NewIterator(iterable)
+			if !ok {
+				return fmt.Errorf("object is not iterable: %s", iterable.Type())
+			}
+			err := vm.push(iter)
+			if err != nil {
+				return err
+			}
+		case code.OpIterNext:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+			iter, ok := vm.StackTop().(*object.Iterator)
+			if !ok {
+				return fmt.Errorf("loop iterator missing from stack")
+			}
+			el, ok := iter.Next()
+			if !ok {
+				vm.pop()
+				vm.currentFrame().ip = pos - 1
+				break
+			}
+			err := vm.push(el)
+			if err != nil {
+				return err
+			}
+		case code.OpLoopMark:
+			depth := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+			vm.currentFrame().markLoop(depth, vm.sp)
+		case code.OpLoopUnwind:
+			depth := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+			vm.sp = vm.currentFrame().loopBases[depth]
+		case code.OpTry:
+			slot := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			frame := vm.currentFrame()
+			for len(frame.tryBase) <= slot {
+				frame.tryBase = append(frame.tryBase, 0)
+			}
+			frame.tryBase[slot] = vm.sp
+		case code.OpThrow:
+			value := vm.pop()
+			if err, ok := value.(*object.Error); ok { // finally运行完后重新抛出
+				return err
+			}
+			return object.NewException(value)
 		case code.OpPop:
 			vm.pop()
 		}
@@ -287,6 +691,12 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 	if leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ {
 		return vm.executeIntegerComparison(op, left, right)
 	}
+	if isNumber(left) && isNumber(right) {
+		return vm.executeFloatComparison(op, left, right)
+	}
+	if leftType == object.STRING_OBJ && rightType == object.STRING_OBJ {
+		return vm.executeStringComparison(op, left, right)
+	}
 
 	switch op {
 	case code.OpEqual:
@@ -299,6 +709,20 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 
 }
 
+func (vm *VM) executeStringComparison(op code.Opcode, left, right object.Object) error {
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+	default:
+		return fmt.Errorf("unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+	}
+}
+
 func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object) error {
 	leftValue := left.(*object.Integer).Value
 	rightValue := right.(*object.Integer).Value
@@ -310,12 +734,40 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object
 		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpLessThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
 
 }
 
+func (vm *VM) executeFloatComparison(op code.Opcode, left, right object.Object) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpLessThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
 		return True
@@ -332,6 +784,8 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	switch {
 	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
 		return vm.executeBinaryIntegerOperation(op, left, right)
+	case isNumber(left) && isNumber(right): // 整数和浮点数混合运算时按浮点数计算
+		return vm.executeBinaryFloatOperation(op, left, right)
 	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left, right)
 	}
@@ -353,7 +807,31 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 	case code.OpMul:
 		result = leftValue * rightValue
 	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
 		result = leftValue / rightValue
+	case code.OpMod:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = leftValue % rightValue
+	case code.OpBitAnd:
+		result = leftValue & rightValue
+	case code.OpBitOr:
+		result = leftValue | rightValue
+	case code.OpBitXor:
+		result = leftValue ^ rightValue
+	case code.OpShiftLeft:
+		if rightValue < 0 {
+			return fmt.Errorf("negative shift count: %d", rightValue)
+		}
+		result = leftValue << uint64(rightValue)
+	case code.OpShiftRight:
+		if rightValue < 0 {
+			return fmt.Errorf("negative shift count: %d", rightValue)
+		}
+		result = leftValue >> uint64(rightValue)
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
@@ -361,6 +839,45 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 	return vm.push(&object.Integer{Value: result})
 }
 
+func (vm *VM) executeBinaryFloatOperation(op code.Opcode, left, right object.Object) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	var result float64
+
+	switch op {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		result = leftValue / rightValue
+	case code.OpMod:
+		result = math.Mod(leftValue, rightValue)
+	default:
+		return fmt.Errorf("unknown float operator: %d", op)
+	}
+
+	return vm.push(&object.Float{Value: result})
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
+	}
+}
+
 func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
 	if op != code.OpAdd {
 		return fmt.Errorf("unknown string operator: %d", op)
@@ -369,7 +886,7 @@ func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Ob
 	leftValue := left.(*object.String).Value
 	rightValue := right.(*object.String).Value
 
-	return vm.push(&object.String{Value: leftValue + rightValue})
+	return vm.pushAllocated(&object.String{Value: leftValue + rightValue})
 
 }
 
@@ -388,21 +905,36 @@ func (vm *VM) executeBangOperator() error {
 	}
 }
 
-func (vm *VM) executeMinusOperator() error {
+func (vm *VM) executeBitNotOperator() error {
 	operand := vm.pop()
 
 	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+		return fmt.Errorf("unsupported type for bitwise not: %s", operand.Type())
 	}
 
 	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
+	return vm.push(&object.Integer{Value: ^value})
+}
+
+func (vm *VM) executeMinusOperator() error {
+	operand := vm.pop()
+
+	switch operand := operand.(type) {
+	case *object.Integer:
+		return vm.push(&object.Integer{Value: -operand.Value})
+	case *object.Float:
+		return vm.push(&object.Float{Value: -operand.Value})
+	default:
+		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	}
 }
 
 func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return vm.executeStringIndex(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndex(left, index)
 	default:
@@ -423,11 +955,27 @@ func (vm *VM) executeArrayIndex(array, index object.Object) error {
 	return vm.push(arrayObject.Elements[i])
 }
 
+func (vm *VM) executeStringIndex(str, index object.Object) error {
+	runes := str.(*object.String).Runes()
+	i := index.(*object.Integer).Value
+
+	max := int64(len(runes) - 1)
+
+	if i < 0 || i > max {
+		return vm.push(Null)
+	}
+
+	return vm.push(&object.String{Value: string(runes[i])})
+}
+
 func (vm *VM) executeHashIndex(hash, index object.Object) error {
 	hashObject := hash.(*object.Hash)
-	i := index.(object.Hashable).HashKey()
+	key, ok := index.(object.Hashable)
+	if !ok {
+		return fmt.Errorf("unusable as hash key: %s", index.Type())
+	}
 
-	pair, ok := hashObject.Pairs[i]
+	pair, ok := hashObject.Pairs[key.HashKey()]
 
 	if !ok {
 		return vm.push(Null)
@@ -436,6 +984,88 @@ func (vm *VM) executeHashIndex(hash, index object.Object) error {
 	return vm.push(pair.Value)
 }
 
+// 数组和hash原地修改；数组不会因为赋值而变长，越界是运行时错误
+func (vm *VM) executeSetIndex(left, index, value object.Object) error {
+	switch left := left.(type) {
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			return fmt.Errorf("array index must be INTEGER, got %s", index.Type())
+		}
+		if i.Value < 0 || i.Value >= int64(len(left.Elements)) {
+			return fmt.Errorf("index out of range: %d (array length %d)", i.Value, len(left.Elements))
+		}
+		left.Elements[i.Value] = value
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+		hashKey := key.HashKey()
+		if _, exists := left.Pairs[hashKey]; !exists {
+			if err := vm.budget.Grow(1); err != nil {
+				return err
+			}
+		}
+		left.Pairs[hashKey] = object.HashPair{Key: index, Value: value}
+	default:
+		return fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+
+	return vm.push(value)
+}
+
+// 倒序压栈，这样编译器可以按模式中名字的顺序逐个弹出保存
+func (vm *VM) executeDestructArray(value object.Object, numElements int, hasRest bool) error {
+	array, ok := value.(*object.Array)
+	if !ok {
+		return fmt.Errorf("cannot destructure %s with array pattern", value.Type())
+	}
+	length := len(array.Elements)
+	if hasRest && length < numElements {
+		return fmt.Errorf("wrong number of elements to destructure. got=%d, want at least %d", length, numElements)
+	}
+	if !hasRest && length != numElements {
+		return fmt.Errorf("wrong number of elements to destructure. got=%d, want=%d", length, numElements)
+	}
+
+	if hasRest {
+		rest := make([]object.Object, length-numElements)
+		copy(rest, array.Elements[numElements:])
+		err := vm.pushAllocated(&object.Array{Elements: rest})
+		if err != nil {
+			return err
+		}
+	}
+	for i := numElements - 1; i >= 0; i-- {
+		err := vm.push(array.Elements[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *VM) executeDestructHash(value object.Object, keys []object.Object) error {
+	hash, ok := value.(*object.Hash)
+	if !ok {
+		return fmt.Errorf("cannot destructure %s with hash pattern", value.Type())
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		key := keys[i].(object.Hashable)
+		pair, ok := hash.Pairs[key.HashKey()]
+		if !ok {
+			return fmt.Errorf("key not found in hash: %s", keys[i].Inspect())
+		}
+		err := vm.push(pair.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func isTruthy(obj object.Object) bool {
 	switch obj := obj.(type) {
 	case *object.Boolean:
@@ -486,23 +1116,112 @@ func (vm *VM) executeCall(numArgs int) error {
 		return vm.callClosure(callee, numArgs)
 	case *object.Builtin:
 		return vm.callBuiltin(callee, numArgs)
+	case *object.BoundMethod:
+		return vm.callMethod(callee, numArgs)
 	default:
 		return fmt.Errorf("calling non-function and non-built-in")
 	}
 }
 
+// 被调用的是闭包时，把它和实参移到当前帧的函数所在的位置，弹出当前帧后再调用，帧数不会增长；
+// 其他函数照常调用后直接返回
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok {
+		err := vm.executeCall(numArgs)
+		if err != nil {
+			return err
+		}
+		returnValue := vm.pop()
+		frame := vm.popFrame()
+		vm.sp = frame.basePointer - 1
+		return vm.push(returnValue)
+	}
+
+	// 参数个数不对时，错误应该报在当前帧里
+	minArgs, maxArgs := cl.Fn.Arity()
+	if err := object.CheckArity(minArgs, maxArgs, numArgs); err != nil {
+		return err
+	}
+
+	frame := vm.popFrame()
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = frame.basePointer + numArgs
+	return vm.callClosure(cl, numArgs)
+}
+
+// 把栈顶的数组逐个展开压栈，返回展开后的实参个数
+func (vm *VM) spreadArguments(numPieces int) (int, error) {
+	pieces := make([]object.Object, numPieces)
+	copy(pieces, vm.stack[vm.sp-numPieces:vm.sp])
+	vm.sp = vm.sp - numPieces
+
+	numArgs := 0
+	for _, piece := range pieces {
+		array, ok := piece.(*object.Array)
+		if !ok {
+			return 0, fmt.Errorf("spread argument must be ARRAY, got %s", piece.Type())
+		}
+		for _, el := range array.Elements {
+			err := vm.push(el)
+			if err != nil {
+				return 0, err
+			}
+		}
+		numArgs += len(array.Elements)
+	}
+	return numArgs, nil
+}
+
 func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
+	fn := cl.Fn
 
 	// 函数运行到Return时才退栈
-	if numArgs != cl.Fn.NumParameters {
-		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	minArgs, maxArgs := fn.Arity()
+	if err := object.CheckArity(minArgs, maxArgs, numArgs); err != nil {
+		return err
 	}
 
 	// 进入新的帧
 	frame := NewFrame(cl, vm.sp-numArgs) // vm.sp作为新帧的basePointer
-	vm.pushFrame(frame)
+	if err := vm.ensureStack(frame.basePointer + fn.NumLocals); err != nil {
+		return err
+	}
+	if err := vm.pushFrame(frame); err != nil {
+		return err
+	}
+
+	// 多出的实参收集成...rest数组，放在参数之后的槽里
+	var rest *object.Array
+	if fn.Variadic {
+		rest = &object.Array{Elements: []object.Object{}}
+		if numArgs > fn.NumParameters {
+			rest.Elements = append(rest.Elements, vm.stack[frame.basePointer+fn.NumParameters:vm.sp]...)
+			vm.sp = frame.basePointer + fn.NumParameters
+		}
+		if err := vm.budget.Allocate(rest); err != nil {
+			return err
+		}
+	}
 
-	vm.sp = frame.basePointer + cl.Fn.NumLocals // 下一个命令运行时，跳过给fn局部参数预留的槽
+	// 清空上次使用留下的值，否则残留的Cell会让OpSetLocal写进别的闭包里
+	for i := vm.sp; i < frame.basePointer+fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
+	if rest != nil {
+		vm.stack[frame.basePointer+fn.NumParameters] = rest
+	}
+
+	// 缺少默认参数时从第一个缺少的默认参数开始求值，否则直接跳到函数体
+	if len(fn.DefaultOffsets) > 0 {
+		if numArgs < fn.NumParameters {
+			frame.ip = fn.DefaultOffsets[numArgs-minArgs] - 1
+		} else {
+			frame.ip = fn.BodyOffset - 1
+		}
+	}
+
+	vm.sp = frame.basePointer + fn.NumLocals // 下一个命令运行时，跳过给fn局部参数预留的槽
 	// 除了预留槽以外，其他的依旧照常运行在vm.sp，只有使用local值时才会用到frame.basePointer
 
 	return nil
@@ -512,17 +1231,103 @@ func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp] // 直接取参数放到函数内运行
 
 	result := builtin.Fn(args...)
+	if err, ok := result.(*object.Error); ok { // 内置函数的错误和运行时错误一样抛出
+		return err
+	}
 
 	// 函数运行完退栈
 	vm.sp = vm.sp - 1 - numArgs
 
-	if result != nil {
-		vm.push(result)
-	} else {
-		vm.push(Null)
+	return vm.pushAllocated(nativeResult(result))
+}
+
+func (vm *VM) callMethod(method *object.BoundMethod, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp] // 回调用户函数时只使用vm.sp之上的栈，不会覆盖参数
+
+	result := method.Fn(vm.callFunction, method.Receiver, args...)
+	if vm.callErr != nil {
+		err := vm.callErr
+		vm.callErr = nil
+		return err
+	}
+	if err, ok := result.(*object.Error); ok {
+		return err
 	}
 
-	return nil
+	vm.sp = vm.sp - 1 - numArgs
+
+	return vm.pushAllocated(nativeResult(result))
+}
+
+// 提供给内置方法，在当前虚拟机上调用函数并运行到它返回
+func (vm *VM) callFunction(fn object.Object, args ...object.Object) object.Object {
+	if vm.callErr == nil {
+		vm.callErr = vm.runFunction(fn, args)
+	}
+	if vm.callErr != nil {
+		return &object.Error{Message: vm.callErr.Error()}
+	}
+	return vm.pop()
+}
+
+func (vm *VM) runFunction(fn object.Object, args []object.Object) error {
+	stopAt := vm.framesIndex
+
+	err := vm.push(fn)
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		err := vm.push(arg)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = vm.executeCall(len(args))
+	if err != nil {
+		return err
+	}
+	return vm.run(stopAt)
+}
+
+// 内置函数和方法返回的nil和布尔值换成虚拟机的单例，==比较的是指针
+func nativeResult(result object.Object) object.Object {
+	switch result := result.(type) {
+	case nil:
+		return Null
+	case *object.Boolean:
+		return nativeBoolToBooleanObject(result.Value)
+	default:
+		return result
+	}
+}
+
+// hash先按字符串键查找，找不到再查方法；其他类型只查方法
+func (vm *VM) executeMember(obj object.Object, name string) error {
+	hash, isHash := obj.(*object.Hash)
+	if isHash {
+		if pair, ok := hash.Pairs[(&object.String{Value: name}).HashKey()]; ok {
+			return vm.push(pair.Value)
+		}
+	}
+
+	if method, ok := object.GetMethod(obj, name); ok {
+		return vm.push(method)
+	}
+
+	if isHash {
+		return vm.push(Null)
+	}
+	return fmt.Errorf("unknown method %s for %s", name, obj.Type())
+}
+
+// 取出Cell中的值，其他对象原样返回
+func deref(obj object.Object) object.Object {
+	if cell, ok := obj.(*object.Cell); ok {
+		return cell.Value
+	}
+	return obj
 }
 
 func (vm *VM) pushClosure(constIndex int, numFree int) error {
@@ -544,5 +1349,5 @@ func (vm *VM) pushClosure(constIndex int, numFree int) error {
 	vm.sp = vm.sp - numFree
 
 	closure := &object.Closure{Fn: function, Free: free}
-	return vm.push(closure)
+	return vm.pushAllocated(closure)
 }
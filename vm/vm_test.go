@@ -1,13 +1,17 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"monkey/ast"
 	"monkey/compiler"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"strings"
 	"testing"
+	"time"
 )
 
 type vmTestCase struct {
@@ -31,10 +35,313 @@ func TestIntegerArithmetic(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"2.5", 2.5},
+		{"-2.5", -2.5},
+		{"1.5 + 1.5", 3.0},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2.0},
+		{"7 / 2.0", 3.5},
+		{"1e3 - 1", 999.0},
+		{"0.5 < 1", true},
+		{"2 > 1.5", true},
+		{"1 == 1.0", true},
+		{"1.5 != 1.5", false},
+		{`{1.0: "one", 0.5: "half"}[1]`, "one"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestComparisonAndLogicalOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"7.5 % 2", 1.5},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"2 >= 2", true},
+		{"1 >= 2", false},
+		{"1.5 >= 1", true},
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && 2", true},
+		{"1 > 2 || 3 > 2", true},
+		{"let f = fn() { puts(\"not short-circuited\"); 1 / 0 }; false && f()", false},
+		{"let f = fn() { 1 / 0 }; true || f()", true},
+	}
+	runVmTests(t, tests)
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"12 & 10", 8},
+		{"12 | 10", 14},
+		{"12 ^ 10", 6},
+		{"~0", -1},
+		{"~5", -6},
+		{"1 << 10", 1024},
+		{"1024 >> 3", 128},
+		{"-16 >> 2", -4},
+		{"0xFF & 0b1010 | 1 << 8", 266},
+	}
+	runVmTests(t, tests)
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 / 0", "division by zero"},
+		{"1 % 0", "division by zero"},
+		{"let x = 0; 10 / x", "division by zero"},
+		// 比较时先求值左边，右边的错误不会先报出来
+		{"(1 / 0) < -true", "division by zero"},
+		{"(1 / 0) <= -true", "division by zero"},
+		{"1 << -1", "negative shift count: -1"},
+		{"let n = -2; 8 >> n", "negative shift count: -2"},
+		{"~true", "unsupported type for bitwise not: BOOLEAN"},
+		{"for (x in 5) { x }", "object is not iterable: INTEGER"},
+		{"let a = [1]; a[1] = 2", "index out of range: 1 (array length 1)"},
+		{"let a = [1]; a[-1] = 2", "index out of range: -1 (array length 1)"},
+		{"let a = [1]; a[\"x\"] = 2", "array index must be INTEGER, got STRING"},
+		{"let s = \"abc\"; s[0] = \"x\"", "index assignment not supported: STRING"},
+		{"let h = {}; h[[]] = 1", "unusable as hash key: ARRAY"},
+		{"{}[[]]", "unusable as hash key: ARRAY"},
+		{"{[1]: 2}", "unusable as hash key: ARRAY"},
+		{"let h = {[1]: 2}; len(h)", "unusable as hash key: ARRAY"},
+		{"let [a, b] = [1]", "wrong number of elements to destructure. got=1, want=2"},
+		{"let [a, b, ...c] = [1]", "wrong number of elements to destructure. got=1, want at least 2"},
+		{"let [a] = 1", "cannot destructure INTEGER with array pattern"},
+		{"let {a} = [1]", "cannot destructure ARRAY with hash pattern"},
+		{`let {a, b} = {"a": 1}`, "key not found in hash: b"},
+		{"len(...5)", "spread argument must be ARRAY, got INTEGER"},
+		{"5.upper()", "unknown method upper for INTEGER"},
+		{"let h = {\"a\": null}; h?.a.b", "unknown method b for NULL"},
+		{"[1, 0].map(fn(x) { 1 / x })", "division by zero"},
+		{"fn() { [1].map(fn(x) { [0].map(fn(y) { x / y }) }) }()", "division by zero"},
+		{`throw "boom"`, "uncaught exception: boom"},
+		{`try { throw 1 } catch (e) { throw e + 1 }`, "uncaught exception: 2"},
+		{`try { throw [1] } finally { 2 }`, "uncaught exception: [1]"},
+		{"let f = fn(n) { f(n + 1) + 1 }; f(0)", "maximum call depth exceeded"},
+		{"let f = fn(n) { [n].map(fn(x) { f(x) }) }; f(0)", "maximum call depth exceeded"},
+		{`try { 1 / 0 } finally { 2 }`, "division by zero"},
+		{`let f = fn() { throw {"a": 1} }; [1].map(fn(x) { f() })`, "uncaught exception: {a:1}"},
+		{`len(1)`, "argument to `len` not supported, got INTEGER"},
+		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
+		{`bytes(1)`, "argument to `bytes` must be STRING, got INTEGER"},
+		{`first(1)`, "argument to `first` must be ARRAY, got INTEGER"},
+		{`last(1)`, "argument to `last` must be ARRAY, got INTEGER"},
+		{`push(1, 1)`, "argument to `push` must be ARRAY, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		input := tt.input
+		program := parse(input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode(), Config{})
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			"let add = fn(a, b) {\n  a + b\n};\nlet twice = fn(f) {\n  f(1)\n};\ntwice(add);",
+			"at twice (line 5, offset 5)\n" +
+				"at <main> (line 7, offset 20)\n",
+		},
+		{
+			"let div = fn(x) {\n  [1, 0].map(fn(y) {\n    x / y\n  })\n};\n\ndiv(1);",
+			"at <anonymous> (line 3, offset 4)\n" +
+				"at div (line 2, offset 18)\n" +
+				"at <main> (line 7, offset 13)\n",
+		},
+		{
+			"let f = fn() { throw \"boom\" };\ntry {\n  f()\n} finally {\n  1\n}",
+			"at f (line 1, offset 3)\n" +
+				"at <main> (line 3, offset 13)\n",
+		},
+		{
+			// 很深的调用栈只保留两头的帧
+			"let f = fn(n) {\n  if (n == 0) { throw \"deep\" }\n  1 + f(n - 1)\n};\nf(30);",
+			"at f (line 2, offset 12)\n" +
+				strings.Repeat("at f (line 3, offset 29)\n", 9) +
+				"... 12 more frames\n" +
+				strings.Repeat("at f (line 3, offset 29)\n", 9) +
+				"at <main> (line 5, offset 13)\n",
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode(), Config{})
+		err = vm.Run()
+		exception, ok := err.(*object.Error)
+		if !ok {
+			t.Fatalf("expected *object.Error for %q. got=%T (%v)", tt.input, err, err)
+		}
+		if exception.StackTrace() != tt.expected {
+			t.Errorf("wrong stack trace.\nwant=%q\ngot =%q", tt.expected, exception.StackTrace())
+		}
+	}
+}
+
+func TestConfigLimits(t *testing.T) {
+	tests := []struct {
+		input    string
+		config   Config
+		expected interface{} // 运行结果，string表示期望的错误
+	}{
+		// 栈和帧按需增长到默认上限
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(1000)", Config{}, 1000},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(1000)", Config{MaxFrames: 100}, "maximum call depth exceeded"},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(98)", Config{MaxFrames: 100}, 98},
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(1000)", Config{MaxFrames: 10}, 0},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(1000)", Config{StackSize: 64}, "stack overflow"},
+		{"[1, 2, 3, 4, 5, 6, 7, 8]", Config{StackSize: 4}, "stack overflow"},
+		{"let a = 1; let b = 2; a + b", Config{GlobalsSize: 1}, "too many globals: limit is 1"},
+		{"let a = 1; let b = 2; a + b", Config{GlobalsSize: 2}, 3},
+		{"let f = fn(n) { f(n + 1) + 1 }; try { f(0) } catch (e) { e.message }", Config{MaxFrames: 50}, "maximum call depth exceeded"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode(), tt.config)
+		err = vm.Run()
+		if message, ok := tt.expected.(string); ok && err != nil {
+			if err.Error() != message {
+				t.Errorf("wrong VM error for %q. want=%q, got=%q", tt.input, message, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestExecutionBudgets(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input    string
+		config   Config
+		ctx      context.Context
+		expected error // 期望的中止原因，nil表示正常运行完
+	}{
+		{"1 + 2", Config{MaxInstructions: 100}, context.Background(), nil},
+		{"let f = fn() { f() }; f()", Config{MaxInstructions: 10000}, context.Background(), object.ErrInstructionBudget},
+		{"try { while (true) {} } catch (e) { 1 } finally { 2 }", Config{MaxInstructions: 1000}, context.Background(), object.ErrInstructionBudget},
+		{"[1].map(fn(x) { while (true) {} })", Config{MaxInstructions: 1000}, context.Background(), object.ErrInstructionBudget},
+		{"let a = []; while (true) { a = push(a, 1) }", Config{MaxAllocations: 10000}, context.Background(), object.ErrAllocationBudget},
+		{`let s = ""; while (true) { s = s + "abc" }`, Config{MaxAllocations: 10000}, context.Background(), object.ErrAllocationBudget},
+		// hash中插入新键、剩余参数和解构剩余元素创建的数组也计入分配量
+		{"let h = {}; let i = 0; while (i < 200000) { h[i] = i; i += 1 }", Config{MaxAllocations: 1000}, context.Background(), object.ErrAllocationBudget},
+		{`let h = {"a": 0}; let i = 0; while (i < 2000) { h["a"] = i; i += 1 }`, Config{MaxAllocations: 1000}, context.Background(), nil},
+		{"let f = fn(...xs) { 0 }; while (true) { f(1, 2, 3) }", Config{MaxAllocations: 1000}, context.Background(), object.ErrAllocationBudget},
+		{"let a = [1, 2, 3]; while (true) { let [x, ...r] = a; }", Config{MaxAllocations: 1000}, context.Background(), object.ErrAllocationBudget},
+		{"[1, 2, 3]", Config{MaxAllocations: 4}, context.Background(), nil},
+		{"[1, 2, 3]", Config{MaxAllocations: 3}, context.Background(), object.ErrAllocationBudget},
+		{"1", Config{}, cancelled, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode(), tt.config)
+		err = vm.RunContext(tt.ctx)
+		if tt.expected == nil {
+			if err != nil {
+				t.Errorf("vm error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		var abort *object.AbortError
+		if !errors.As(err, &abort) || !errors.Is(err, tt.expected) {
+			t.Errorf("wrong error for %q. want abort with %q, got=%T (%v)", tt.input, tt.expected, err, err)
+		}
+	}
+}
+
+func TestRunContextTimeout(t *testing.T) {
+	program := parse("let f = fn() { f() }; f()")
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	vm := New(comp.Bytecode(), Config{})
+	err = vm.RunContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded. got=%T (%v)", err, err)
+	}
+
+	// 脚本自身的错误不是AbortError
+	program = parse("1 / 0")
+	comp = compiler.New()
+	err = comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm = New(comp.Bytecode(), Config{MaxInstructions: 100})
+	err = vm.RunContext(context.Background())
+	var abort *object.AbortError
+	if err == nil || errors.As(err, &abort) {
+		t.Fatalf("expected script error. got=%T (%v)", err, err)
+	}
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{"true", true},
 		{"false", false},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" == "b"`, false},
+		{`let s = "mon"; s + "key" == "monkey"`, true},
+		{`"1" == 1`, false},
 		{"1 < 2", true}, {"1 > 2", false}, {"1 < 1", false},
 		{"1 > 1", false},
 		{"1 == 1", true},
@@ -139,6 +446,11 @@ func TestIndexExpressions(t *testing.T) {
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
 		{"{}[0]", Null},
+		{`"abc"[1]`, "b"},
+		{`"héllo"[1]`, "é"},
+		{`"日本語"[2]`, "語"},
+		{`"abc"[3]`, Null},
+		{`"abc"[-1]`, Null},
 	}
 
 	runVmTests(t, tests)
@@ -364,6 +676,18 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 			input:    `fn(a, b) { a + b; }(1);`,
 			expected: `wrong number of arguments: want=2, got=1`,
 		},
+		{
+			input:    `fn(a, b = 1) { a + b; }(1, 2, 3);`,
+			expected: `wrong number of arguments: want 1 to 2, got=3`,
+		},
+		{
+			input:    `fn(a, ...b) { a; }();`,
+			expected: `wrong number of arguments: want at least 1, got=0`,
+		},
+		{
+			input:    `fn(a, b) { a + b; }(...[1, 2, 3]);`,
+			expected: `wrong number of arguments: want=2, got=3`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -374,7 +698,7 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 			t.Fatalf("compiler error: %s", err)
 		}
 
-		vm := New(comp.Bytecode())
+		vm := New(comp.Bytecode(), Config{})
 		err = vm.Run()
 		if err == nil {
 			t.Fatalf("expected VM error but resulted in none.")
@@ -385,6 +709,34 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	}
 }
 
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []vmTestCase{
+		{input: "let f = fn(a, b = 10) { a + b }; f(1)", expected: 11},
+		{input: "let f = fn(a, b = 10) { a + b }; f(1, 2)", expected: 3},
+		{input: "let f = fn(a = 1, b = a * 2) { a + b }; f()", expected: 3},
+		{input: "let f = fn(a = 1, b = a * 2) { a + b }; f(5)", expected: 15},
+		{input: "let f = fn(a, b = 0, c = 0) { a * 100 + b * 10 + c }; f(1, 2)", expected: 120},
+		{input: "let f = fn(a, b = fn() { a }) { b() }; f(7)", expected: 7},
+		{input: "let n = 0; let f = fn(a = n) { a }; n = 4; f()", expected: 4},
+		{input: "let f = fn(a = if (true) { return 5 }) { 1 }; f()", expected: 5},
+		{input: "let f = fn(a = (f = 3)) { a }; f(); f", expected: 3},
+		{input: "let f = fn(...xs) { len(xs) }; f()", expected: 0},
+		{input: "let f = fn(a, ...xs) { a + len(xs) * 10 }; f(1, 2, 3)", expected: 21},
+		{input: "let f = fn(a, b = 2, ...xs) { a + b + len(xs) }; f(1)", expected: 3},
+		{input: "let f = fn(a, b = 2, ...xs) { a + b + len(xs) }; f(1, 5, 0, 0)", expected: 8},
+		{input: "let sum = fn(...xs) { xs.reduce(fn(a, b) { a + b }, 0) }; sum(1, 2, 3, 4)", expected: 10},
+		{input: "let add = fn(a, b, c) { a + b * 10 + c * 100 }; let xs = [2, 3]; add(1, ...xs)", expected: 321},
+		{input: "let add = fn(a, b, c) { a + b * 10 + c * 100 }; add(...[1], 2, ...[3])", expected: 321},
+		{input: "let f = fn(...xs) { len(xs) }; f(...[], ...[1, 2], 3, ...[])", expected: 3},
+		{input: "len(...[[1, 2, 3]])", expected: 3},
+		{input: "[1, 2].reduce(...[fn(a, b) { a + b }, 10])", expected: 13},
+		{input: "let f = fn(...xs) { xs[0] = 9; 0 }; let a = [1]; f(...a); a[0]", expected: 1},
+		{input: "let fact = fn(n, acc = 1) { if (n < 2) { acc } else { fact(n - 1, acc * n) } }; fact(5)", expected: 120},
+		{input: "let f = fn(a, ...xs) { xs }; f(1, 2, 3)", expected: []int{2, 3}},
+	}
+	runVmTests(t, tests)
+}
+
 func TestBuiltinFunctionsSpecial(t *testing.T) {
 	tests := []vmTestCase{
 		{`push([], 1)`, []int{1}},
@@ -397,42 +749,20 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
-		{
-			`len(1)`,
-			&object.Error{
-				Message: "argument to `len` not supported, got INTEGER",
-			},
-		},
-		{`len("one", "two")`,
-			&object.Error{
-				Message: "wrong number of arguments. got=2, want=1",
-			},
-		},
+		{`len("é")`, 1},
+		{`len("日本語")`, 3},
 		{`len([1, 2, 3])`, 3},
 		{`len([])`, 0},
 		{`puts("hello", "world!")`, Null},
+		{`bytes("aé")`, []int{97, 195, 169}},
+		{`len(bytes("日本語"))`, 9},
 		{`first([1, 2, 3])`, 1},
 		{`first([])`, Null},
-		{`first(1)`,
-			&object.Error{
-				Message: "argument to `first` must be ARRAY, got INTEGER",
-			},
-		},
 		{`last([1, 2, 3])`, 3},
 		{`last([])`, Null},
-		{`last(1)`,
-			&object.Error{
-				Message: "argument to `last` must be ARRAY, got INTEGER",
-			},
-		},
 		{`rest([1, 2, 3])`, []int{2, 3}},
 		{`rest([])`, Null},
 		{`push([], 1)`, []int{1}},
-		{`push(1, 1)`,
-			&object.Error{
-				Message: "argument to `push` must be ARRAY, got INTEGER",
-			},
-		},
 	}
 	runVmTests(t, tests)
 }
@@ -584,6 +914,302 @@ func TestRecursiveFibonacci(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{input: "while (false) { 1 }; 5", expected: 5},
+		{input: "while (true) { break; } 5", expected: 5},
+		{input: "for (;;) { break; } 5", expected: 5},
+		{input: "for (let i = 0; false;) { 1 } i", expected: 0},
+		{input: "let f = fn(arr) { for (x in arr) { if (x > 2) { return x; } } -1 }; f([1, 2, 3, 4])", expected: 3},
+		{input: "let f = fn(arr) { for (x in arr) { if (x > 9) { return x; } } -1 }; f([1, 2, 3, 4])", expected: -1},
+		{input: "let f = fn(arr) { for (x in arr) { if (x % 2 == 1) { continue; } return x; } }; f([1, 3, 4, 5])", expected: 4},
+		{input: "for (x in [1, 2, 3]) { if (x == 2) { break; } } x", expected: 2},
+		{input: "for (c in \"héllo\") { } c", expected: "o"},
+		{input: "for (k in {\"b\": 2, \"a\": 1}) { break; } k", expected: "a"},
+		{input: "let f = fn(a) { for (x in a) { for (y in a) { if (x * y == 6) { return x * 10 + y; } } } }; f([1, 2, 3])", expected: 23},
+		{input: "let f = fn(arr) { let g = fn() { for (x in arr) { if (x > 1) { return x; } } }; g() }; f([1, 2, 3])", expected: 2},
+		{input: "fn() { for (x in [1]) { return 7; } }()", expected: 7},
+		{input: "fn() { for (x in [1]) { let y = x; } }()", expected: Null},
+		// break之后迭代器要从栈上弹出，否则栈会越来越高
+		{input: "for (x in [1, 2]) { for (y in [1, 2]) { break; } } 5", expected: 5},
+		// 表达式中间的break和continue要丢掉栈上已经算出的值
+		{input: "let f = fn() { for (x in [1, 2, 3]) { let y = [x, if (x > 1) { continue } else { 0 }]; } 5 }; f()", expected: 5},
+		{input: "for (x in [1, 2, 3]) { let y = [x, if (x == 2) { break } else { 0 }]; } x", expected: 2},
+		{input: "for (x in [1, 2, 3]) { let y = [if (x > 1) { continue } else { 0 }]; } y[0]", expected: 0},
+		{input: "let f = fn() { for (x in [1, 2, 3]) { let y = 1 + if (x == 2) { return x } else { 0 }; } }; f()", expected: 2},
+		{
+			// 1600次continue，每次留下两个值的话会超出栈的大小
+			input: `let s = "0123456789012345678901234567890123456789";
+			for (a in s) { for (b in s) { let y = [1, 2, if (true) { continue }]; } }
+			5`,
+			expected: 5,
+		},
+		// 循环语句的值是null
+		{input: "5; while (false) { 1 }", expected: Null},
+		{input: "5; for (let i = 0; false;) { 1 }", expected: Null},
+		{input: "5; for (x in [1, 2]) { x }", expected: Null},
+		{
+			// 一万次迭代，递归实现会超出MaxFrames
+			input: `let d = [0, 1, 2, 3, 4, 5, 6, 7, 8, 9];
+			let f = fn() {
+				for (a in d) { for (b in d) { for (c in d) { for (e in d) {
+					if (a * 1000 + b * 100 + c * 10 + e == 9999) { return 9999; }
+				} } } }
+			};
+			f()`,
+			expected: 9999,
+		},
+	}
+	runVmTests(t, tests)
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{input: "let a = 1; a = 2; a", expected: 2},
+		{input: "let a = 1; a = 2", expected: 2},
+		{input: "let a = 1; let b = 0; a = b = 3; a + b", expected: 6},
+		{input: "let a = 10; a += 5; a -= 3; a *= 2; a /= 4; a", expected: 6},
+		{input: "let a = 1.5; a *= 2; a", expected: 3.0},
+		{input: "let s = \"a\"; s += \"b\"; s", expected: "ab"},
+		{input: "fn() { let a = 1; a += 1; a }()", expected: 2},
+		{input: "let i = 0; let sum = 0; while (i < 100) { i += 1; sum += i; } sum", expected: 5050},
+		{input: "let sum = 0; for (let i = 0; i < 10; i += 1) { if (i % 2 == 0) { continue; } sum += i; } sum", expected: 25},
+		{input: "let n = 0; for (x in [1, 2, 3]) { n = n * 10 + x; } n", expected: 123},
+		{input: "fn() { let i = 0; while (true) { i += 1; if (i == 10000) { break; } } i }()", expected: 10000},
+		// 闭包修改外层的变量
+		{input: "let c = 0; let inc = fn() { c += 1 }; inc(); inc(); c", expected: 2},
+		{input: "let counter = fn() { let n = 0; fn() { n += 1; n } }; let c = counter(); c(); c(); c()", expected: 3},
+		{input: "let f = fn() { let x = 1; let g = fn() { x = 5 }; g(); x }; f()", expected: 5},
+		{input: "let f = fn() { let x = 1; let g = fn() { x }; x = 7; g() }; f()", expected: 7},
+		{input: "let f = fn() { let x = 1; let g = fn() { let h = fn() { x = 5 }; h() }; g(); x }; f()", expected: 5},
+		// 函数体中给函数自己的名字赋值，写到let定义的变量上
+		{input: "let f = fn() { f = 1; f }; f()", expected: 1},
+		{input: "let f = fn() { fn() { f = 1 } }; f()(); f", expected: 1},
+		{input: "let g = fn() { let f = fn() { f = 2; f }; f() + f }; g()", expected: 4},
+		{input: "let f = fn(n) { if (n == 0) { f = 5; return 0; } f(n - 1) }; f(3); f", expected: 5},
+		// 比较运算先求值左边
+		{input: `let s = ""; let a = fn() { s += "a"; 1 }; let b = fn() { s += "b"; 2 }; a() <= b(); b() < a(); s`, expected: "abba"},
+		{
+			// 两个计数器互不影响
+			input: `let counter = fn() { let n = 0; fn() { n += 1 } };
+			let a = counter(); let b = counter();
+			a(); a(); b();
+			[a(), b()]`,
+			expected: []int{3, 2},
+		},
+		{
+			// 再次调用同一个函数时，局部变量槽里不能残留上次的Cell
+			input: `let keep = [];
+			let f = fn(v) { let x = v; keep = push(keep, fn() { x }); x };
+			f(1); f(2);
+			[keep[0](), keep[1]()]`,
+			expected: []int{1, 2},
+		},
+	}
+	runVmTests(t, tests)
+}
+
+func TestIndexAssignExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{input: "let a = [1, 2, 3]; a[0] = 10; a", expected: []int{10, 2, 3}},
+		{input: "let a = [1, 2, 3]; a[1] = 5", expected: 5},
+		{input: "let a = [1, 2, 3]; a[2] *= 4; a[2]", expected: 12},
+		{input: "let h = {}; h[\"k\"] = 1; h[\"k\"] += 2; h", expected: map[object.HashKey]int64{
+			(&object.String{Value: "k"}).HashKey(): 3,
+		}},
+		{input: "let m = [[1, 2], [3, 4]]; m[1][0] = 9; m[1]", expected: []int{9, 4}},
+		{input: "fn() { let a = [0, 0]; for (let i = 0; i < 2; i += 1) { a[i] = i + 1; } a }()", expected: []int{1, 2}},
+		// 数组和hash按引用共享
+		{input: "let a = [1]; let b = a; b[0] = 2; a", expected: []int{2}},
+		{input: "let set = fn(arr) { arr[0] = 7 }; let a = [0]; set(a); a", expected: []int{7}},
+		{input: "let a = [1]; let b = push(a, 2); b[0] = 5; a", expected: []int{1}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{input: "let [a, b] = [1, 2]; a * 10 + b", expected: 12},
+		{input: "let [a, ...rest] = [1, 2, 3]; a + len(rest) * 10 + rest[1]", expected: 24},
+		{input: "let [...rest] = []; len(rest)", expected: 0},
+		{input: "let pair = [3, 4]; let [x, y] = pair; pair[0] = 9; x * y", expected: 12},
+		{input: "let [a, b] = [1, 2]; let [a, b] = [b, a]; a * 10 + b", expected: 21},
+		{input: `let cfg = {"name": 1, "port": 8080}; let {name, port: p} = cfg; name + p`, expected: 8081},
+		{input: `let {} = {"a": 1}; 5`, expected: 5},
+		{input: "fn(p) { let [a, b] = p; let f = fn() { a + b }; f() }([5, 6])", expected: 11},
+		{input: "let total = 0; for (p in [[1, 2], [3, 4]]) { let [a, b] = p; total += a * b; } total", expected: 14},
+		{input: "let [a, ...rest] = [1, 2, 3]; rest", expected: []int{2, 3}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestMatchExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{input: `match (1) { 1 => "one", _ => "other" }`, expected: "one"},
+		{input: `match (5) { 1 => "one", _ => "other" }`, expected: "other"},
+		{input: `match (-2) { -2 => "minus two", _ => "other" }`, expected: "minus two"},
+		{input: `match (2.0) { 2 => "two", _ => "other" }`, expected: "two"},
+		{input: `match ("b") { "a" => "A", "b" => "B" }`, expected: "B"},
+		{input: `match (null) { false => "false", null => "null" }`, expected: "null"},
+		{input: `match (true) { 1 => "one", true => "true" }`, expected: "true"},
+		{input: `match ("1") { 1 => "int", _ => "other" }`, expected: "other"},
+		{input: `match (7) { n => "n=${n}" }`, expected: "n=7"},
+		{input: `match ([1, 2]) { [a] => "one", [a, b] => "${a},${b}", _ => "many" }`, expected: "1,2"},
+		{input: `match ([1, 2, 3]) { [a, ...rest] => "${a}|${rest}" }`, expected: "1|[2, 3]"},
+		{input: `match ([1, [2, 3]]) { [x, [y, z]] => "${x + y + z}" }`, expected: "6"},
+		{input: `match ([1, [2]]) { [x, [y, z]] => "three", [x, [y]] => "two" }`, expected: "two"},
+		{input: `match ([0, 9]) { [1, x] => "one", [0, x] => "zero ${x}" }`, expected: "zero 9"},
+		{input: `match ([1, 2]) { [_, _, _] => "three", [_, _] => "two" }`, expected: "two"},
+		{input: `match (5) { [a] => "array", {a} => "hash", _ => "other" }`, expected: "other"},
+		{input: `let op = {"type": "add", "lhs": 1, "rhs": 2}; match (op) { {type: "sub", lhs, rhs} => "${lhs - rhs}", {type: "add", lhs, rhs} => "${lhs + rhs}" }`, expected: "3"},
+		{input: `match ({"a": 1}) { {a, b} => "both", {a: x} => "x=${x}" }`, expected: "x=1"},
+		{input: `match ({"p": [1, 2]}) { {p: [a, b]} => "${a * b}" }`, expected: "2"},
+		{input: `match (3) { n if n > 5 => "big", n if n > 1 => "medium", _ => "small" }`, expected: "medium"},
+		{input: `match ([4, 2]) { [a, b] if a < b => "asc", [a, b] => "desc" }`, expected: "desc"},
+		{input: `let a = "outer"; match (1) { a if false => a, _ => a }`, expected: "outer"},
+		{input: `let a = "outer"; let r = match ([1]) { [a] => a }; "${r} ${a}"`, expected: "1 outer"},
+		{input: `let f = match (2) { n => fn() { n * 10 } }; "${f()}"`, expected: "20"},
+		{input: `let describe = fn(x) { match (x) { 0 => "zero", [h, ...t] => "list", _ => "thing" } }; describe(0) + describe([1]) + describe("s")`, expected: "zerolistthing"},
+		{input: `let s = ""; for (x in [1, "a", [2]]) { s += match (x) { 1 => "I", "a" => "A", [n] => "L${n}" }; } s`, expected: "IAL2"},
+		{input: `"${match (9) { 1 => "one" }}"`, expected: "null"},
+		{input: `match (1) { 2 => 2 }`, expected: Null},
+		{input: `fn(x) { match (x) { [a, b] => a + b, _ => 0 } }([3, 4])`, expected: 7},
+		// 循环中每次匹配都是新的绑定，闭包各自捕获自己的那一个
+		{input: `let f = fn() { let fs = []; for (x in [1, 2, 3]) { fs = push(fs, match (x) { v => fn() { v } }) } [fs[0](), fs[1](), fs[2]()] }; "${f()}"`, expected: "[1, 2, 3]"},
+		{input: `let f = fn() { let fs = []; for (x in [1, 2, 3]) { fs = push(fs, match ([x]) { [v] => fn() { v } }) } [fs[0](), fs[1](), fs[2]()] }; "${f()}"`, expected: "[1, 2, 3]"},
+		{input: `let fs = []; for (x in [[1], [2]]) { fs = push(fs, match (x) { [a] => fn() { a } }) }; "${[fs[0](), fs[1]()]}"`, expected: "[1, 2]"},
+		{input: `let fs = []; for (x in [1, 2]) { fs = push(fs, match (x) { v => fn() { fn() { v } } }) }; "${[fs[0]()(), fs[1]()()]}"`, expected: "[1, 2]"},
+		{input: `let fs = []; for (x in [[1, 2], [3]]) { fs = push(fs, match (x) { [_, ...r] => fn() { r } }) }; "${[fs[0](), fs[1]()]}"`, expected: "[[2], []]"},
+		// 闭包和外面对同一次绑定的赋值互相可见
+		{input: `let r = match (1) { v => [fn() { v }, v = 2] }; "${r[0]()}"`, expected: "2"},
+		{input: `match (1) { v => fn() { let g = fn() { v }; v = 2; "${g()}" }() }`, expected: "2"},
+		{input: `let r = match (1) { v => fn() { let g = fn() { v = 3 }; g(); v }() }; "${r}"`, expected: "3"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestTryCatchFinally(t *testing.T) {
+	tests := []vmTestCase{
+		{input: `try { 1 / 0 } catch (e) { e.message }`, expected: "division by zero"},
+		{input: `try { throw "boom" } catch (e) { "caught ${e}" }`, expected: "caught boom"},
+		{input: `"${1 + try { throw 5 } catch (e) { e * 2 }}"`, expected: "11"},
+		{input: `try { "ok" } catch (e) { "caught" }`, expected: "ok"},
+		{input: `try { throw 1 } catch { "no param" }`, expected: "no param"},
+		{input: `try { len(1) } catch (e) { e.message }`, expected: "argument to `len` not supported, got INTEGER"},
+		{input: `try { let h = {[1]: 2}; h } catch (e) { e.message }`, expected: "unusable as hash key: ARRAY"},
+		{input: `try { [1, 0].map(fn(x) { 1 / x }) } catch (e) { e.message }`, expected: "division by zero"},
+		{input: `let check = fn(x) { if (x < 0) { throw {"code": 400} } x }; let f = fn(x) { check(x) + 1 }; try { f(-1) } catch (e) { "code ${e.code}" }`, expected: "code 400"},
+		{input: `let s = ""; let r = try { s += "t"; "value" } finally { s += "f" }; "${r} ${s}"`, expected: "value tf"},
+		{input: `let s = ""; try { try { throw "x" } finally { s += "inner " } } catch (e) { s += "outer ${e}" }; s`, expected: "inner outer x"},
+		{input: `let s = ""; let f = fn() { try { return "r" } finally { s += "f" } }; "${f()} ${s}"`, expected: "r f"},
+		{input: `let f = fn() { try { return "try" } finally { return "finally" } }; f()`, expected: "finally"},
+		{input: `let s = ""; for (x in [1, 2, 3]) { try { if (x == 2) { break } s += "${x}" } finally { s += "f" } }; s`, expected: "1ff"},
+		{input: `let s = ""; let i = 0; while (i < 3) { i += 1; try { if (i == 2) { continue } s += "${i}" } finally { s += "." } }; s`, expected: "1..3."},
+		{input: `let f = fn() { try { throw 1 } catch (e) { throw e + 1 } }; try { f() } catch (e) { "${e}" }`, expected: "2"},
+		{input: `let e = "outer"; try { throw "inner" } catch (e) { e }; e`, expected: "outer"},
+		{input: `let total = 0; for (x in [1, 0, 2]) { total += try { 10 / x } catch { 100 } }; "${total}"`, expected: "115"},
+		{input: `let f = fn(n) { if (n == 0) { throw "bottom" } try { f(n - 1) } finally { 0 } }; try { f(3) } catch (e) { e }`, expected: "bottom"},
+		{input: `try { 1 } finally { 2 }`, expected: 1},
+		{input: `try {} catch {}`, expected: Null},
+		// 循环中每次catch都是新的绑定
+		{input: `let f = fn() { let fs = []; for (x in [1, 2, 3]) { fs = push(fs, try { throw x } catch (e) { fn() { e } }) } [fs[0](), fs[1](), fs[2]()] }; "${f()}"`, expected: "[1, 2, 3]"},
+		{input: `let fs = []; for (x in [1, 2]) { fs = push(fs, try { throw x } catch (e) { fn() { e } }) }; "${[fs[0](), fs[1]()]}"`, expected: "[1, 2]"},
+		// 表达式中间的break先运行finally
+		{input: `let s = ""; for (x in [1, 2, 3]) { let y = [x, try { if (x == 2) { break } 0 } finally { s += "f" }]; s += "${x}" }; s`, expected: "f1f"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{input: `let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + 1) } }; loop(100000, 0)`, expected: 100000},
+		{input: `let loop = fn(n, acc) { if (n == 0) { return acc; } return loop(n - 1, acc + n); }; loop(100000, 0)`, expected: 5000050000},
+		{input: `let isOdd = null; let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1) } }; isOdd = fn(n) { if (n == 0) { false } else { isEven(n - 1) } }; isEven(100001)`, expected: false},
+		{input: `let count = fn(n, acc = 0) { if (n == 0) { acc } else { count(n - 1, acc + 1) } }; count(50000)`, expected: 50000},
+		{input: `let last = fn(first, ...rest) { if (len(rest) == 0) { first } else { last(...rest) } }; last(1, 2, 3)`, expected: 3},
+		{input: `let size = fn(x) { len(x) }; size([1, 2, 3])`, expected: 3},
+		{input: `let f = fn(n) { if (n == 0) { return "done"; } try { return f(n - 1); } catch (e) { "caught" } }; f(100)`, expected: "done"},
+		{input: `let adders = []; let make = fn(n) { if (n == 0) { adders } else { adders = push(adders, fn(x) { x + n }); make(n - 1) } }; make(3)[0](10)`, expected: 13},
+		{input: `let apply = fn(f, x) { f(x) }; apply(fn(x) { x * 2 }, 21)`, expected: 42},
+	}
+	runVmTests(t, tests)
+}
+
+func TestMemberExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{input: `let cfg = {"server": {"port": 8080}}; cfg.server.port`, expected: 8080},
+		{input: `let h = {"a": 1}; h.b`, expected: Null},
+		{input: `let h = {"len": 5}; h.len`, expected: 5},
+		{input: `let h = {"a": 1, "b": 2}; h.len()`, expected: 2},
+		{input: `let h = {}; h.x = 1; h.x += 2; h["x"]`, expected: 3},
+		{input: `"abc".upper()`, expected: "ABC"},
+		{input: `"ÀB".lower()`, expected: "àb"},
+		{input: `"  hi ".trim()`, expected: "hi"},
+		{input: `"héllo".len()`, expected: 5},
+		{input: `"a,b,c".split(",").join("-")`, expected: "a-b-c"},
+		{input: `"hello".contains("ell")`, expected: true},
+		{input: `"hello".contains("xyz") == false`, expected: true},
+		{input: `"aaa".replace("a", "b")`, expected: "bbb"},
+		{input: `[1, 2, 3].len()`, expected: 3},
+		{input: `[1, 2, 3].map(fn(x) { x * 2 }).join(",")`, expected: "2,4,6"},
+		{input: `[1, 2, 3, 4].filter(fn(x) { x % 2 == 0 }).join(",")`, expected: "2,4"},
+		{input: `[1, 2, 3].reduce(fn(acc, x) { acc + x }, 10)`, expected: 16},
+		{input: `let a = [1]; let b = a.push(2); a.len() * 10 + b.len()`, expected: 12},
+		{input: `{"b": 2, "a": 1}.keys().join(",")`, expected: "a,b"},
+		{input: `{"b": 2, "a": 1}.values().join(",")`, expected: "1,2"},
+		{input: `{"a": 1}.has("a")`, expected: true},
+		{input: `{"a": 1}.has("b")`, expected: false},
+		{input: `let up = "abc".upper; up()`, expected: "ABC"},
+		{input: `let n = 10; [1, 2].map(fn(x) { x + n }).reduce(fn(a, b) { a + b }, 0)`, expected: 23},
+		{input: `fn() { let total = 0; [1, 2, 3].map(fn(x) { total += x }); total }()`, expected: 6},
+		{input: `[[1, 2], [3]].map(fn(a) { a.map(fn(x) { x * 10 }).reduce(fn(s, x) { s + x }, 0) }).join(",")`, expected: "30,30"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestNullAndOptionalChaining(t *testing.T) {
+	tests := []vmTestCase{
+		{input: "null", expected: Null},
+		{input: "null == null", expected: true},
+		{input: "1 == null", expected: false},
+		{input: "!null", expected: true},
+		{input: "if (null) { 1 } else { 2 }", expected: 2},
+		{input: "first([]) == null", expected: true},
+		{input: "null ?? 5", expected: 5},
+		{input: "0 ?? 5", expected: 0},
+		{input: "false ?? 5", expected: false},
+		{input: "null ?? null ?? 3", expected: 3},
+		{input: "let h = {}; h[\"missing\"] ?? \"default\"", expected: "default"},
+		{input: "let calls = 0; let f = fn() { calls += 1; 1 }; 2 ?? f(); calls", expected: 0},
+		{input: "let h = null; h?.a", expected: Null},
+		{input: "let h = null; h?.a.b.c", expected: Null},
+		{input: "let h = null; h?[0][1]", expected: Null},
+		{input: "let h = null; h?.upper()", expected: Null},
+		{input: "let h = {\"a\": {\"b\": 7}}; h?.a?.b", expected: 7},
+		{input: "let h = {\"a\": null}; h.a?.b ?? 9", expected: 9},
+		{input: "let s = \"abc\"; s?.upper()", expected: "ABC"},
+		{input: "let a = [1, 2]; a?[1]", expected: 2},
+		{input: "let calls = 0; let f = fn() { calls += 1; 0 }; let a = null; a?[f()]; calls", expected: 0},
+		{input: "let h = null; h?.a ?? \"none\"", expected: "none"},
+		{input: "fn(h) { h?.a.b ?? 0 }(null)", expected: 0},
+	}
+	runVmTests(t, tests)
+}
+
+func TestInterpolatedStrings(t *testing.T) {
+	tests := []vmTestCase{
+		{input: `let name = "Monkey"; "hello ${name}"`, expected: "hello Monkey"},
+		{input: `let age = 41; "you are ${age + 1}"`, expected: "you are 42"},
+		{input: `"${1.5} ${true} ${null} ${[1, "a"]}"`, expected: "1.5 true null [1, a]"},
+		{input: `"${"nested ${1 + 1}"}!"`, expected: "nested 2!"},
+		{input: `let h = {"k": 3}; "${h["k"]}"`, expected: "3"},
+		{input: `"\${x}"`, expected: "${x}"},
+		{input: `"${fn(x) { x * 2 }(21)}"`, expected: "42"},
+		{input: `let s = "a"; for (x in [1, 2]) { s = "${s}${x}"; } s`, expected: "a12"},
+	}
+	runVmTests(t, tests)
+}
+
 func runVmTests(t *testing.T, tests []vmTestCase) {
 	t.Helper()
 
@@ -606,7 +1232,7 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 			fmt.Printf("\n")
 		}
 
-		vm := New(comp.Bytecode())
+		vm := New(comp.Bytecode(), Config{})
 		err = vm.Run()
 		if err != nil {
 			t.Fatalf("vm error: %s", err)
@@ -632,6 +1258,16 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if err != nil {
 			t.Errorf("testBooleanObject failed: %s", err)
 		}
+	case float64:
+		err := testFloatObject(expected, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
+	case string:
+		err := testStringObject(expected, actual)
+		if err != nil {
+			t.Errorf("testStringObject failed: %s", err)
+		}
 	case []int:
 		array, ok := actual.(*object.Array)
 		if !ok {
@@ -704,6 +1340,30 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g",
+			result.Value, expected)
+	}
+	return nil
+}
+
+func testStringObject(expected string, actual object.Object) error {
+	result, ok := actual.(*object.String)
+	if !ok {
+		return fmt.Errorf("object is not String. got=%T (%+v)", actual, actual)
+	}
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%q, want=%q",
+			result.Value, expected)
+	}
+	return nil
+}
+
 func testBooleanObject(expected bool, actual object.Object) error {
 	result, ok := actual.(*object.Boolean)
 	if !ok {